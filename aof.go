@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keshavchand/backendInternAssignment/queue"
+)
+
+type FsyncPolicy int
+
+const (
+	FsyncAlways FsyncPolicy = iota
+	FsyncEverySec
+	FsyncNever
+)
+
+// The log is rewritten once it doubles in size since the last rewrite
+const minRewriteSize = 64 * 1024 * 1024
+
+var (
+	ErrorInvalidFsyncPolicy = errors.New("invalid fsync policy")
+	ErrorAOFDisabled        = errors.New("append only file is disabled")
+	ErrorRewriteInProgress  = errors.New("append only file rewrite already in progress")
+	ErrorInvalidLogEntry    = errors.New("invalid append only file entry")
+)
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no", "never":
+		return FsyncNever, nil
+	}
+	return 0, ErrorInvalidFsyncPolicy
+}
+
+// AOF is an append only log of every mutation, stored as RESP arrays
+type AOF struct {
+	lock   sync.Mutex
+	path   string
+	file   *os.File
+	policy FsyncPolicy
+	dirty  bool // written since the last fsync
+
+	size     int64
+	baseSize int64 // size after the last rewrite
+
+	// While a rewrite runs new entries are also kept here, to be appended
+	// to the rewritten log once it has caught up
+	rewriting  bool
+	rewriteBuf bytes.Buffer
+
+	done chan struct{}
+}
+
+func OpenAOF(path string, policy FsyncPolicy) (*AOF, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	a := &AOF{
+		path:     path,
+		file:     file,
+		policy:   policy,
+		size:     info.Size(),
+		baseSize: info.Size(),
+		done:     make(chan struct{}),
+	}
+
+	if policy == FsyncEverySec {
+		go a.syncEverySecond()
+	}
+	return a, nil
+}
+
+func (a *AOF) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+
+		a.lock.Lock()
+		if a.dirty {
+			if err := a.file.Sync(); err != nil {
+				log.Print(err.Error())
+			}
+			a.dirty = false
+		}
+		a.lock.Unlock()
+	}
+}
+
+func encodeLogEntry(buf *bytes.Buffer, args []string) {
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// Append writes the entry straight to the file, so it survives a crash of
+// the process. Whether it survives a crash of the machine depends on the
+// fsync policy.
+func (a *AOF) Append(args ...string) {
+	var buf bytes.Buffer
+	encodeLogEntry(&buf, args)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.rewriting {
+		a.rewriteBuf.Write(buf.Bytes())
+	}
+
+	n, err := a.file.Write(buf.Bytes())
+	a.size += int64(n)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	if a.policy == FsyncAlways {
+		if err := a.file.Sync(); err != nil {
+			log.Print(err.Error())
+		}
+	} else {
+		a.dirty = true
+	}
+}
+
+func (a *AOF) NeedsRewrite() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return !a.rewriting && a.size >= minRewriteSize && a.size >= 2*a.baseSize
+}
+
+func (a *AOF) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	close(a.done)
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// EnableAOF replays the log at path, if any, and logs every further mutation to it
+func (s *Storage) EnableAOF(path string, policy FsyncPolicy) error {
+	if err := s.LoadAOF(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	aof, err := OpenAOF(path, policy)
+	if err != nil {
+		return err
+	}
+
+	s.lockAll()
+	s.aof = aof
+	s.unlockAll()
+	return nil
+}
+
+// LoadAOF applies every entry in the log at path. An entry cut short by a
+// crash in the middle of a write is dropped and truncated from the file.
+func (s *Storage) LoadAOF(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s.loading.Store(true)
+	defer s.loading.Store(false)
+
+	counter := &countingReader{r: file}
+	r := bufio.NewReader(counter)
+	var offset int64
+
+	for {
+		args, err := readRESPCommand(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("append only file %s is truncated at %d, dropping the last entry", path, offset)
+			return file.Truncate(offset)
+		}
+		if err != nil {
+			return fmt.Errorf("%s at offset %d: %w", path, offset, err)
+		}
+
+		if err := s.applyLogEntry(args); err != nil {
+			return fmt.Errorf("%s at offset %d: %w", path, offset, err)
+		}
+		offset = counter.n - int64(r.Buffered())
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Entries are applied with the log detached, so replaying doesn't log them again
+func (s *Storage) applyLogEntry(args []string) error {
+	if len(args) < 2 {
+		return ErrorInvalidLogEntry
+	}
+
+	switch args[0] {
+	case "SET":
+		var expiry *time.Time
+		switch {
+		case len(args) == 5 && args[3] == "PXAT":
+			ms, err := strconv.ParseInt(args[4], 10, 64)
+			if err != nil {
+				return ErrorInvalidLogEntry
+			}
+			expiry = new(time.Time)
+			*expiry = time.UnixMilli(ms)
+		case len(args) != 3:
+			return ErrorInvalidLogEntry
+		}
+		s.Set(args[1], args[2], expiry)
+
+	case "MSET":
+		if len(args)%2 != 1 {
+			return ErrorInvalidLogEntry
+		}
+		var keys, values []string
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+			values = append(values, args[i+1])
+		}
+		s.MSet(keys, values, false)
+
+	case "DEL":
+		s.Del(args[1:]...)
+
+	case "PEXPIREAT":
+		if len(args) != 3 {
+			return ErrorInvalidLogEntry
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		s.Expire(args[1], time.UnixMilli(ms))
+
+	case "PERSIST":
+		s.Persist(args[1])
+
+	case "HSET":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return ErrorInvalidLogEntry
+		}
+		if _, err := s.HSet(args[1], args[2:]); err != nil {
+			return ErrorInvalidLogEntry
+		}
+
+	case "HDEL":
+		if _, err := s.HDel(args[1], args[2:]...); err != nil {
+			return ErrorInvalidLogEntry
+		}
+
+	case "SADD":
+		if _, err := s.SAdd(args[1], args[2:]...); err != nil {
+			return ErrorInvalidLogEntry
+		}
+
+	case "SREM":
+		if _, err := s.SRem(args[1], args[2:]...); err != nil {
+			return ErrorInvalidLogEntry
+		}
+
+	// The result of SINTERSTORE, SUNIONSTORE or SDIFFSTORE
+	case "SSTORE":
+		if len(args) < 3 {
+			return ErrorInvalidLogEntry
+		}
+		s.restoreValue(args[1], Value{set: newSet(args[2:])})
+
+	case "ZADD":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return ErrorInvalidLogEntry
+		}
+		members := make([]ZMember, 0, len(args[2:])/2)
+		for i := 2; i < len(args); i += 2 {
+			score, ok := parseScore(args[i])
+			if !ok {
+				return ErrorInvalidLogEntry
+			}
+			members = append(members, ZMember{Member: args[i+1], Score: score})
+		}
+		if _, err := s.ZAdd(args[1], members, ZAddOptions{}); err != nil {
+			return ErrorInvalidLogEntry
+		}
+
+	case "ZREM":
+		if _, err := s.ZRem(args[1], args[2:]...); err != nil {
+			return ErrorInvalidLogEntry
+		}
+
+	case "QPUSH":
+		s.restorePush(args[1], args[2:], 0, false)
+
+	case "QPUSHFRONT":
+		s.restorePush(args[1], args[2:], 0, true)
+
+	case "QPUSHPRIORITY":
+		if len(args) < 4 {
+			return ErrorInvalidLogEntry
+		}
+		priority, err := strconv.Atoi(args[2])
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		s.restorePush(args[1], args[3:], priority, false)
+
+	case "QPOP":
+		s.QPop(args[1])
+
+	case "QMOVE":
+		if len(args) != 3 {
+			return ErrorInvalidLogEntry
+		}
+		s.QMove(args[1], args[2], nil)
+
+	case "QPOPBACK":
+		s.QPopBack(args[1])
+
+	case "QREM":
+		if len(args) != 4 {
+			return ErrorInvalidLogEntry
+		}
+		count, err := strconv.Atoi(args[2])
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		s.QRem(args[1], count, args[3])
+
+	case "QPUSHAT":
+		if len(args) < 5 {
+			return ErrorInvalidLogEntry
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		priority, err := strconv.Atoi(args[3])
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		s.restoreDelayed(args[1], args[4:], priority, time.UnixMilli(ms))
+
+	case "QPROMOTE":
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		s.promoteAt(time.UnixMilli(ms))
+
+	case "QLEASE":
+		if len(args) != 4 {
+			return ErrorInvalidLogEntry
+		}
+		ms, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		s.popLeased(args[1], args[2], time.UnixMilli(ms))
+
+	// Written by rewrites, the value was popped before the rewrite started
+	case "QLEASED":
+		if len(args) != 7 {
+			return ErrorInvalidLogEntry
+		}
+		ms, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		deliveries, err := strconv.Atoi(args[4])
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		priority, err := strconv.Atoi(args[5])
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		s.restoreLease(args[1], args[6], priority, deliveries, args[2], time.UnixMilli(ms))
+
+	// Written by rewrites
+	case "QDELIVERIES":
+		deliveries := make([]int, 0, len(args)-2)
+		for _, arg := range args[2:] {
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return ErrorInvalidLogEntry
+			}
+			deliveries = append(deliveries, n)
+		}
+		return s.setDeliveries(args[1], deliveries)
+
+	case "QSETDLQ":
+		if len(args) != 4 {
+			return ErrorInvalidLogEntry
+		}
+		maxDeliveries, err := strconv.Atoi(args[3])
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		s.restoreDeadLetter(args[1], args[2], maxDeliveries)
+
+	case "QREDRIVE":
+		if len(args) != 3 {
+			return ErrorInvalidLogEntry
+		}
+		count, err := strconv.Atoi(args[2])
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		s.QRedrive(args[1], count)
+
+	case "QSETCAP":
+		if len(args) != 4 {
+			return ErrorInvalidLogEntry
+		}
+		capacity, err := strconv.Atoi(args[2])
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		policy, ok := queue.ParseOverflowPolicy(args[3])
+		if !ok {
+			return ErrorInvalidLogEntry
+		}
+		s.QSetCapacity(args[1], capacity, policy)
+
+	case "XADD":
+		if len(args) < 5 || len(args)%2 != 1 {
+			return ErrorInvalidLogEntry
+		}
+		id, ok := parseStreamID(args[2], 0)
+		if !ok {
+			return ErrorInvalidLogEntry
+		}
+		if _, err := s.XAdd(args[1], &id, args[3:]); err != nil {
+			return ErrorInvalidLogEntry
+		}
+
+	case "XGROUP":
+		switch {
+		case len(args) == 6 && args[1] == "CREATE":
+			id, ok := parseStreamID(args[4], 0)
+			if !ok {
+				return ErrorInvalidLogEntry
+			}
+			if err := s.XGroupCreate(args[2], args[3], &id, true); err != nil {
+				return ErrorInvalidLogEntry
+			}
+		case len(args) == 4 && args[1] == "DESTROY":
+			s.XGroupDestroy(args[2], args[3])
+		default:
+			return ErrorInvalidLogEntry
+		}
+
+	case "XDELIVER", "XCLAIM":
+		if len(args) < 6 {
+			return ErrorInvalidLogEntry
+		}
+		ms, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		ids, ok := parseStreamIDs(args[5:])
+		if !ok {
+			return ErrorInvalidLogEntry
+		}
+		return s.restoreDelivery(args[1], args[2], args[3], time.UnixMilli(ms), ids, 0)
+
+	// Written by rewrites
+	case "XPEL":
+		if len(args) != 7 {
+			return ErrorInvalidLogEntry
+		}
+		ms, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil {
+			return ErrorInvalidLogEntry
+		}
+		deliveries, err := strconv.Atoi(args[5])
+		if err != nil || deliveries <= 0 {
+			return ErrorInvalidLogEntry
+		}
+		ids, ok := parseStreamIDs(args[6:])
+		if !ok {
+			return ErrorInvalidLogEntry
+		}
+		return s.restoreDelivery(args[1], args[2], args[3], time.UnixMilli(ms), ids, deliveries)
+
+	case "XACK":
+		if len(args) < 4 {
+			return ErrorInvalidLogEntry
+		}
+		ids, ok := parseStreamIDs(args[3:])
+		if !ok {
+			return ErrorInvalidLogEntry
+		}
+		s.XAck(args[1], args[2], ids)
+
+	case "QACK":
+		if len(args) != 3 {
+			return ErrorInvalidLogEntry
+		}
+		s.QAck(args[1], args[2])
+
+	case "QNACK":
+		if len(args) != 3 {
+			return ErrorInvalidLogEntry
+		}
+		s.QNack(args[1], args[2])
+
+	default:
+		return ErrorInvalidLogEntry
+	}
+
+	return nil
+}
+
+// RewriteAOF replaces the log with the shortest one producing the current
+// state. Only copying the state blocks other commands, the writing happens
+// while new entries are buffered.
+func (s *Storage) RewriteAOF() error {
+	a, state, err := s.startAOFRewrite()
+	if err != nil {
+		return err
+	}
+	return a.rewrite(state)
+}
+
+// BackgroundRewriteAOF is RewriteAOF without waiting for the writing
+func (s *Storage) BackgroundRewriteAOF() error {
+	a, state, err := s.startAOFRewrite()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := a.rewrite(state); err != nil {
+			log.Print(err.Error())
+		}
+	}()
+	return nil
+}
+
+func (s *Storage) startAOFRewrite() (*AOF, storageState, error) {
+	s.lockAll()
+	defer s.unlockAll()
+
+	a := s.aof
+	if a == nil {
+		return nil, storageState{}, ErrorAOFDisabled
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.rewriting {
+		return nil, storageState{}, ErrorRewriteInProgress
+	}
+	a.rewriting = true
+	a.rewriteBuf.Reset()
+
+	return a, s.copyStateLocked(), nil
+}
+
+func (a *AOF) rewrite(state storageState) error {
+	tmpPath := a.path + ".rewrite"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		a.lock.Lock()
+		a.rewriting = false
+		a.rewriteBuf.Reset()
+		a.lock.Unlock()
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	var buf bytes.Buffer
+	writeEntry := func(args ...string) {
+		buf.Reset()
+		encodeLogEntry(&buf, args)
+		w.Write(buf.Bytes())
+	}
+
+	for k, v := range state.KV {
+		switch {
+		case v.hash != nil:
+			writeEntry(hashLogEntry(k, v.hash)...)
+		case v.set != nil:
+			writeEntry(append([]string{"SADD", k}, sortedMembers(v.set)...)...)
+		case v.zset != nil:
+			writeEntry(zsetLogEntry(k, v.zset)...)
+		default:
+			writeEntry(setLogEntry(k, v)...)
+			continue
+		}
+		if v.expiry != nil {
+			writeEntry("PEXPIREAT", k, strconv.FormatInt(v.expiry.UnixMilli(), 10))
+		}
+	}
+	for k, values := range state.Queue {
+		priorityRuns(values, state.Priorities[k], func(values []string, priority int) {
+			writeEntry(pushLogEntry(k, values, priority)...)
+		})
+
+		if deliveries, found := state.Deliveries[k]; found {
+			entry := []string{"QDELIVERIES", k}
+			for _, n := range deliveries {
+				entry = append(entry, strconv.Itoa(n))
+			}
+			writeEntry(entry...)
+		}
+	}
+	for _, l := range state.Leases {
+		writeEntry("QLEASED", l.key, l.receipt, strconv.FormatInt(l.deadline.UnixMilli(), 10),
+			strconv.Itoa(l.node.deliveries), strconv.Itoa(l.node.priority), l.node.value)
+	}
+	for k, c := range state.DeadLetters {
+		writeEntry("QSETDLQ", k, c.key, strconv.Itoa(c.maxDeliveries))
+	}
+	// After the values, which may not fit anymore
+	for k, l := range state.Limits {
+		writeEntry("QSETCAP", k, strconv.Itoa(l.Capacity), l.Policy.String())
+	}
+	for _, d := range state.Delayed {
+		writeEntry(delayedLogEntry(d.key, d.values, d.priority, d.at)...)
+	}
+	for k, st := range state.Streams {
+		for _, e := range st.entries {
+			writeEntry(append([]string{"XADD", k, e.ID.String()}, e.Fields...)...)
+		}
+		for name, g := range st.groups {
+			writeEntry("XGROUP", "CREATE", k, name, g.lastDelivered.String(), "MKSTREAM")
+			for _, id := range g.pendingIDs("") {
+				p := g.pending[id]
+				writeEntry("XPEL", k, name, p.consumer, strconv.FormatInt(p.delivered.UnixMilli(), 10),
+					strconv.Itoa(p.deliveries), id.String())
+			}
+		}
+	}
+	for k, at := range state.Expiries {
+		writeEntry("PEXPIREAT", k, strconv.FormatInt(at.UnixMilli(), 10))
+	}
+
+	// Syncing the bulk of the file first keeps the final sync under the lock short
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		a.rewriting = false
+		a.rewriteBuf.Reset()
+		return err
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := tmp.Write(a.rewriteBuf.Bytes()); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmpPath, a.path); err != nil {
+		return fail(err)
+	}
+
+	// The file was opened without O_APPEND, its offset is already at the end
+	a.file.Close()
+	a.file = tmp
+	a.size = info.Size()
+	a.baseSize = a.size
+	a.dirty = false
+	a.rewriting = false
+	a.rewriteBuf.Reset()
+	return nil
+}
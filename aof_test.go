@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAOFReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	s := NewStorage()
+	if err := s.EnableAOF(path, FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := new(time.Time)
+	*expiry = time.Now().Add(time.Hour)
+	expired := new(time.Time)
+	*expired = time.Now().Add(-time.Second)
+
+	s.Set("a", "1", nil)
+	s.Set("b", "2", expiry)
+	s.Set("c", "3", expired)
+	s.QPush("q", []string{"x", "y", "z"})
+	s.QPop("q")
+	s.QSetDeadLetter("jobs", "jobs:dead", 2)
+	s.QPush("jobs", []string{"j1", "j2", "j3"})
+	acked, _ := s.QPopAny([]string{"jobs"}, nil, time.Hour)
+	s.QAck("jobs", acked.Receipt)
+	nacked, _ := s.QPopAny([]string{"jobs"}, nil, time.Hour)
+	s.QNack("jobs", nacked.Receipt)
+	leased, _ := s.QPopAny([]string{"jobs"}, nil, time.Hour)
+	s.QPushAt("delayed", []string{"d1"}, 0, time.Now().Add(20*time.Millisecond))
+	s.QPushAt("delayed", []string{"d2"}, 0, time.Now().Add(time.Hour))
+	time.Sleep(30 * time.Millisecond)
+	s.QPop("empty") // Promotes d1
+	s.QPush("delayed", []string{"d3"})
+	s.QPush("prio", []string{"p0"})
+	s.QPushPriority("prio", []string{"p5a", "p5b"}, 5)
+	s.QPushAt("prio", []string{"p9"}, 9, time.Now().Add(time.Hour))
+	s.QSetCapacity("capped", 2, OverflowDropOldest)
+	s.QPush("capped", []string{"c1", "c2", "c3"})
+	s.QPush("deque", []string{"b", "x", "c", "x", "d"})
+	s.QPushFront("deque", []string{"a"})
+	s.QPopBack("deque")
+	s.QRem("deque", 0, "x")
+	s.QPush("source", []string{"m1", "m2"})
+	s.QMove("source", "deque", nil)
+	s.Expire("source", *expiry)
+	fillStreams(s)
+	s.Expire("empty", *expiry)
+	s.HSet("user", []string{"name", "ann", "age", "30", "tmp", "x"})
+	s.HDel("user", "tmp")
+	s.HIncrBy("user", "age", 1)
+	s.Expire("user", *expiry)
+	s.SAdd("tags", "a", "b", "c", "d")
+	s.SRem("tags", "d")
+	s.SAdd("other", "b", "c", "x")
+	s.SCombineStore(SetInter, "common", "tags", "other")
+	fillSortedSets(s)
+	s.Expire("other", time.Now().Add(20*time.Millisecond))
+	time.Sleep(30 * time.Millisecond)
+	s.aof.Close()
+
+	replayed := NewStorage()
+	if err := replayed.LoadAOF(path); err != nil {
+		t.Fatal(err)
+	}
+	checkReplayed(t, replayed, expiry)
+	checkLeaseReplayed(t, replayed, leased)
+	checkDelayedReplayed(t, replayed)
+	checkCapacityReplayed(t, replayed)
+	if values, _ := replayed.QRange("deque", 0, -1); strings.Join(values, " ") != "a b c m1" {
+		t.Fatalf("Expected [a b c m1], got %+v", values)
+	}
+	if values, _ := replayed.QRange("source", 0, -1); strings.Join(values, " ") != "m2" {
+		t.Fatalf("Expected [m2], got %+v", values)
+	}
+	checkStreamsReplayed(t, replayed)
+	checkHashReplayed(t, replayed, expiry)
+	checkSetsReplayed(t, replayed)
+	checkSortedSetsReplayed(t, replayed)
+	checkExpiriesReplayed(t, replayed, expiry, "source", "empty")
+
+	// A rewrite must produce the same state
+	s = NewStorage()
+	if err := s.EnableAOF(path, FsyncNever); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	s.aof.Close()
+
+	replayed = NewStorage()
+	if err := replayed.LoadAOF(path); err != nil {
+		t.Fatal(err)
+	}
+	checkReplayed(t, replayed, expiry)
+	checkLeaseReplayed(t, replayed, leased)
+	checkDelayedReplayed(t, replayed)
+	checkCapacityReplayed(t, replayed)
+	if values, _ := replayed.QRange("deque", 0, -1); strings.Join(values, " ") != "a b c m1" {
+		t.Fatalf("Expected [a b c m1], got %+v", values)
+	}
+	if values, _ := replayed.QRange("source", 0, -1); strings.Join(values, " ") != "m2" {
+		t.Fatalf("Expected [m2], got %+v", values)
+	}
+	checkStreamsReplayed(t, replayed)
+	checkHashReplayed(t, replayed, expiry)
+	checkSetsReplayed(t, replayed)
+	checkSortedSetsReplayed(t, replayed)
+	checkExpiriesReplayed(t, replayed, expiry, "source", "empty")
+}
+
+func checkSetsReplayed(t *testing.T, s *Storage) {
+	t.Helper()
+
+	if members, err := s.SMembers("tags"); err != nil || strings.Join(members, " ") != "a b c" {
+		t.Fatalf("Expected [a b c], got %+v %+v", members, err)
+	}
+	// Stored while other was still there
+	if members, err := s.SMembers("common"); err != nil || strings.Join(members, " ") != "b c" {
+		t.Fatalf("Expected [b c], got %+v %+v", members, err)
+	}
+}
+
+// Queues and streams expire like every other key
+func checkExpiriesReplayed(t *testing.T, s *Storage, expiry *time.Time, keys ...string) {
+	t.Helper()
+
+	for _, key := range keys {
+		if got, err := s.Expiry(key); err != nil || got == nil || got.UnixMilli() != expiry.UnixMilli() {
+			t.Fatalf("Expected %s to expire at %v, got %v %+v", key, expiry, got, err)
+		}
+	}
+}
+
+func fillSortedSets(s *Storage) {
+	s.ZAdd("board", []ZMember{{"alice", 30}, {"bob", 10}, {"carol", 20}, {"dave", math.Inf(1)}}, ZAddOptions{})
+	s.ZAdd("board", []ZMember{{"erin", 0.1}, {"low", math.Inf(-1)}}, ZAddOptions{})
+	s.ZIncrBy("board", "bob", 5, ZAddOptions{})
+	s.ZRem("board", "carol")
+	s.ZPop("board", 1, true)
+}
+
+func checkSortedSetsReplayed(t *testing.T, s *Storage) {
+	t.Helper()
+
+	members, err := s.ZRange("board", ZRangeQuery{Start: 0, Stop: -1})
+	expected := []ZMember{{"low", math.Inf(-1)}, {"erin", 0.1}, {"bob", 15}, {"alice", 30}}
+	if err != nil || fmt.Sprint(members) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %+v, got %+v %+v", expected, members, err)
+	}
+}
+
+func checkHashReplayed(t *testing.T, s *Storage, expiry *time.Time) {
+	t.Helper()
+
+	fieldValues, err := s.HGetAll("user")
+	if err != nil || strings.Join(fieldValues, " ") != "age 31 name ann" {
+		t.Fatalf("Expected [age 31 name ann], got %+v %+v", fieldValues, err)
+	}
+	if got, _ := s.Expiry("user"); got == nil || got.UnixMilli() != expiry.UnixMilli() {
+		t.Fatalf("Expected expiry %v, got %v", expiry, got)
+	}
+}
+
+func checkReplayed(t *testing.T, s *Storage, expiry *time.Time) {
+	t.Helper()
+
+	if v, err := s.Get("a"); err != nil || v != "1" {
+		t.Fatalf("Expected 1, got %s %+v", v, err)
+	}
+	if v, err := s.Get("b"); err != nil || v != "2" {
+		t.Fatalf("Expected 2, got %s %+v", v, err)
+	}
+	if got := s.KV["b"].expiry; got == nil || got.UnixMilli() != expiry.UnixMilli() {
+		t.Fatalf("Expected expiry %v, got %v", expiry, got)
+	}
+	if _, err := s.Get("c"); err != ErrorKeyNotFound {
+		t.Fatalf("Expected key not found, got %+v", err)
+	}
+
+	for _, expected := range []string{"y", "z"} {
+		v, err := s.QPop("q")
+		if err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+	}
+	if _, err := s.QPop("q"); err != ErrorEmptyQueue {
+		t.Fatalf("Expected empty queue, got %+v", err)
+	}
+}
+
+func checkLeaseReplayed(t *testing.T, s *Storage, leased Popped) {
+	t.Helper()
+
+	if v, err := s.QPop("jobs"); err != nil || v != "j3" {
+		t.Fatalf("Expected j3, got %s %+v", v, err)
+	}
+
+	// Its second delivery, so it is dead lettered
+	if !s.QNack("jobs", leased.Receipt) {
+		t.Fatal("Expected the lease to be restored")
+	}
+	if values, err := s.QDeadLetters("jobs", 10); err != nil || len(values) != 1 || values[0] != leased.Value {
+		t.Fatalf("Expected [%s], got %+v %+v", leased.Value, values, err)
+	}
+}
+
+func checkDelayedReplayed(t *testing.T, s *Storage) {
+	t.Helper()
+
+	// d1 was promoted before d3 was pushed, d2 isn't due yet
+	for _, expected := range []string{"d1", "d3"} {
+		v, err := s.QPop("delayed")
+		if err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+	}
+	if _, err := s.QPop("delayed"); err != ErrorEmptyQueue {
+		t.Fatalf("Expected empty queue, got %+v", err)
+	}
+	for _, expected := range []string{"p5a", "p5b", "p0"} {
+		v, err := s.QPop("prio")
+		if err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+	}
+	if len(s.delayed) != 2 {
+		t.Fatalf("Expected d2 and p9 to still be delayed, got %+v", s.delayed)
+	}
+	for _, d := range s.delayed {
+		if d.values[0] == "p9" && d.priority != 9 {
+			t.Fatalf("Expected p9 to keep its priority, got %+v", d)
+		}
+	}
+}
+
+// Three entries, the first acknowledged and the second pending for c1
+func fillStreams(s *Storage) {
+	s.XAdd("events", &StreamID{1, 1}, []string{"n", "1"})
+	s.XAdd("events", nil, []string{"n", "2"})
+	s.XAdd("events", nil, []string{"n", "3"})
+	s.XGroupCreate("events", "g", &StreamID{}, false)
+	s.XReadGroup("g", "c1", []string{"events"}, []*StreamID{nil}, 2, nil)
+	s.XAck("events", "g", []StreamID{{1, 1}})
+	s.XGroupCreate("empty", "g", nil, true)
+}
+
+func checkStreamsReplayed(t *testing.T, s *Storage) {
+	t.Helper()
+
+	entries, _ := s.XRange("events", StreamID{}, maxStreamID, 10)
+	if len(entries) != 3 || entries[0].ID != (StreamID{1, 1}) || entries[2].Fields[1] != "3" {
+		t.Fatalf("Expected the three entries, got %+v", entries)
+	}
+	pending, err := s.XPending("events", "g")
+	if err != nil || len(pending) != 1 || pending[0].ID != entries[1].ID || pending[0].Consumer != "c1" || pending[0].Deliveries != 1 {
+		t.Fatalf("Expected the second entry to be pending for c1, got %+v %+v", pending, err)
+	}
+	read, err := s.XReadGroup("g", "c2", []string{"events"}, []*StreamID{nil}, 10, nil)
+	if err != nil || len(read) != 1 || len(read[0].Entries) != 1 || read[0].Entries[0].ID != entries[2].ID {
+		t.Fatalf("Expected the third entry, got %+v %+v", read, err)
+	}
+	if err := s.XGroupCreate("empty", "g", nil, false); err != ErrorGroupExists {
+		t.Fatalf("Expected the empty stream and its group, got %+v", err)
+	}
+}
+
+func checkCapacityReplayed(t *testing.T, s *Storage) {
+	t.Helper()
+
+	if l := s.limits["capped"]; l != (queueLimit{Capacity: 2, Policy: OverflowDropOldest}) {
+		t.Fatalf("Expected the capacity to be restored, got %+v", l)
+	}
+	for _, expected := range []string{"c2", "c3"} {
+		v, err := s.QPop("capped")
+		if err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+	}
+}
+
+func TestAOFTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	content := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$2\r\n2"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorage()
+	if err := s.LoadAOF(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := s.Get("a"); err != nil || v != "1" {
+		t.Fatalf("Expected 1, got %s %+v", v, err)
+	}
+	if _, err := s.Get("b"); err != ErrorKeyNotFound {
+		t.Fatalf("Expected key not found, got %+v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n")) {
+		t.Fatalf("Expected the partial entry to be truncated, size %d", info.Size())
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/keshavchand/backendInternAssignment/queue"
+)
+
+// Storage bounds its queues with the queue package's limits, so a full queue
+// behaves the same whichever one serves it
+type (
+	OverflowPolicy = queue.OverflowPolicy
+	queueLimit     = queue.Limit
+)
+
+const (
+	OverflowReject     = queue.OverflowReject
+	OverflowBlock      = queue.OverflowBlock
+	OverflowDropOldest = queue.OverflowDropOldest
+)
+
+// A client blocked pushing to a full queue, see QPushTimeout
+type queueProducer struct {
+	values   []string
+	priority int
+	front    bool
+
+	served bool
+	err    error         // set if the queue went away instead
+	ready  chan struct{} // closed once pushed
+}
+
+// QSetCapacity limits the queue at key to capacity values, zero capacity
+// removes the limit. Values already there are kept even if they don't fit.
+func (s *Storage) QSetCapacity(key string, capacity int, policy OverflowPolicy) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	if capacity <= 0 {
+		delete(s.limits, key)
+	} else {
+		s.limits[key] = queueLimit{Capacity: capacity, Policy: policy}
+	}
+	s.log("QSETCAP", key, strconv.Itoa(capacity), policy.String())
+
+	if queue, _ := s.queueLocked(key); queue != nil {
+		s.admitLocked(key, queue)
+	}
+}
+
+// QPushTimeout is QPushPriority waiting until timeout for room when the
+// queue is full and its policy is OverflowBlock. Blocked pushes go in in the
+// order they started waiting.
+func (s *Storage) QPushTimeout(key string, value []string, priority int, timeout *time.Time) error {
+	return s.push(key, value, priority, false, timeout)
+}
+
+// Pushes at the end pops take values from if front is set, dropping values
+// from the other end when the queue is full and its policy is
+// OverflowDropOldest
+func (s *Storage) push(key string, value []string, priority int, front bool, timeout *time.Time) error {
+	if len(value) <= 0 {
+		return nil
+	}
+
+	s.kvLock.Lock()
+
+	queue, err := s.queueLocked(key)
+	if err != nil {
+		s.kvLock.Unlock()
+		return err
+	}
+	// Only created once values go in
+	length, producers := 0, 0
+	if queue != nil {
+		length, producers = queue.length, len(queue.producers)
+	}
+
+	limit := s.limits[key]
+	switch {
+	case producers == 0 && limit.Fits(length, len(s.queueWaiters[key]), len(value)):
+		s.pushValuesLocked(key, value, priority, front)
+		s.kvLock.Unlock()
+		return nil
+
+	case limit.Policy == OverflowDropOldest:
+		s.pushValuesLocked(key, value, priority, front)
+		// Logged as pops, so the log replays without limits
+		queue, _ = s.queueLocked(key)
+		for queue != nil && queue.length > limit.Capacity {
+			if front {
+				queue.popBack()
+				s.log("QPOPBACK", key)
+			} else {
+				queue.pop()
+				s.log("QPOP", key)
+			}
+		}
+		s.kvLock.Unlock()
+		return nil
+
+	case !limit.Blocks(len(value), timeout):
+		s.kvLock.Unlock()
+		return ErrorQueueFull
+	}
+
+	// Values that don't fit means there is a queue
+	p := &queueProducer{values: value, priority: priority, front: front, ready: make(chan struct{})}
+	queue.producers = append(queue.producers, p)
+	s.kvLock.Unlock()
+
+	timer := time.NewTimer(time.Until(*timeout))
+	defer timer.Stop()
+
+	select {
+	case <-p.ready:
+		return p.err
+	case <-timer.C:
+	}
+
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	// Pushed between the timer firing and taking the lock
+	if p.served {
+		return p.err
+	}
+
+	for i, other := range queue.producers {
+		if other == p {
+			queue.producers = append(queue.producers[:i], queue.producers[i+1:]...)
+			break
+		}
+	}
+	return ErrorQueueFull
+}
+
+// Must be called with kvLock held
+func (s *Storage) pushValuesLocked(key string, value []string, priority int, front bool) {
+	// Pushes to the front have the default priority
+	if front {
+		s.log(append([]string{"QPUSHFRONT", key}, value...)...)
+		for _, v := range value {
+			s.pushFrontLocked(key, &QueueNode{value: v})
+		}
+		return
+	}
+
+	first, last := newQueueNodes(value, priority)
+	s.log(pushLogEntry(key, value, priority)...)
+	s.pushLocked(key, first, last)
+}
+
+// Pushes the values of blocked producers that fit now, in the order they
+// started waiting. Must be called with kvLock held.
+func (s *Storage) admitLocked(key string, queue *Queue) {
+	limit := s.limits[key]
+	for len(queue.producers) > 0 {
+		p := queue.producers[0]
+		if !limit.Fits(queue.length, len(s.queueWaiters[key]), len(p.values)) {
+			return
+		}
+		queue.producers = queue.producers[1:]
+
+		s.pushValuesLocked(key, p.values, p.priority, p.front)
+		p.served = true
+		close(p.ready)
+	}
+}
+
+// Replays a QPUSH, QPUSHPRIORITY or QPUSHFRONT log entry, or restores values
+// from a snapshot. Limits were checked when the values were first pushed.
+func (s *Storage) restorePush(key string, values []string, priority int, front bool) {
+	if len(values) <= 0 {
+		return
+	}
+
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	s.pushValuesLocked(key, values, priority, front)
+}
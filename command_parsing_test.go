@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"strings"
 	"testing"
 	"time"
@@ -97,6 +100,38 @@ func TestQPush(t *testing.T) {
 				t.Errorf("%d: Expected %s, got %s", idx, tc.output.Value[i], v)
 			}
 		}
+
+		if qPush.At != nil {
+			t.Errorf("%d: Expected no delay, got %s", idx, qPush.At)
+		}
+	}
+
+	qPush, err := parseQPushCommand([]string{"a", "delay", "10", "b", "c"})
+	if err != nil || qPush.At == nil || time.Until(*qPush.At) < 9*time.Second || len(qPush.Value) != 2 {
+		t.Fatalf("Unexpected %+v %+v", qPush, err)
+	}
+	qPush, err = parseQPushCommand([]string{"a", "AT", "1700000000", "b"})
+	if err != nil || qPush.At == nil || qPush.At.Unix() != 1700000000 {
+		t.Fatalf("Unexpected %+v %+v", qPush, err)
+	}
+
+	// Without a value after it the option is the value
+	qPush, err = parseQPushCommand([]string{"a", "DELAY", "10"})
+	if err != nil || qPush.At != nil || len(qPush.Value) != 2 {
+		t.Fatalf("Unexpected %+v %+v", qPush, err)
+	}
+	if _, err := parseQPushCommand([]string{"a", "DELAY", "soon", "b"}); err != ErrorInvalidQPushCommand {
+		t.Fatalf("Expected an error, got %+v", err)
+	}
+
+	qPush, err = parseQPushCommand([]string{"a", "priority", "-5", "DELAY", "10", "b"})
+	if err != nil || qPush.Priority != -5 || qPush.At == nil || len(qPush.Value) != 1 {
+		t.Fatalf("Unexpected %+v %+v", qPush, err)
+	}
+	for _, input := range []string{"a PRIORITY high b", "a PRIORITY 1 PRIORITY 2 b", "a AT 1 DELAY 1 b"} {
+		if _, err := parseQPushCommand(strings.Split(input, " ")); err != ErrorInvalidQPushCommand {
+			t.Errorf("%s: Expected an error, got %+v", input, err)
+		}
 	}
 }
 
@@ -106,6 +141,7 @@ func TestQPop(t *testing.T) {
 		output QPop
 	}{
 		{"a", QPop{Key: "a"}},
+		{"a lease 30", QPop{Key: "a", Lease: 30 * time.Second}},
 	}
 
 	for idx, tc := range testCases {
@@ -115,12 +151,29 @@ func TestQPop(t *testing.T) {
 			t.Errorf("%d: %s %+v", idx, tc.input, err)
 		}
 
-		if qPop.Key != tc.output.Key {
-			t.Errorf("%d: Expected %s, got %s", idx, tc.output.Key, qPop.Key)
+		if qPop != tc.output {
+			t.Errorf("%d: Expected %+v, got %+v", idx, tc.output, qPop)
+		}
+	}
+
+	for _, input := range []string{"a LEASE", "a LEASE 0", "a TTL 10", "a b"} {
+		if _, err := parseQPopCommand(strings.Split(input, " ")); err != ErrorInvalidQPopCommand {
+			t.Errorf("%s: Expected an error, got %+v", input, err)
 		}
 	}
 }
 
+func TestBQPopWithoutTimeout(t *testing.T) {
+	bqPop, err := parseBQPopCommand([]string{"a"})
+	if err != nil || len(bqPop.Keys) != 1 || bqPop.Keys[0] != "a" || bqPop.Timeout != nil {
+		t.Fatalf("Unexpected %+v %+v", bqPop, err)
+	}
+
+	if _, err := parseBQPopCommand([]string{"a", "b"}); err != ErrorInvalidBQPopCommand {
+		t.Fatalf("Expected the last key to be parsed as a timeout, got %+v", err)
+	}
+}
+
 func TestBQPop(t *testing.T) {
 	expireIn10Sec := new(time.Time)
 	*expireIn10Sec = time.Now().Add(10 * time.Second)
@@ -129,7 +182,10 @@ func TestBQPop(t *testing.T) {
 		input  string
 		output BQPop
 	}{
-		{"a 10", BQPop{Key: "a", Timeout: expireIn10Sec}},
+		{"a 10", BQPop{Keys: []string{"a"}, Timeout: expireIn10Sec}},
+		{"a b c 10", BQPop{Keys: []string{"a", "b", "c"}, Timeout: expireIn10Sec}},
+		{"a 10 LEASE 30", BQPop{Keys: []string{"a"}, Timeout: expireIn10Sec, Lease: 30 * time.Second}},
+		{"a LEASE 10", BQPop{Keys: []string{"a", "LEASE"}, Timeout: expireIn10Sec}},
 	}
 
 	for idx, tc := range testCases {
@@ -139,12 +195,602 @@ func TestBQPop(t *testing.T) {
 			t.Errorf("%d: %s %+v", idx, tc.input, err)
 		}
 
-		if bqPop.Key != tc.output.Key {
-			t.Errorf("%d: Expected %s, got %s", idx, tc.output.Key, bqPop.Key)
+		if strings.Join(bqPop.Keys, " ") != strings.Join(tc.output.Keys, " ") {
+			t.Errorf("%d: Expected %s, got %s", idx, tc.output.Keys, bqPop.Keys)
 		}
 
 		if bqPop.Timeout.Sub(*tc.output.Timeout) > 100*time.Millisecond {
 			t.Errorf("Output Time different from expected")
 		}
+
+		if bqPop.Lease != tc.output.Lease {
+			t.Errorf("%d: Expected lease %s, got %s", idx, tc.output.Lease, bqPop.Lease)
+		}
+	}
+}
+
+func TestQAck(t *testing.T) {
+	qAck, err := parseQAckCommand([]string{"jobs", "r1"})
+	if err != nil || qAck.Key != "jobs" || qAck.Receipt != "r1" {
+		t.Fatalf("Unexpected %+v %+v", qAck, err)
+	}
+	if _, err := parseQNackCommand([]string{"jobs"}); err != ErrorInvalidQNackCommand {
+		t.Fatalf("Expected an error, got %+v", err)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output []string
+	}{
+		{"SET a 10", []string{"SET", "a", "10"}},
+		{"  SET   a\t10  ", []string{"SET", "a", "10"}},
+		{`SET a "hello world"`, []string{"SET", "a", "hello world"}},
+		{`SET a 'hello world'`, []string{"SET", "a", "hello world"}},
+		{`SET a ""`, []string{"SET", "a", ""}},
+		{`SET a "line\none \"quoted\" \x41\x7a"`, []string{"SET", "a", "line\none \"quoted\" Az"}},
+		{`SET a 'it\'s \n'`, []string{"SET", "a", `it's \n`}},
+		{`SET a b"c`, []string{"SET", "a", `b"c`}},
+	}
+
+	for idx, tc := range testCases {
+		args, err := Tokenize(tc.input)
+		if err != nil {
+			t.Errorf("%d: %s %+v", idx, tc.input, err)
+			continue
+		}
+
+		if len(args) != len(tc.output) {
+			t.Errorf("%d: Expected %q, got %q", idx, tc.output, args)
+			continue
+		}
+		for i := range args {
+			if args[i] != tc.output[i] {
+				t.Errorf("%d: Expected %q, got %q", idx, tc.output[i], args[i])
+			}
+		}
+	}
+}
+
+func TestTokenizeErrors(t *testing.T) {
+	testCases := []struct {
+		input string
+		err   error
+		msg   string
+	}{
+		{`SET a "hello`, ErrorUnterminatedQuote, "unterminated quote at position 6"},
+		{`SET a 'hello`, ErrorUnterminatedQuote, "unterminated quote at position 6"},
+		{`SET a "hello"world`, ErrorQuoteNotClosed, "closing quote must be followed by a space at position 13"},
+		{`SET a "\xZZ"`, ErrorInvalidEscape, "invalid escape sequence at position 7"},
+		{`SET a "\q"`, ErrorInvalidEscape, "invalid escape sequence at position 7"},
+	}
+
+	for idx, tc := range testCases {
+		_, err := Tokenize(tc.input)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%d: Expected %+v, got %+v", idx, tc.err, err)
+			continue
+		}
+		if err.Error() != tc.msg {
+			t.Errorf("%d: Expected %q, got %q", idx, tc.msg, err.Error())
+		}
+	}
+}
+
+func TestParseCommandQuoted(t *testing.T) {
+	command, err := ParseCommand(`QPUSH jobs "send email to bob"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qPush, ok := command.(QPush)
+	if !ok {
+		t.Fatalf("Expected QPush, got %T", command)
+	}
+	if qPush.Key != "jobs" || len(qPush.Value) != 1 || qPush.Value[0] != "send email to bob" {
+		t.Fatalf("Unexpected %+v", qPush)
+	}
+
+	command, err = ParseCommand("GET  a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get := command.(Get); get.Key != "a" {
+		t.Fatalf("Expected a, got %q", get.Key)
+	}
+}
+
+func TestKeyLifecycleCommands(t *testing.T) {
+	command, err := ParseCommand("DEL a b c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if del := command.(Del); strings.Join(del.Keys, " ") != "a b c" {
+		t.Fatalf("Unexpected %+v", del)
+	}
+
+	command, err = ParseCommand("PTTL a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := command.(TTL); ttl.Key != "a" || !ttl.Milliseconds {
+		t.Fatalf("Unexpected %+v", ttl)
+	}
+
+	command, err = ParseCommand("PEXPIRE a 1500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Now().Add(1500 * time.Millisecond)
+	if expire := command.(Expire); expire.At.Sub(expected).Abs() > 100*time.Millisecond {
+		t.Fatalf("Expected %v, got %v", expected, expire.At)
+	}
+
+	command, err = ParseCommand("EXPIREAT a 4102444800")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expire := command.(Expire); expire.At.Unix() != 4102444800 {
+		t.Fatalf("Unexpected %+v", expire)
+	}
+
+	command, err = ParseCommand("TYPE a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ := command.(Type); typ.Key != "a" {
+		t.Fatalf("Unexpected %+v", typ)
+	}
+
+	for _, invalid := range []string{"DEL", "TTL a b", "EXPIRE a", "EXPIRE a ten", "EXPIRE a 99999999999999999", "PERSIST", "TYPE", "TYPE a b"} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	set, err := parseSetCommand([]string{"a", "10", "PX", "1500", "XX", "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Now().Add(1500 * time.Millisecond)
+	if set.Expiry == nil || set.Expiry.Sub(expected).Abs() > 100*time.Millisecond {
+		t.Fatalf("Expected %v, got %v", expected, set.Expiry)
+	}
+	if !set.XX || !set.Get {
+		t.Fatalf("Unexpected %+v", set)
+	}
+
+	set, err = parseSetCommand([]string{"a", "10", "pxat", "4102444800000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Expiry == nil || set.Expiry.UnixMilli() != 4102444800000 {
+		t.Fatalf("Unexpected %v", set.Expiry)
+	}
+
+	set, err = parseSetCommand([]string{"a", "10", "EXAT", "4102444800", "NX"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Expiry == nil || set.Expiry.Unix() != 4102444800 || !set.NX {
+		t.Fatalf("Unexpected %+v", set)
+	}
+
+	set, err = parseSetCommand([]string{"a", "10", "KEEPTTL"})
+	if err != nil || !set.KeepTTL || set.Expiry != nil {
+		t.Fatalf("Unexpected %+v %+v", set, err)
+	}
+
+	testCases := []struct {
+		input string
+		err   error
+	}{
+		{"a 10 EX 10 PX 100", ErrorSetExpiryConflict},
+		{"a 10 EX 10 EX 10", ErrorSetExpiryConflict},
+		{"a 10 KEEPTTL PXAT 100", ErrorSetExpiryConflict},
+		{"a 10 NX XX", ErrorSetConditionConflict},
+		{"a 10 PX", ErrorInvalidSetCommand},
+		{"a 10 PX -1", ErrorInvalidSetCommand},
+	}
+	for idx, tc := range testCases {
+		_, err := parseSetCommand(strings.Split(tc.input, " "))
+		if err != tc.err {
+			t.Errorf("%d: Expected %+v, got %+v", idx, tc.err, err)
+		}
+	}
+}
+
+func TestIncrCommands(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output IncrBy
+	}{
+		{"INCR a", IncrBy{Key: "a", Delta: 1}},
+		{"DECR a", IncrBy{Key: "a", Delta: -1}},
+		{"INCRBY a 10", IncrBy{Key: "a", Delta: 10}},
+		{"DECRBY a 10", IncrBy{Key: "a", Delta: -10}},
+	}
+
+	for idx, tc := range testCases {
+		command, err := ParseCommand(tc.input)
+		if err != nil {
+			t.Errorf("%d: %s %+v", idx, tc.input, err)
+			continue
+		}
+		if incr := command.(IncrBy); incr != tc.output {
+			t.Errorf("%d: Expected %+v, got %+v", idx, tc.output, incr)
+		}
+	}
+
+	for _, invalid := range []string{"INCR", "INCRBY a", "INCRBY a 1.5", "DECRBY a -9223372036854775808", "INCRBYFLOAT a inf"} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestDeadLetterCommands(t *testing.T) {
+	qSetDLQ, err := parseQSetDLQCommand([]string{"jobs", "jobs:dead", "5"})
+	if err != nil || qSetDLQ != (QSetDLQ{Key: "jobs", DeadLetterKey: "jobs:dead", MaxDeliveries: 5}) {
+		t.Fatalf("Unexpected %+v %+v", qSetDLQ, err)
+	}
+	if _, err := parseQSetDLQCommand([]string{"jobs", "jobs", "5"}); err != ErrorInvalidQSetDLQCommand {
+		t.Fatalf("Expected a queue to not be its own dead letter queue, got %+v", err)
+	}
+
+	qDLQ, err := parseQDLQCommand([]string{"jobs"})
+	if err != nil || qDLQ.Key != "jobs" || qDLQ.Count != math.MaxInt {
+		t.Fatalf("Unexpected %+v %+v", qDLQ, err)
+	}
+
+	qRedrive, err := parseQRedriveCommand([]string{"jobs", "3"})
+	if err != nil || qRedrive.Key != "jobs" || qRedrive.Count != 3 {
+		t.Fatalf("Unexpected %+v %+v", qRedrive, err)
+	}
+	if _, err := parseQRedriveCommand([]string{"jobs", "0"}); err != ErrorInvalidQRedriveCommand {
+		t.Fatalf("Expected an error, got %+v", err)
+	}
+}
+
+func TestCapacityCommands(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output QSetCap
+	}{
+		{"QSETCAP jobs 10", QSetCap{Key: "jobs", Capacity: 10, Policy: OverflowReject}},
+		{"QSETCAP jobs 10 block", QSetCap{Key: "jobs", Capacity: 10, Policy: OverflowBlock}},
+		{"QSETCAP jobs 10 DROPOLDEST", QSetCap{Key: "jobs", Capacity: 10, Policy: OverflowDropOldest}},
+		{"QSETCAP jobs 0", QSetCap{Key: "jobs"}},
+	}
+	for idx, tc := range testCases {
+		command, err := ParseCommand(tc.input)
+		if err != nil {
+			t.Errorf("%d: %s %+v", idx, tc.input, err)
+			continue
+		}
+		if qSetCap := command.(QSetCap); qSetCap != tc.output {
+			t.Errorf("%d: Expected %+v, got %+v", idx, tc.output, qSetCap)
+		}
+	}
+
+	command, err := ParseCommand("BQPUSH jobs 5 PRIORITY 2 a b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bqpush := command.(BQPush)
+	if bqpush.Key != "jobs" || bqpush.Priority != 2 || strings.Join(bqpush.Value, " ") != "a b" {
+		t.Fatalf("Unexpected %+v", bqpush)
+	}
+	if remaining := time.Until(*bqpush.Timeout); remaining <= 4*time.Second || remaining > 5*time.Second {
+		t.Fatalf("Expected a 5 seconds timeout, got %s", remaining)
+	}
+
+	for _, invalid := range []string{
+		"QSETCAP jobs", "QSETCAP jobs -1", "QSETCAP jobs 10 WAIT", "QSETCAP jobs 10 BLOCK extra",
+		"BQPUSH jobs 5", "BQPUSH jobs -1 a", "BQPUSH jobs 5 DELAY 10 a", "BQPUSH jobs 5 AT 10 a",
+	} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestDequeCommands(t *testing.T) {
+	command, err := ParseCommand("QPUSHFRONT jobs a b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qpush := command.(QPushFront); qpush.Key != "jobs" || strings.Join(qpush.Value, " ") != "a b" {
+		t.Fatalf("Unexpected %+v", qpush)
+	}
+
+	testCases := []struct {
+		input  string
+		output Command
+	}{
+		{"QPOPBACK jobs", QPopBack{Key: "jobs"}},
+		{"QLEN jobs", QLen{Key: "jobs"}},
+		{"QPEEK jobs", QPeek{Key: "jobs"}},
+		{"QRANGE jobs 0 -1", QRange{Key: "jobs", Start: 0, Stop: -1}},
+		{"QREM jobs -2 x", QRem{Key: "jobs", Count: -2, Value: "x"}},
+	}
+	for idx, tc := range testCases {
+		command, err := ParseCommand(tc.input)
+		if err != nil {
+			t.Errorf("%d: %s %+v", idx, tc.input, err)
+			continue
+		}
+		if command != tc.output {
+			t.Errorf("%d: Expected %+v, got %+v", idx, tc.output, command)
+		}
+	}
+
+	for _, invalid := range []string{
+		"QPUSHFRONT jobs", "QPOPBACK", "QLEN a b", "QPEEK", "QRANGE jobs 0", "QRANGE jobs a 1",
+		"QREM jobs x", "QREM jobs 1",
+	} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestQMoveCommands(t *testing.T) {
+	command, err := ParseCommand("QMOVE jobs processing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qmove := command.(QMove); qmove.Source != "jobs" || qmove.Destination != "processing" || qmove.Timeout != nil {
+		t.Fatalf("Unexpected %+v", qmove)
+	}
+
+	command, err = ParseCommand("BQMOVE jobs processing 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qmove := command.(QMove)
+	if qmove.Source != "jobs" || qmove.Destination != "processing" || qmove.Timeout == nil {
+		t.Fatalf("Unexpected %+v", qmove)
+	}
+
+	for _, invalid := range []string{"QMOVE jobs", "QMOVE jobs processing 5", "BQMOVE jobs processing", "BQMOVE jobs processing -1", `QMOVE jobs ""`} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestStreamCommands(t *testing.T) {
+	command, err := ParseCommand("XADD events * n 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xadd := command.(XAdd); xadd.Key != "events" || xadd.ID != nil || len(xadd.Fields) != 2 {
+		t.Fatalf("Unexpected %+v", xadd)
+	}
+	command, err = ParseCommand("XADD events 5-1 n 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xadd := command.(XAdd); xadd.ID == nil || *xadd.ID != (StreamID{5, 1}) {
+		t.Fatalf("Unexpected %+v", xadd)
+	}
+
+	command, err = ParseCommand("XRANGE events 5 7 COUNT 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xrange := command.(XRange)
+	if xrange.Start != (StreamID{5, 0}) || xrange.End != (StreamID{7, math.MaxUint64}) || xrange.Count != 2 {
+		t.Fatalf("Unexpected %+v", xrange)
+	}
+	command, _ = ParseCommand("XRANGE events - +")
+	if xrange := command.(XRange); xrange.Start != (StreamID{}) || xrange.End != maxStreamID || xrange.Count != math.MaxInt {
+		t.Fatalf("Unexpected %+v", xrange)
+	}
+
+	command, err = ParseCommand("XGROUP CREATE events g $ MKSTREAM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xgroup := command.(XGroup); !xgroup.Create || xgroup.ID != nil || !xgroup.MkStream || xgroup.Group != "g" {
+		t.Fatalf("Unexpected %+v", xgroup)
+	}
+	command, _ = ParseCommand("XGROUP DESTROY events g")
+	if xgroup := command.(XGroup); xgroup.Create || xgroup.Key != "events" || xgroup.Group != "g" {
+		t.Fatalf("Unexpected %+v", xgroup)
+	}
+
+	command, err = ParseCommand("XREADGROUP GROUP g c COUNT 3 BLOCK 100 STREAMS a b > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xread := command.(XReadGroup)
+	if xread.Group != "g" || xread.Consumer != "c" || xread.Count != 3 || xread.Timeout == nil {
+		t.Fatalf("Unexpected %+v", xread)
+	}
+	if len(xread.Keys) != 2 || xread.IDs[0] != nil || xread.IDs[1] == nil || *xread.IDs[1] != (StreamID{}) {
+		t.Fatalf("Unexpected %+v", xread)
+	}
+
+	command, err = ParseCommand("XCLAIM events g c 1000 5-1 6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xclaim := command.(XClaim); xclaim.MinIdle != time.Second || len(xclaim.IDs) != 2 || xclaim.IDs[1] != (StreamID{6, 0}) {
+		t.Fatalf("Unexpected %+v", xclaim)
+	}
+
+	for _, invalid := range []string{
+		"XADD events * n", "XADD events 0-0 n 1", "XADD events x-1 n 1",
+		"XRANGE events - + COUNT 0", "XLEN",
+		"XGROUP CREATE events g", "XGROUP CREATE events g $ NOPE", "XGROUP DESTROY events",
+		"XREADGROUP GROUP g c STREAMS a", "XREADGROUP GROUP g c STREAMS a b >", "XREADGROUP g c STREAMS a >",
+		"XREADGROUP GROUP g c BLOCK -1 STREAMS a >", "XACK events g", "XCLAIM events g c -1 5", "XPENDING events",
+	} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestPublishCommand(t *testing.T) {
+	command, err := ParseCommand(`PUBLISH news "hello world"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publish := command.(Publish); publish.Channel != "news" || publish.Message != "hello world" {
+		t.Fatalf("Unexpected %+v", publish)
+	}
+
+	for _, invalid := range []string{"PUBLISH news", "PUBLISH news a b"} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestHashCommands(t *testing.T) {
+	command, err := ParseCommand("HSET user name ann age 30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hset := command.(HSet); hset.Key != "user" || strings.Join(hset.FieldValues, " ") != "name ann age 30" {
+		t.Fatalf("Unexpected %+v", hset)
+	}
+
+	command, _ = ParseCommand("HKEYS user")
+	if hkeys := command.(HGetAll); !hkeys.Fields || hkeys.Values {
+		t.Fatalf("Unexpected %+v", hkeys)
+	}
+	command, _ = ParseCommand("HGETALL user")
+	if hgetall := command.(HGetAll); !hgetall.Fields || !hgetall.Values {
+		t.Fatalf("Unexpected %+v", hgetall)
+	}
+
+	command, err = ParseCommand("HINCRBY user age -2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hincrby := command.(HIncrBy); hincrby.Field != "age" || hincrby.Delta != -2 {
+		t.Fatalf("Unexpected %+v", hincrby)
+	}
+
+	for _, invalid := range []string{
+		"HSET user", "HSET user name", "HSET user name ann age", "HGET user", "HMGET user",
+		"HDEL user", "HEXISTS user", "HLEN", "HVALS", "HINCRBY user age x",
+	} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestSetCommands(t *testing.T) {
+	command, err := ParseCommand("SPOP tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spop := command.(SPop); spop.Key != "tags" || spop.Count != 1 || spop.Array || spop.Peek {
+		t.Fatalf("Unexpected %+v", spop)
+	}
+	command, err = ParseCommand("SRANDMEMBER tags -3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srand := command.(SPop); srand.Count != -3 || !srand.Array || !srand.Peek {
+		t.Fatalf("Unexpected %+v", srand)
+	}
+	// Repeats are built in memory, so their count is bounded
+	if _, err := ParseCommand(fmt.Sprintf("SRANDMEMBER tags %d", -maxRandomMembers)); err != nil {
+		t.Fatal(err)
+	}
+
+	command, err = ParseCommand("SDIFFSTORE dest a b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scombine := command.(SCombine)
+	if scombine.Op != SetDiff || !scombine.Store || scombine.Destination != "dest" || strings.Join(scombine.Keys, " ") != "a b" {
+		t.Fatalf("Unexpected %+v", scombine)
+	}
+	command, _ = ParseCommand("SUNION a")
+	if scombine := command.(SCombine); scombine.Op != SetUnion || scombine.Store || len(scombine.Keys) != 1 {
+		t.Fatalf("Unexpected %+v", scombine)
+	}
+
+	for _, invalid := range []string{
+		"SADD tags", "SREM tags", "SISMEMBER tags", "SMEMBERS", "SCARD a b",
+		"SPOP tags -1", "SPOP tags x", "SRANDMEMBER tags -2000000000000", "SINTER", "SINTERSTORE dest",
+	} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestSortedSetCommands(t *testing.T) {
+	command, err := ParseCommand("ZADD board GT CH 10 alice -inf bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zadd := command.(ZAdd)
+	if zadd.Key != "board" || !zadd.Options.GT || !zadd.Options.CH || zadd.Incr || len(zadd.Members) != 2 ||
+		zadd.Members[0] != (ZMember{"alice", 10}) || zadd.Members[1].Member != "bob" || !math.IsInf(zadd.Members[1].Score, -1) {
+		t.Fatalf("Unexpected %+v", zadd)
+	}
+	command, _ = ParseCommand("ZADD board XX INCR 1.5 alice")
+	if zadd := command.(ZAdd); !zadd.Incr || !zadd.Options.XX || zadd.Members[0] != (ZMember{"alice", 1.5}) {
+		t.Fatalf("Unexpected %+v", zadd)
+	}
+
+	command, err = ParseCommand("ZRANGE board (10 +inf BYSCORE LIMIT 1 5 WITHSCORES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zrange := command.(ZRange)
+	expected := ZRangeQuery{By: ZRangeByScore, Score: ScoreRange{Min: 10, Max: math.Inf(1), MinExclusive: true}, Offset: 1, Count: 5}
+	if zrange.Key != "board" || zrange.Query != expected || !zrange.WithScores {
+		t.Fatalf("Unexpected %+v", zrange)
+	}
+	// REV takes the range from max to min
+	command, _ = ParseCommand("ZRANGE names [c - BYLEX REV")
+	expected = ZRangeQuery{By: ZRangeByLex, Lex: LexRange{Max: "c", MinUnbounded: true}, Rev: true, Count: -1}
+	if zrange := command.(ZRange); zrange.Query != expected {
+		t.Fatalf("Unexpected %+v", zrange)
+	}
+	command, _ = ParseCommand("ZRANGE board 0 -1 REV")
+	expected = ZRangeQuery{Start: 0, Stop: -1, Rev: true, Count: -1}
+	if zrange := command.(ZRange); zrange.Query != expected || zrange.WithScores {
+		t.Fatalf("Unexpected %+v", zrange)
+	}
+
+	command, _ = ParseCommand("ZREVRANK board alice")
+	if zrank := command.(ZRank); !zrank.Rev || zrank.Member != "alice" {
+		t.Fatalf("Unexpected %+v", zrank)
+	}
+	command, _ = ParseCommand("ZPOPMAX board 3")
+	if zpop := command.(ZPop); !zpop.Max || zpop.Count != 3 {
+		t.Fatalf("Unexpected %+v", zpop)
+	}
+	command, _ = ParseCommand("BZPOPMIN a b 5")
+	if bzpop := command.(BZPop); bzpop.Max || strings.Join(bzpop.Keys, " ") != "a b" || bzpop.Timeout == nil {
+		t.Fatalf("Unexpected %+v", bzpop)
+	}
+
+	for _, invalid := range []string{
+		"ZADD board", "ZADD board 1", "ZADD board x alice", "ZADD board nan alice",
+		"ZADD board NX XX 1 a", "ZADD board NX GT 1 a", "ZADD board GT LT 1 a", "ZADD board INCR 1 a 2 b",
+		"ZREM board", "ZSCORE board", "ZRANK board", "ZCARD",
+		"ZRANGE board 0", "ZRANGE board a 1", "ZRANGE board 0 1 LIMIT 0 1", "ZRANGE board 0 1 BYSCORE LIMIT 0",
+		"ZRANGE board a c BYLEX", "ZRANGE board [a [c BYLEX WITHSCORES", "ZRANGE board 0 1 BYSCORE FOO",
+		"ZPOPMIN board -1", "BZPOPMIN board", "BZPOPMIN board -1",
+	} {
+		if _, err := ParseCommand(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
 	}
 }
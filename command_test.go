@@ -3,6 +3,10 @@ package main
 import (
 	"errors"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -83,8 +87,9 @@ func TestQueue(t *testing.T) {
 		expireTime := new(time.Time)
 		*expireTime = time.Now().Add(1 * time.Second)
 
+		// Queued behind the first waiter, which gets the value
 		_, err := storage.QPopTimeout("queue", expireTime)
-		if err != ErrorManyWaiterOnQueue {
+		if err != ErrorEmptyQueue {
 			t.Errorf("Expected error, got %+v", err)
 		}
 	}()
@@ -109,7 +114,7 @@ func TestParallelReader(t *testing.T) {
 	go func() {
 		time.Sleep(1 * time.Second)
 		_, err := storage.QPopTimeout("queue", expireTime)
-		if err != ErrorManyWaiterOnQueue {
+		if err != ErrorEmptyQueue {
 			t.Errorf("Expected error, got %+v", err)
 		}
 	}()
@@ -168,3 +173,1367 @@ func TestScenarios(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyLifecycle(t *testing.T) {
+	storage := NewStorage()
+	storage.Set("a", "1", nil)
+	storage.Set("b", "2", nil)
+
+	if n := storage.Exists("a", "b", "a", "c"); n != 3 {
+		t.Fatalf("Expected 3, got %d", n)
+	}
+
+	expiry, err := storage.Expiry("a")
+	if err != nil || expiry != nil {
+		t.Fatalf("Expected no expiry, got %v %+v", expiry, err)
+	}
+	if _, err := storage.Expiry("c"); err != ErrorKeyNotFound {
+		t.Fatalf("Expected key not found, got %+v", err)
+	}
+
+	at := time.Now().Add(time.Hour)
+	if !storage.Expire("a", at) {
+		t.Fatal("Expected expire to succeed")
+	}
+	if expiry, _ := storage.Expiry("a"); expiry == nil || !expiry.Equal(at) {
+		t.Fatalf("Expected %v, got %v", at, expiry)
+	}
+	if storage.Expire("c", at) {
+		t.Fatal("Expected expire of a missing key to fail")
+	}
+
+	if !storage.Persist("a") {
+		t.Fatal("Expected persist to succeed")
+	}
+	if storage.Persist("a") {
+		t.Fatal("Expected persist of a persistent key to fail")
+	}
+
+	// An expiry in the past deletes the key
+	if !storage.Expire("b", time.Now().Add(-time.Second)) {
+		t.Fatal("Expected expire to succeed")
+	}
+	if _, err := storage.Get("b"); err != ErrorKeyNotFound {
+		t.Fatalf("Expected key not found, got %+v", err)
+	}
+
+	storage.Set("b", "2", nil)
+	if n := storage.Del("a", "b", "c"); n != 2 {
+		t.Fatalf("Expected 2, got %d", n)
+	}
+	if n := storage.Exists("a", "b"); n != 0 {
+		t.Fatalf("Expected 0, got %d", n)
+	}
+}
+
+func TestKeyspaceTypes(t *testing.T) {
+	storage := NewStorage()
+	storage.Set("string", "1", nil)
+	storage.QPush("queue", []string{"a"})
+	storage.XAdd("stream", nil, []string{"f", "v"})
+	storage.HSet("hash", []string{"f", "v"})
+
+	for key, expected := range map[string]string{"string": "string", "queue": "queue", "stream": "stream", "hash": "hash", "missing": "none"} {
+		if got := storage.Type(key); got != expected {
+			t.Errorf("Expected %s to be a %s, got %s", key, expected, got)
+		}
+	}
+
+	if err := storage.QPush("string", []string{"a"}); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.Get("queue"); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.QPop("stream"); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.XAdd("queue", nil, []string{"f", "v"}); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.QLen("hash"); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.QMove("queue", "string", nil); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if n, _ := storage.QLen("queue"); n != 1 {
+		t.Fatalf("Expected the value to stay, got %d", n)
+	}
+	// Keys are looked at in order, up to the first with a value
+	if _, err := storage.QPopAny([]string{"string", "queue"}, nil, 0); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+
+	// Writing a string replaces the queue
+	storage.Set("queue", "2", nil)
+	if got := storage.Type("queue"); got != "string" {
+		t.Fatalf("Expected a string, got %s", got)
+	}
+	if n := storage.Del("string", "stream", "hash"); n != 3 {
+		t.Fatalf("Expected 3, got %d", n)
+	}
+}
+
+func TestQueueLifecycle(t *testing.T) {
+	storage := NewStorage()
+	storage.QPush("jobs", []string{"a", "b"})
+
+	if !storage.Expire("jobs", time.Now().Add(50*time.Millisecond)) {
+		t.Fatal("Expected expire to succeed")
+	}
+	if expiry, _ := storage.Expiry("jobs"); expiry == nil {
+		t.Fatal("Expected the queue to expire")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := storage.QPop("jobs"); err != ErrorEmptyQueue {
+		t.Fatalf("Expected the queue to be gone, got %+v", err)
+	}
+
+	// Deleting a full queue fails the pushes waiting for room
+	storage.QPush("jobs", []string{"a"})
+	storage.QSetCapacity("jobs", 1, OverflowBlock)
+	done := make(chan error)
+	go func() {
+		timeout := time.Now().Add(time.Second)
+		done <- storage.QPushTimeout("jobs", []string{"b"}, 0, &timeout)
+	}()
+	for !hasProducers(storage, "jobs", 1) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := storage.Del("jobs"); n != 1 {
+		t.Fatalf("Expected 1, got %d", n)
+	}
+	if err := <-done; err != ErrorKeyNotFound {
+		t.Fatalf("Expected key not found, got %+v", err)
+	}
+	if n := storage.Exists("jobs"); n != 0 {
+		t.Fatalf("Expected 0, got %d", n)
+	}
+
+	// Consumers keep waiting on a deleted key
+	popped := make(chan string)
+	go func() {
+		timeout := time.Now().Add(time.Second)
+		v, _ := storage.QPopTimeout("jobs", &timeout)
+		popped <- v
+	}()
+	for !hasWaiters(storage, "jobs", 1) {
+		time.Sleep(time.Millisecond)
+	}
+	storage.QPush("jobs", []string{"c"})
+	if v := <-popped; v != "c" {
+		t.Fatalf("Expected c, got %s", v)
+	}
+}
+
+func TestSetWithOptions(t *testing.T) {
+	storage := NewStorage()
+
+	// NX on a missing key sets it
+	if err := storage.SetIfDoesntExists("key", "value1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := new(time.Time)
+	*expiry = time.Now().Add(time.Hour)
+	old, found, err := storage.SetWithOptions("key", "value2", expiry, SetOptions{})
+	if err != nil || !found || old != "value1" {
+		t.Fatalf("Expected value1, got %s %v %+v", old, found, err)
+	}
+
+	old, found, err = storage.SetWithOptions("key", "value3", nil, SetOptions{KeepTTL: true})
+	if err != nil || old != "value2" {
+		t.Fatalf("Expected value2, got %s %v %+v", old, found, err)
+	}
+	if got, _ := storage.Expiry("key"); got == nil || !got.Equal(*expiry) {
+		t.Fatalf("Expected the expiry to be kept, got %v", got)
+	}
+
+	old, found, err = storage.SetWithOptions("key", "value4", nil, SetOptions{NX: true})
+	if err != ErrorKeyExists || !found || old != "value3" {
+		t.Fatalf("Expected key exists with value3, got %s %v %+v", old, found, err)
+	}
+
+	_, found, err = storage.SetWithOptions("missing", "value", nil, SetOptions{XX: true, KeepTTL: true})
+	if err != ErrorKeyNotFound || found {
+		t.Fatalf("Expected key not found, got %v %+v", found, err)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	storage := NewStorage()
+
+	n, err := storage.IncrBy("counter", 1)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1, got %d %+v", n, err)
+	}
+	n, err = storage.IncrBy("counter", -11)
+	if err != nil || n != -10 {
+		t.Fatalf("Expected -10, got %d %+v", n, err)
+	}
+
+	expiry := new(time.Time)
+	*expiry = time.Now().Add(time.Hour)
+	storage.Set("big", "9223372036854775806", expiry)
+	n, err = storage.IncrBy("big", 1)
+	if err != nil || n != math.MaxInt64 {
+		t.Fatalf("Expected max int64, got %d %+v", n, err)
+	}
+	if _, err := storage.IncrBy("big", 1); err != ErrorOverflow {
+		t.Fatalf("Expected overflow, got %+v", err)
+	}
+	if got, _ := storage.Expiry("big"); got == nil || !got.Equal(*expiry) {
+		t.Fatalf("Expected the expiry to be kept, got %v", got)
+	}
+
+	storage.Set("text", "hello", nil)
+	if _, err := storage.IncrBy("text", 1); err != ErrorNotInteger {
+		t.Fatalf("Expected not an integer, got %+v", err)
+	}
+	if _, err := storage.IncrByFloat("text", 1); err != ErrorNotFloat {
+		t.Fatalf("Expected not a float, got %+v", err)
+	}
+
+	storage.Set("float", "10.5", nil)
+	f, err := storage.IncrByFloat("float", 0.1)
+	if err != nil || f != "10.6" {
+		t.Fatalf("Expected 10.6, got %s %+v", f, err)
+	}
+	if _, err := storage.IncrBy("float", 1); err != ErrorNotInteger {
+		t.Fatalf("Expected not an integer, got %+v", err)
+	}
+	if _, err := storage.IncrByFloat("float", math.MaxFloat64); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.IncrByFloat("float", math.MaxFloat64); err != ErrorNaNOrInfinity {
+		t.Fatalf("Expected NaN or Infinity error, got %+v", err)
+	}
+}
+
+func TestMultiKey(t *testing.T) {
+	storage := NewStorage()
+
+	storage.MSet([]string{"a", "b"}, []string{"1", "2"}, false)
+	values, found := storage.MGet("a", "missing", "b")
+	if !found[0] || found[1] || !found[2] || values[0] != "1" || values[2] != "2" {
+		t.Fatalf("Unexpected %q %v", values, found)
+	}
+
+	if storage.MSet([]string{"c", "a"}, []string{"3", "4"}, true) {
+		t.Fatal("Expected MSETNX to fail when a key exists")
+	}
+	if n := storage.Exists("c"); n != 0 {
+		t.Fatal("Expected MSETNX to set nothing")
+	}
+
+	if !storage.MSet([]string{"c", "d"}, []string{"3", "4"}, true) {
+		t.Fatal("Expected MSETNX to succeed")
+	}
+	if n := storage.Exists("c", "d"); n != 2 {
+		t.Fatalf("Expected 2, got %d", n)
+	}
+}
+
+func TestFairWaiters(t *testing.T) {
+	storage := NewStorage()
+
+	expireTime := new(time.Time)
+	*expireTime = time.Now().Add(5 * time.Second)
+
+	const consumers = 3
+	results := make([]chan string, consumers)
+	for i := range results {
+		results[i] = make(chan string, 1)
+		go func(i int) {
+			v, err := storage.QPopTimeout("queue", expireTime)
+			if err != nil {
+				t.Errorf("%d: %+v", i, err)
+			}
+			results[i] <- v
+		}(i)
+
+		// Consumers start waiting in order
+		for !hasWaiters(storage, "queue", i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for i, v := range []string{"a", "b", "c"} {
+		storage.QPush("queue", []string{v})
+		if got := <-results[i]; got != v {
+			t.Fatalf("Expected consumer %d to get %s, got %s", i, v, got)
+		}
+	}
+
+	if storage.Type("queue") != "none" {
+		t.Fatal("Expected the drained queue to be removed")
+	}
+}
+
+func TestWaiterTimeout(t *testing.T) {
+	storage := NewStorage()
+
+	short := new(time.Time)
+	*short = time.Now().Add(100 * time.Millisecond)
+	long := new(time.Time)
+	*long = time.Now().Add(5 * time.Second)
+
+	done := make(chan string)
+	go func() {
+		_, err := storage.QPopTimeout("queue", short)
+		if err != ErrorEmptyQueue {
+			t.Errorf("Expected error, got %+v", err)
+		}
+		done <- ""
+	}()
+	for !hasWaiters(storage, "queue", 1) {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		v, _ := storage.QPopTimeout("queue", long)
+		done <- v
+	}()
+
+	// The timed out waiter leaves the line, the value goes to the next one
+	<-done
+	storage.QPush("queue", []string{"value"})
+	if v := <-done; v != "value" {
+		t.Fatalf("Expected value, got %s", v)
+	}
+}
+
+func hasWaiters(s *Storage, key string, n int) bool {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	return len(s.queueWaiters[key]) == n
+}
+
+func TestQPopAny(t *testing.T) {
+	storage := NewStorage()
+
+	// Keys with data are checked in argument order
+	storage.QPush("low", []string{"l"})
+	storage.QPush("high", []string{"h"})
+	popped, err := storage.QPopAny([]string{"high", "normal", "low"}, nil, 0)
+	if err != nil || popped.Key != "high" || popped.Value != "h" {
+		t.Fatalf("Expected high h, got %+v %+v", popped, err)
+	}
+
+	// Drain low, then wait on all three
+	storage.QPop("low")
+	expireTime := new(time.Time)
+	*expireTime = time.Now().Add(5 * time.Second)
+
+	done := make(chan Popped)
+	go func() {
+		popped, err := storage.QPopAny([]string{"high", "normal", "low", "normal"}, expireTime, 0)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		done <- popped
+	}()
+	for !hasWaiters(storage, "high", 1) {
+		time.Sleep(time.Millisecond)
+	}
+	if !hasWaiters(storage, "normal", 1) {
+		t.Fatal("Expected a repeated key to be waited on once")
+	}
+
+	storage.QPush("normal", []string{"n"})
+	if r := <-done; r.Key != "normal" || r.Value != "n" {
+		t.Fatalf("Expected normal n, got %+v", r)
+	}
+
+	// The registration on the other queues is gone with the value
+	storage.kvLock.Lock()
+	remaining := len(storage.queueWaiters)
+	storage.kvLock.Unlock()
+	if remaining != 0 {
+		t.Fatalf("Expected no queues waited on, got %d", remaining)
+	}
+
+	storage.QPush("low", []string{"l"})
+	if v, err := storage.QPop("low"); err != nil || v != "l" {
+		t.Fatalf("Expected l, got %s %+v", v, err)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	storage := NewStorage()
+	storage.QPush("jobs", []string{"a", "b"})
+
+	popped, err := storage.QPopAny([]string{"jobs"}, nil, time.Hour)
+	if err != nil || popped.Value != "a" || popped.Receipt == "" {
+		t.Fatalf("Expected a with a receipt, got %+v %+v", popped, err)
+	}
+
+	// Acknowledging needs the right key and works once
+	if storage.QAck("other", popped.Receipt) {
+		t.Fatal("Expected the receipt to belong to jobs")
+	}
+	if !storage.QAck("jobs", popped.Receipt) || storage.QAck("jobs", popped.Receipt) {
+		t.Fatal("Expected the receipt to be acknowledged once")
+	}
+
+	// A nack puts the value back at the head
+	popped, _ = storage.QPopAny([]string{"jobs"}, nil, time.Hour)
+	storage.QPush("jobs", []string{"c"})
+	if !storage.QNack("jobs", popped.Receipt) {
+		t.Fatal("Expected the nack to succeed")
+	}
+	if v, err := storage.QPop("jobs"); err != nil || v != "b" {
+		t.Fatalf("Expected b, got %s %+v", v, err)
+	}
+
+	// An expired lease is handed to a waiting consumer
+	popped, _ = storage.QPopAny([]string{"jobs"}, nil, time.Hour)
+	expireTime := new(time.Time)
+	*expireTime = time.Now().Add(5 * time.Second)
+	done := make(chan string)
+	go func() {
+		v, err := storage.QPopTimeout("jobs", expireTime)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		done <- v
+	}()
+	for !hasWaiters(storage, "jobs", 1) {
+		time.Sleep(time.Millisecond)
+	}
+
+	storage.reapLeases(time.Now().Add(2 * time.Hour))
+	if v := <-done; v != popped.Value {
+		t.Fatalf("Expected %s, got %s", popped.Value, v)
+	}
+	if storage.QAck("jobs", popped.Receipt) {
+		t.Fatal("Expected the expired receipt to be gone")
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	storage := NewStorage()
+	storage.QSetDeadLetter("jobs", "jobs:dead", 2)
+	storage.QPush("jobs", []string{"poison"})
+
+	// Delivered twice, then it goes to the dead letter queue
+	for i := 0; i < 2; i++ {
+		popped, err := storage.QPopAny([]string{"jobs"}, nil, time.Hour)
+		if err != nil || popped.Value != "poison" {
+			t.Fatalf("Expected poison, got %+v %+v", popped, err)
+		}
+		storage.QNack("jobs", popped.Receipt)
+	}
+	if _, err := storage.QPop("jobs"); err != ErrorEmptyQueue {
+		t.Fatalf("Expected empty queue, got %+v", err)
+	}
+
+	values, err := storage.QDeadLetters("jobs", 10)
+	if err != nil || len(values) != 1 || values[0] != "poison" {
+		t.Fatalf("Expected [poison], got %+v %+v", values, err)
+	}
+
+	// Redriven values start counting again
+	if moved, err := storage.QRedrive("jobs", 10); err != nil || moved != 1 {
+		t.Fatalf("Expected 1 moved, got %d %+v", moved, err)
+	}
+	if values, _ := storage.QDeadLetters("jobs", 10); len(values) != 0 {
+		t.Fatalf("Expected the dead letter queue to be empty, got %+v", values)
+	}
+	popped, _ := storage.QPopAny([]string{"jobs"}, nil, time.Hour)
+	storage.QNack("jobs", popped.Receipt)
+	if v, err := storage.QPop("jobs"); err != nil || v != "poison" {
+		t.Fatalf("Expected poison, got %s %+v", v, err)
+	}
+
+	if _, err := storage.QDeadLetters("other", 10); err != ErrorNoDeadLetterQueue {
+		t.Fatalf("Expected no dead letter queue, got %+v", err)
+	}
+
+	storage.Set("name", "ann", nil)
+	if err := storage.QSetDeadLetter("other", "name", 1); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+
+	// A dead letter key that changed type since keeps the value on its queue
+	storage.QSetDeadLetter("other", "other:dead", 1)
+	storage.Set("other:dead", "taken", nil)
+	storage.QPush("other", []string{"poison"})
+	popped, _ = storage.QPopAny([]string{"other"}, nil, time.Hour)
+	storage.QNack("other", popped.Receipt)
+	if v, err := storage.QPop("other"); err != nil || v != "poison" {
+		t.Fatalf("Expected poison, got %s %+v", v, err)
+	}
+}
+
+func TestDelayedPush(t *testing.T) {
+	storage := NewStorage()
+
+	storage.QPushAt("jobs", []string{"later"}, 0, time.Now().Add(200*time.Millisecond))
+	storage.QPushAt("jobs", []string{"now"}, 0, time.Now().Add(-time.Second))
+	if v, err := storage.QPop("jobs"); err != nil || v != "now" {
+		t.Fatalf("Expected now, got %s %+v", v, err)
+	}
+	if _, err := storage.QPop("jobs"); err != ErrorEmptyQueue {
+		t.Fatalf("Expected the delayed value to be invisible, got %+v", err)
+	}
+
+	// Promotion wakes a blocked consumer
+	expireTime := new(time.Time)
+	*expireTime = time.Now().Add(5 * time.Second)
+	start := time.Now()
+	v, err := storage.QPopTimeout("jobs", expireTime)
+	if err != nil || v != "later" {
+		t.Fatalf("Expected later, got %s %+v", v, err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond || waited > time.Second {
+		t.Fatalf("Expected the value around its time, waited %s", waited)
+	}
+
+	// Polling consumers see due values without waiting for the timers
+	storage.QPushAt("jobs", []string{"b"}, 0, time.Now().Add(20*time.Millisecond))
+	storage.QPushAt("jobs", []string{"a"}, 0, time.Now().Add(10*time.Millisecond))
+	time.Sleep(30 * time.Millisecond)
+	if v, err := storage.QPop("jobs"); err != nil || v != "a" {
+		t.Fatalf("Expected a, the first one due, got %s %+v", v, err)
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	storage := NewStorage()
+
+	storage.QPush("jobs", []string{"low1", "low2"})
+	storage.QPushPriority("jobs", []string{"high1", "high2"}, 10)
+	storage.QPushPriority("jobs", []string{"lowest"}, -1)
+	storage.QPushPriority("jobs", []string{"high3"}, 10)
+
+	// A value given back goes before the others of its priority only
+	popped, _ := storage.QPopAny([]string{"jobs"}, nil, time.Hour)
+	if popped.Value != "high1" {
+		t.Fatalf("Expected high1, got %+v", popped)
+	}
+	storage.QPushPriority("jobs", []string{"urgent"}, 20)
+	storage.QNack("jobs", popped.Receipt)
+
+	for _, expected := range []string{"urgent", "high1", "high2", "high3", "low1", "low2", "lowest"} {
+		v, err := storage.QPop("jobs")
+		if err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	storage := NewStorage()
+
+	expectPops := func(key string, expected ...string) {
+		t.Helper()
+		for _, e := range expected {
+			v, err := storage.QPop(key)
+			if err != nil || v != e {
+				t.Fatalf("Expected %s, got %s %+v", e, v, err)
+			}
+		}
+		if _, err := storage.QPop(key); err != ErrorEmptyQueue {
+			t.Fatalf("Expected empty queue, got %+v", err)
+		}
+	}
+
+	// Nothing of a push that doesn't fit goes in
+	storage.QSetCapacity("reject", 2, OverflowReject)
+	storage.QPush("reject", []string{"a"})
+	if err := storage.QPush("reject", []string{"b", "c"}); err != ErrorQueueFull {
+		t.Fatalf("Expected full queue, got %+v", err)
+	}
+	expectPops("reject", "a")
+
+	storage.QSetCapacity("drop", 2, OverflowDropOldest)
+	storage.QPush("drop", []string{"a", "b"})
+	storage.QPush("drop", []string{"c"})
+	expectPops("drop", "b", "c")
+
+	// A nacked value goes back even when the queue is full
+	storage.QSetCapacity("jobs", 1, OverflowBlock)
+	storage.QPush("jobs", []string{"a"})
+	popped, _ := storage.QPopAny([]string{"jobs"}, nil, time.Hour)
+	storage.QPush("jobs", []string{"b"})
+	storage.QNack("jobs", popped.Receipt)
+	if err := storage.QPush("jobs", []string{"c"}); err != ErrorQueueFull {
+		t.Fatalf("Expected full queue, got %+v", err)
+	}
+
+	short := time.Now().Add(50 * time.Millisecond)
+	if err := storage.QPushTimeout("jobs", []string{"c"}, 0, &short); err != ErrorQueueFull {
+		t.Fatalf("Expected full queue, got %+v", err)
+	}
+
+	// Blocked producers go in as pops make room, in the order they came
+	long := time.Now().Add(5 * time.Second)
+	done := make(chan error, 2)
+	go func() { done <- storage.QPushTimeout("jobs", []string{"c"}, 0, &long) }()
+	for !hasProducers(storage, "jobs", 1) {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { done <- storage.QPushTimeout("jobs", []string{"d"}, 0, &long) }()
+	for !hasProducers(storage, "jobs", 2) {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, expected := range []string{"a", "b", "c", "d"} {
+		v, err := storage.QPop("jobs")
+		if err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+		if expected == "b" || expected == "c" {
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Raising the capacity lets blocked producers in
+	storage.QSetCapacity("jobs", 1, OverflowBlock)
+	storage.QPush("jobs", []string{"a"})
+	go func() { done <- storage.QPushTimeout("jobs", []string{"b"}, 0, &long) }()
+	for !hasProducers(storage, "jobs", 1) {
+		time.Sleep(time.Millisecond)
+	}
+	storage.QSetCapacity("jobs", 0, OverflowReject)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	expectPops("jobs", "a", "b")
+}
+
+func hasProducers(s *Storage, key string, n int) bool {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	queue, _ := s.queueLocked(key)
+	return queue != nil && len(queue.producers) == n
+}
+
+func TestDeque(t *testing.T) {
+	storage := NewStorage()
+
+	storage.QPush("jobs", []string{"b", "c", "d"})
+	storage.QPushFront("jobs", []string{"a2", "a1"})
+	storage.QPushPriority("jobs", []string{"high"}, 5)
+
+	// Pushes to the front stay behind values of a higher priority
+	expectRange := func(start, stop int, expected ...string) {
+		t.Helper()
+		got, _ := storage.QRange("jobs", start, stop)
+		if strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Fatalf("%d %d: Expected %+v, got %+v", start, stop, expected, got)
+		}
+	}
+	expectRange(0, -1, "high", "a1", "a2", "b", "c", "d")
+	expectRange(4, 100, "c", "d")
+	expectRange(-2, -1, "c", "d")
+	expectRange(-100, 1, "high", "a1")
+	expectRange(3, 2)
+
+	if n, _ := storage.QLen("jobs"); n != 6 {
+		t.Fatalf("Expected 6, got %d", n)
+	}
+	if v, err := storage.QPeek("jobs"); err != nil || v != "high" {
+		t.Fatalf("Expected high, got %s %+v", v, err)
+	}
+	if v, err := storage.QPopBack("jobs"); err != nil || v != "d" {
+		t.Fatalf("Expected d, got %s %+v", v, err)
+	}
+
+	storage.QPush("jobs", []string{"x", "b", "x", "x"})
+	if n, _ := storage.QRem("jobs", -2, "x"); n != 2 {
+		t.Fatalf("Expected 2 removed, got %d", n)
+	}
+	if n, _ := storage.QRem("jobs", 0, "b"); n != 2 {
+		t.Fatalf("Expected 2 removed, got %d", n)
+	}
+	expectRange(0, -1, "high", "a1", "a2", "c", "x")
+
+	// A push to the front of a full queue drops from the back
+	storage.QSetCapacity("jobs", 5, OverflowDropOldest)
+	storage.QPushFront("jobs", []string{"first"})
+	expectRange(0, -1, "high", "first", "a1", "a2", "c")
+
+	for storage.Type("jobs") == "queue" {
+		storage.QPopBack("jobs")
+	}
+	if _, err := storage.QPeek("jobs"); err != ErrorEmptyQueue {
+		t.Fatalf("Expected empty queue, got %+v", err)
+	}
+	if storage.Type("jobs") != "none" {
+		t.Fatal("Expected the empty queue to be dropped")
+	}
+}
+
+func TestQMove(t *testing.T) {
+	storage := NewStorage()
+
+	if _, err := storage.QMove("jobs", "processing", nil); err != ErrorEmptyQueue {
+		t.Fatalf("Expected empty queue, got %+v", err)
+	}
+
+	storage.QPush("jobs", []string{"a", "b"})
+	if v, err := storage.QMove("jobs", "processing", nil); err != nil || v != "a" {
+		t.Fatalf("Expected a, got %s %+v", v, err)
+	}
+	if values, _ := storage.QRange("processing", 0, -1); len(values) != 1 || values[0] != "a" {
+		t.Fatalf("Expected [a], got %+v", values)
+	}
+
+	// A blocked move is woken by a push, and hands the value on to a
+	// consumer blocked on the destination
+	storage.QPop("jobs")
+	storage.QPop("processing")
+	expireTime := new(time.Time)
+	*expireTime = time.Now().Add(5 * time.Second)
+	consumed := make(chan string, 1)
+	go func() {
+		v, _ := storage.QPopTimeout("processing", expireTime)
+		consumed <- v
+	}()
+	moved := make(chan string, 1)
+	go func() {
+		v, _ := storage.QMove("jobs", "processing", expireTime)
+		moved <- v
+	}()
+	for !hasWaiters(storage, "jobs", 1) || !hasWaiters(storage, "processing", 1) {
+		time.Sleep(time.Millisecond)
+	}
+
+	storage.QPush("jobs", []string{"c"})
+	if v := <-moved; v != "c" {
+		t.Fatalf("Expected c to be moved, got %s", v)
+	}
+	if v := <-consumed; v != "c" {
+		t.Fatalf("Expected c to be consumed, got %s", v)
+	}
+	if n, _ := storage.QLen("processing"); n != 0 {
+		t.Fatalf("Expected the value to be consumed, got %d left", n)
+	}
+
+	// Moving onto itself rotates the queue
+	storage.QPush("ring", []string{"1", "2", "3"})
+	storage.QMove("ring", "ring", nil)
+	if values, _ := storage.QRange("ring", 0, -1); strings.Join(values, " ") != "2 3 1" {
+		t.Fatalf("Expected [2 3 1], got %+v", values)
+	}
+
+	short := new(time.Time)
+	*short = time.Now().Add(50 * time.Millisecond)
+	if _, err := storage.QMove("empty", "processing", short); err != ErrorEmptyQueue {
+		t.Fatalf("Expected empty queue, got %+v", err)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	storage := NewStorage()
+
+	id, err := storage.XAdd("events", &StreamID{5, 0}, []string{"n", "1"})
+	if err != nil || id != (StreamID{5, 0}) {
+		t.Fatalf("Expected 5-0, got %s %+v", id, err)
+	}
+	if _, err := storage.XAdd("events", &StreamID{5, 0}, []string{"n", "2"}); err != ErrorStreamIDTooOld {
+		t.Fatalf("Expected the ID to be too old, got %+v", err)
+	}
+	second, _ := storage.XAdd("events", nil, []string{"n", "2"})
+	if !(StreamID{5, 0}).Less(second) {
+		t.Fatalf("Expected an ID after 5-0, got %s", second)
+	}
+	if n, _ := storage.XLen("events"); n != 2 {
+		t.Fatalf("Expected 2 entries, got %d", n)
+	}
+	if entries, _ := storage.XRange("events", StreamID{}, StreamID{5, math.MaxUint64}, 10); len(entries) != 1 || entries[0].Fields[1] != "1" {
+		t.Fatalf("Expected the first entry, got %+v", entries)
+	}
+
+	// Automatic IDs after the last one carry into the milliseconds, and run
+	// out after the largest ID
+	storage.XAdd("last", &StreamID{math.MaxUint64 - 1, math.MaxUint64}, []string{"n", "1"})
+	if id, err := storage.XAdd("last", nil, []string{"n", "2"}); err != nil || id != (StreamID{math.MaxUint64, 0}) {
+		t.Fatalf("Expected %d-0, got %s %+v", uint64(math.MaxUint64), id, err)
+	}
+	storage.XAdd("last", &maxStreamID, []string{"n", "3"})
+	if _, err := storage.XAdd("last", nil, []string{"n", "4"}); err != ErrorStreamFull {
+		t.Fatalf("Expected the stream to be full, got %+v", err)
+	}
+	if n, _ := storage.XLen("last"); n != 3 {
+		t.Fatalf("Expected 3 entries, got %d", n)
+	}
+
+	if err := storage.XGroupCreate("missing", "g", nil, false); err != ErrorKeyNotFound {
+		t.Fatalf("Expected key not found, got %+v", err)
+	}
+	if err := storage.XGroupCreate("events", "g", &StreamID{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.XGroupCreate("events", "g", nil, false); err != ErrorGroupExists {
+		t.Fatalf("Expected the group to exist, got %+v", err)
+	}
+	if _, err := storage.XReadGroup("other", "c1", []string{"events"}, []*StreamID{nil}, 10, nil); err != ErrorNoGroup {
+		t.Fatalf("Expected no group, got %+v", err)
+	}
+
+	// Every entry goes to one consumer of the group
+	read, err := storage.XReadGroup("g", "c1", []string{"events"}, []*StreamID{nil}, 1, nil)
+	if err != nil || len(read) != 1 || read[0].Entries[0].ID != (StreamID{5, 0}) {
+		t.Fatalf("Expected 5-0, got %+v %+v", read, err)
+	}
+	read, _ = storage.XReadGroup("g", "c2", []string{"events"}, []*StreamID{nil}, 10, nil)
+	if len(read) != 1 || len(read[0].Entries) != 1 || read[0].Entries[0].ID != second {
+		t.Fatalf("Expected %s, got %+v", second, read)
+	}
+	if read, _ := storage.XReadGroup("g", "c1", []string{"events"}, []*StreamID{nil}, 10, nil); len(read) != 0 {
+		t.Fatalf("Expected nothing new, got %+v", read)
+	}
+
+	// Groups don't see each other's reads
+	storage.XGroupCreate("events", "audit", &StreamID{}, false)
+	if read, _ := storage.XReadGroup("audit", "a", []string{"events"}, []*StreamID{nil}, 10, nil); len(read) != 1 || len(read[0].Entries) != 2 {
+		t.Fatalf("Expected both entries, got %+v", read)
+	}
+
+	// The history of a consumer is its pending entries
+	read, _ = storage.XReadGroup("g", "c1", []string{"events"}, []*StreamID{{}}, 10, nil)
+	if len(read) != 1 || len(read[0].Entries) != 1 || read[0].Entries[0].ID != (StreamID{5, 0}) {
+		t.Fatalf("Expected the pending 5-0, got %+v", read)
+	}
+	if n, _ := storage.XAck("events", "g", []StreamID{{5, 0}, {5, 0}, {9, 9}}); n != 1 {
+		t.Fatalf("Expected 1 acknowledged, got %d", n)
+	}
+	read, _ = storage.XReadGroup("g", "c1", []string{"events"}, []*StreamID{{}}, 10, nil)
+	if len(read) != 1 || len(read[0].Entries) != 0 {
+		t.Fatalf("Expected no pending entries, got %+v", read)
+	}
+
+	// An entry stuck with c2 is claimed by c1 once idle long enough
+	if claimed, _ := storage.XClaim("events", "g", "c1", time.Hour, []StreamID{second}); len(claimed) != 0 {
+		t.Fatalf("Expected nothing idle for an hour, got %+v", claimed)
+	}
+	time.Sleep(10 * time.Millisecond)
+	claimed, err := storage.XClaim("events", "g", "c1", 5*time.Millisecond, []StreamID{second})
+	if err != nil || len(claimed) != 1 || claimed[0].ID != second {
+		t.Fatalf("Expected %s to be claimed, got %+v %+v", second, claimed, err)
+	}
+	pending, _ := storage.XPending("events", "g")
+	if len(pending) != 1 || pending[0].Consumer != "c1" || pending[0].Deliveries != 2 {
+		t.Fatalf("Expected %s pending for c1 after 2 deliveries, got %+v", second, pending)
+	}
+
+	// A blocked read is woken by an entry on any of its streams
+	storage.XGroupCreate("other", "g", nil, true)
+	expireTime := new(time.Time)
+	*expireTime = time.Now().Add(5 * time.Second)
+	done := make(chan []StreamRead, 1)
+	go func() {
+		read, _ := storage.XReadGroup("g", "c3", []string{"events", "other"}, []*StreamID{nil, nil}, 10, expireTime)
+		done <- read
+	}()
+	for !hasStreamWaiters(storage, "other", 1) {
+		time.Sleep(time.Millisecond)
+	}
+	third, _ := storage.XAdd("other", nil, []string{"n", "3"})
+	read = <-done
+	if len(read) != 1 || read[0].Key != "other" || read[0].Entries[0].ID != third {
+		t.Fatalf("Expected %s from other, got %+v", third, read)
+	}
+	if hasStreamWaiters(storage, "events", 1) {
+		t.Fatal("Expected the waiter to be gone from every stream")
+	}
+
+	short := new(time.Time)
+	*short = time.Now().Add(50 * time.Millisecond)
+	if read, err := storage.XReadGroup("g", "c3", []string{"other"}, []*StreamID{nil}, 10, short); err != nil || read != nil {
+		t.Fatalf("Expected a timeout, got %+v %+v", read, err)
+	}
+
+	destroyed, _ := storage.XGroupDestroy("events", "g")
+	again, _ := storage.XGroupDestroy("events", "g")
+	if !destroyed || again {
+		t.Fatal("Expected the group to be destroyed once")
+	}
+}
+
+func hasStreamWaiters(s *Storage, key string, n int) bool {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	st := s.KV[key].stream
+	return st != nil && len(st.waiters) == n
+}
+
+func TestPubSub(t *testing.T) {
+	storage := NewStorage()
+
+	if n := storage.Publish("news", "nobody"); n != 0 {
+		t.Fatalf("Expected no receivers, got %d", n)
+	}
+
+	a, b := NewSubscriber(10), NewSubscriber(10)
+	if changes := storage.Subscribe(a, "news", "sport"); len(changes) != 2 || changes[1].Count != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %+v", changes)
+	}
+	storage.PSubscribe(a, "n*")
+	storage.PSubscribe(b, "n[aeiou]ws", "x*")
+
+	// a gets it twice, once for the channel and once for the pattern
+	if n := storage.Publish("news", "hello"); n != 3 {
+		t.Fatalf("Expected 3 receivers, got %d", n)
+	}
+	for _, expected := range []Message{{Channel: "news", Payload: "hello"}, {Pattern: "n*", Channel: "news", Payload: "hello"}} {
+		if m := <-a.Messages(); m != expected {
+			t.Fatalf("Expected %+v, got %+v", expected, m)
+		}
+	}
+	if m := <-b.Messages(); m.Pattern != "n[aeiou]ws" || m.Payload != "hello" {
+		t.Fatalf("Unexpected %+v", m)
+	}
+
+	if changes := storage.Unsubscribe(a); len(changes) != 2 || changes[0].Name != "news" || changes[1].Count != 1 {
+		t.Fatalf("Expected news and sport to be unsubscribed, got %+v", changes)
+	}
+	if n := storage.Publish("sport", "goal"); n != 0 {
+		t.Fatalf("Expected no receivers, got %d", n)
+	}
+
+	// A subscriber falling behind is disconnected rather than blocking
+	slow := NewSubscriber(1)
+	storage.Subscribe(slow, "fast")
+	if n := storage.Publish("fast", "1"); n != 1 {
+		t.Fatalf("Expected 1 receiver, got %d", n)
+	}
+	if n := storage.Publish("fast", "2"); n != 0 {
+		t.Fatalf("Expected the slow subscriber to be dropped, got %d", n)
+	}
+	if m, ok := <-slow.Messages(); !ok || m.Payload != "1" {
+		t.Fatalf("Expected the buffered message, got %+v", m)
+	}
+	if _, ok := <-slow.Messages(); ok {
+		t.Fatal("Expected the messages to be closed")
+	}
+	if n := storage.Publish("fast", "3"); n != 0 {
+		t.Fatalf("Expected no receivers, got %d", n)
+	}
+	if len(storage.channels) != 0 {
+		t.Fatalf("Expected no channels left, got %+v", storage.channels)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"news.*", "news.sport", true},
+		{"news.*", "news", false},
+		{"*.sport", "news.sport", true},
+		{"n*s*t", "news.sport", true},
+		{"n?ws", "news", true},
+		{"n?ws", "nws", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXbXbc", true},
+		{"a*b*c", "aXbXb", false},
+	} {
+		if got := globMatch(c.pattern, c.s); got != c.match {
+			t.Errorf("globMatch(%q, %q) = %v, expected %v", c.pattern, c.s, got, c.match)
+		}
+	}
+}
+
+func TestHashes(t *testing.T) {
+	storage := NewStorage()
+
+	if added, err := storage.HSet("user", []string{"name", "ann", "age", "30"}); err != nil || added != 2 {
+		t.Fatalf("Expected 2 new fields, got %d %+v", added, err)
+	}
+	if added, _ := storage.HSet("user", []string{"name", "bob", "city", "oslo"}); added != 1 {
+		t.Fatalf("Expected 1 new field, got %d", added)
+	}
+	if v, err := storage.HGet("user", "name"); err != nil || v != "bob" {
+		t.Fatalf("Expected bob, got %s %+v", v, err)
+	}
+	if _, err := storage.HGet("user", "missing"); err != ErrorKeyNotFound {
+		t.Fatalf("Expected key not found, got %+v", err)
+	}
+	values, found, _ := storage.HMGet("user", "age", "missing")
+	if !found[0] || values[0] != "30" || found[1] {
+		t.Fatalf("Expected [30 nil], got %+v %+v", values, found)
+	}
+	if n, _ := storage.HLen("user"); n != 3 {
+		t.Fatalf("Expected 3 fields, got %d", n)
+	}
+	if fieldValues, _ := storage.HGetAll("user"); strings.Join(fieldValues, " ") != "age 30 city oslo name bob" {
+		t.Fatalf("Expected the fields in order, got %+v", fieldValues)
+	}
+
+	if n, err := storage.HIncrBy("user", "age", 5); err != nil || n != 35 {
+		t.Fatalf("Expected 35, got %d %+v", n, err)
+	}
+	if n, err := storage.HIncrBy("counters", "hits", -1); err != nil || n != -1 {
+		t.Fatalf("Expected -1, got %d %+v", n, err)
+	}
+	if _, err := storage.HIncrBy("user", "name", 1); err != ErrorNotInteger {
+		t.Fatalf("Expected not an integer, got %+v", err)
+	}
+	storage.HSet("counters", []string{"max", strconv.FormatInt(math.MaxInt64, 10)})
+	if _, err := storage.HIncrBy("counters", "max", 1); err != ErrorOverflow {
+		t.Fatalf("Expected overflow, got %+v", err)
+	}
+
+	// Strings and hashes don't mix
+	storage.Set("plain", "value", nil)
+	if _, err := storage.HSet("plain", []string{"f", "v"}); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.Get("user"); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.IncrBy("user", 1); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, _, err := storage.SetWithOptions("user", "v", nil, SetOptions{Get: true}); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, found := storage.MGet("user"); found[0] {
+		t.Fatal("Expected MGET to skip the hash")
+	}
+
+	// The key goes with its last field
+	if n, _ := storage.HDel("user", "name", "age", "city", "missing"); n != 3 {
+		t.Fatalf("Expected 3 deleted, got %d", n)
+	}
+	if n := storage.Exists("user"); n != 0 {
+		t.Fatalf("Expected the hash to be gone, got %d", n)
+	}
+
+	// Expiry works on the whole hash
+	storage.HSet("session", []string{"token", "abc"})
+	if !storage.Expire("session", time.Now().Add(50*time.Millisecond)) {
+		t.Fatal("Expected the expiry to be set")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if found, err := storage.HExists("session", "token"); err != nil || found {
+		t.Fatalf("Expected the hash to be expired, got %v %+v", found, err)
+	}
+	if added, err := storage.HSet("session", []string{"token", "def"}); err != nil || added != 1 {
+		t.Fatalf("Expected a new hash, got %d %+v", added, err)
+	}
+	if expiry, _ := storage.Expiry("session"); expiry != nil {
+		t.Fatalf("Expected no expiry, got %v", expiry)
+	}
+}
+
+func TestSets(t *testing.T) {
+	storage := NewStorage()
+
+	if added, err := storage.SAdd("a", "1", "2", "3", "2"); err != nil || added != 3 {
+		t.Fatalf("Expected 3 new members, got %d %+v", added, err)
+	}
+	if added, _ := storage.SAdd("a", "3", "4"); added != 1 {
+		t.Fatalf("Expected 1 new member, got %d", added)
+	}
+	if found, _ := storage.SIsMember("a", "4"); !found {
+		t.Fatal("Expected 4 to be a member")
+	}
+	if n, _ := storage.SCard("a"); n != 4 {
+		t.Fatalf("Expected 4 members, got %d", n)
+	}
+	if removed, _ := storage.SRem("a", "4", "5"); removed != 1 {
+		t.Fatalf("Expected 1 removed, got %d", removed)
+	}
+
+	storage.SAdd("b", "2", "3", "9")
+	for _, c := range []struct {
+		op       SetOp
+		keys     []string
+		expected string
+	}{
+		{SetInter, []string{"a", "b"}, "2 3"},
+		{SetInter, []string{"a", "missing"}, ""},
+		{SetUnion, []string{"a", "b", "missing"}, "1 2 3 9"},
+		{SetDiff, []string{"a", "b"}, "1"},
+		{SetDiff, []string{"missing", "a"}, ""},
+	} {
+		if members, err := storage.SCombine(c.op, c.keys...); err != nil || strings.Join(members, " ") != c.expected {
+			t.Errorf("%d %v: Expected [%s], got %+v %+v", c.op, c.keys, c.expected, members, err)
+		}
+	}
+
+	// Storing replaces the destination whatever it held
+	storage.Set("dest", "string", nil)
+	if n, err := storage.SCombineStore(SetUnion, "dest", "a", "b"); err != nil || n != 4 {
+		t.Fatalf("Expected 4 stored, got %d %+v", n, err)
+	}
+	if members, _ := storage.SMembers("dest"); strings.Join(members, " ") != "1 2 3 9" {
+		t.Fatalf("Expected [1 2 3 9], got %+v", members)
+	}
+	if n, _ := storage.SCombineStore(SetInter, "dest", "a", "missing"); n != 0 || storage.Exists("dest") != 0 {
+		t.Fatalf("Expected an empty result to remove the destination, got %d", n)
+	}
+
+	// Random picks never repeat unless asked to
+	picked, _ := storage.SRandMember("a", 10)
+	sort.Strings(picked)
+	if strings.Join(picked, " ") != "1 2 3" {
+		t.Fatalf("Expected every member once, got %+v", picked)
+	}
+	if picked, _ := storage.SRandMember("a", -5); len(picked) != 5 {
+		t.Fatalf("Expected 5 members, got %+v", picked)
+	}
+	popped, _ := storage.SPop("a", 2)
+	if len(popped) != 2 {
+		t.Fatalf("Expected 2 popped, got %+v", popped)
+	}
+	popped, _ = storage.SPop("a", 2)
+	if n := storage.Exists("a"); len(popped) != 1 || n != 0 {
+		t.Fatalf("Expected the last member and the key to be gone, got %+v %d", popped, n)
+	}
+
+	storage.HSet("hash", []string{"f", "v"})
+	if _, err := storage.SAdd("hash", "x"); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.SCombine(SetUnion, "b", "hash"); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.Get("b"); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+}
+
+func TestSortedSets(t *testing.T) {
+	storage := NewStorage()
+
+	members := []ZMember{{"alice", 30}, {"bob", 10}, {"carol", 20}, {"dave", 20}}
+	if added, err := storage.ZAdd("board", members, ZAddOptions{}); err != nil || added != 4 {
+		t.Fatalf("Expected 4 new members, got %d %+v", added, err)
+	}
+	for _, c := range []struct {
+		member string
+		score  float64
+		opts   ZAddOptions
+		result int
+		after  float64
+	}{
+		{"bob", 15, ZAddOptions{}, 0, 15},
+		{"bob", 16, ZAddOptions{CH: true}, 1, 16},
+		{"bob", 5, ZAddOptions{GT: true, CH: true}, 0, 16},
+		{"bob", 5, ZAddOptions{LT: true, CH: true}, 1, 5},
+		{"bob", 50, ZAddOptions{NX: true}, 0, 5},
+		{"erin", 50, ZAddOptions{XX: true}, 0, 0},
+		{"bob", 10, ZAddOptions{XX: true, CH: true}, 1, 10},
+	} {
+		if n, err := storage.ZAdd("board", []ZMember{{c.member, c.score}}, c.opts); err != nil || n != c.result {
+			t.Errorf("%+v: Expected %d, got %d %+v", c, c.result, n, err)
+		}
+		if score, _ := storage.ZScore("board", c.member); score != c.after {
+			t.Errorf("%+v: Expected score %v, got %v", c, c.after, score)
+		}
+	}
+
+	if score, applied, err := storage.ZIncrBy("board", "bob", 25, ZAddOptions{}); err != nil || !applied || score != 35 {
+		t.Fatalf("Expected 35, got %v %v %+v", score, applied, err)
+	}
+	if _, applied, err := storage.ZIncrBy("board", "bob", -1, ZAddOptions{GT: true}); err != nil || applied {
+		t.Fatalf("Expected the increment to be ruled out, got %v %+v", applied, err)
+	}
+	storage.ZAdd("board", []ZMember{{"bob", 10}}, ZAddOptions{})
+
+	// bob 10, carol 20, dave 20, alice 30
+	for _, c := range []struct {
+		member string
+		rev    bool
+		rank   int
+	}{
+		{"bob", false, 0},
+		{"dave", false, 2},
+		{"alice", false, 3},
+		{"alice", true, 0},
+		{"carol", true, 2},
+	} {
+		if rank, err := storage.ZRank("board", c.member, c.rev); err != nil || rank != c.rank {
+			t.Errorf("%+v: Expected rank %d, got %d %+v", c, c.rank, rank, err)
+		}
+	}
+	if _, err := storage.ZRank("board", "erin", false); err != ErrorKeyNotFound {
+		t.Fatalf("Expected not found, got %+v", err)
+	}
+
+	names := func(members []ZMember) string {
+		var names []string
+		for _, m := range members {
+			names = append(names, m.Member)
+		}
+		return strings.Join(names, " ")
+	}
+	for _, c := range []struct {
+		query    ZRangeQuery
+		expected string
+	}{
+		{ZRangeQuery{Start: 0, Stop: -1}, "bob carol dave alice"},
+		{ZRangeQuery{Start: 1, Stop: 2}, "carol dave"},
+		{ZRangeQuery{Start: -2, Stop: 10}, "dave alice"},
+		{ZRangeQuery{Start: 0, Stop: 1, Rev: true}, "alice dave"},
+		{ZRangeQuery{Start: 3, Stop: 1}, ""},
+		{ZRangeQuery{By: ZRangeByScore, Score: ScoreRange{Min: 10, Max: 20}, Count: -1}, "bob carol dave"},
+		{ZRangeQuery{By: ZRangeByScore, Score: ScoreRange{Min: 10, Max: 20, MinExclusive: true}, Count: -1}, "carol dave"},
+		{ZRangeQuery{By: ZRangeByScore, Score: ScoreRange{Min: math.Inf(-1), Max: math.Inf(1)}, Offset: 1, Count: 2}, "carol dave"},
+		{ZRangeQuery{By: ZRangeByScore, Score: ScoreRange{Min: 15, Max: 30, MaxExclusive: true}, Rev: true, Count: -1}, "dave carol"},
+		{ZRangeQuery{By: ZRangeByScore, Score: ScoreRange{Min: 40, Max: 50}, Count: -1}, ""},
+	} {
+		if members, err := storage.ZRange("board", c.query); err != nil || names(members) != c.expected {
+			t.Errorf("%+v: Expected [%s], got %+v %+v", c.query, c.expected, members, err)
+		}
+	}
+
+	storage.ZAdd("lex", []ZMember{{"a", 0}, {"b", 0}, {"c", 0}, {"d", 0}}, ZAddOptions{})
+	for _, c := range []struct {
+		lex      LexRange
+		rev      bool
+		expected string
+	}{
+		{LexRange{MinUnbounded: true, MaxUnbounded: true}, false, "a b c d"},
+		{LexRange{Min: "b", Max: "c"}, false, "b c"},
+		{LexRange{Min: "b", MinExclusive: true, MaxUnbounded: true}, false, "c d"},
+		{LexRange{MinUnbounded: true, Max: "c", MaxExclusive: true}, true, "b a"},
+	} {
+		query := ZRangeQuery{By: ZRangeByLex, Lex: c.lex, Rev: c.rev, Count: -1}
+		if members, _ := storage.ZRange("lex", query); names(members) != c.expected {
+			t.Errorf("%+v: Expected [%s], got %+v", c.lex, c.expected, members)
+		}
+	}
+
+	if popped, _ := storage.ZPop("board", 2, false); names(popped) != "bob carol" {
+		t.Fatalf("Expected bob and carol, got %+v", popped)
+	}
+	if popped, _ := storage.ZPop("board", 1, true); names(popped) != "alice" || popped[0].Score != 30 {
+		t.Fatalf("Expected alice, got %+v", popped)
+	}
+	if removed, _ := storage.ZRem("board", "dave", "erin"); removed != 1 || storage.Exists("board") != 0 {
+		t.Fatalf("Expected dave and the key to be gone, got %d", removed)
+	}
+
+	storage.Set("string", "value", nil)
+	if _, err := storage.ZAdd("string", members, ZAddOptions{}); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+	if _, err := storage.Get("lex"); err != ErrorWrongType {
+		t.Fatalf("Expected wrong type, got %+v", err)
+	}
+}
+
+func TestBZPop(t *testing.T) {
+	storage := NewStorage()
+
+	if _, err := storage.BZPop([]string{"a"}, false, nil); err != ErrorKeyNotFound {
+		t.Fatalf("Expected nothing to pop, got %+v", err)
+	}
+
+	timeout := new(time.Time)
+	*timeout = time.Now().Add(5 * time.Second)
+	done := make(chan ZPopped)
+	for i := 0; i < 2; i++ {
+		go func() {
+			popped, err := storage.BZPop([]string{"a", "b"}, false, timeout)
+			if err != nil {
+				t.Errorf("Expected a member, got %+v", err)
+			}
+			done <- popped
+		}()
+		for !hasZSetWaiters(storage, "b", i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// One add serves both waiters and empties the key
+	storage.ZAdd("b", []ZMember{{"y", 2}, {"x", 1}}, ZAddOptions{})
+	first, second := <-done, <-done
+	if first.Member > second.Member {
+		first, second = second, first
+	}
+	if first.Key != "b" || first.Member != "x" || first.Score != 1 || second.Member != "y" {
+		t.Fatalf("Expected x and y from b, got %+v %+v", first, second)
+	}
+	if storage.Exists("b") != 0 || !hasZSetWaiters(storage, "a", 0) {
+		t.Fatal("Expected the key and the waiters to be gone")
+	}
+
+	short := new(time.Time)
+	*short = time.Now().Add(50 * time.Millisecond)
+	if _, err := storage.BZPop([]string{"a"}, true, short); err != ErrorKeyNotFound {
+		t.Fatalf("Expected a timeout, got %+v", err)
+	}
+	if !hasZSetWaiters(storage, "a", 0) {
+		t.Fatal("Expected the timed out waiter to be gone")
+	}
+}
+
+func hasZSetWaiters(s *Storage, key string, n int) bool {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	return len(s.zsetWaiters[key]) == n
+}
+
+func TestSkiplist(t *testing.T) {
+	zs := newSortedSet()
+	expected := make(map[string]float64)
+	for i := 0; i < 2000; i++ {
+		member := strconv.Itoa(i % 500)
+		if i%3 == 0 {
+			zs.remove(member)
+			delete(expected, member)
+			continue
+		}
+		score := float64(i % 37)
+		zs.set(member, score)
+		expected[member] = score
+	}
+
+	sorted := make([]ZMember, 0, len(expected))
+	for member, score := range expected {
+		sorted = append(sorted, ZMember{member, score})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		return a.Score < b.Score || (a.Score == b.Score && a.Member < b.Member)
+	})
+
+	if zs.zsl.length != len(sorted) || zs.len() != len(sorted) {
+		t.Fatalf("Expected %d members, got %d", len(sorted), zs.zsl.length)
+	}
+	for i, m := range sorted {
+		if rank := zs.zsl.rank(m.Score, m.Member); rank != i+1 {
+			t.Fatalf("Expected %s at rank %d, got %d", m.Member, i+1, rank)
+		}
+		if x := zs.zsl.byRank(i + 1); x == nil || x.member != m.Member {
+			t.Fatalf("Expected %s at rank %d, got %+v", m.Member, i+1, x)
+		}
+	}
+	if zs.zsl.byRank(len(sorted)+1) != nil || zs.zsl.byRank(0) != nil {
+		t.Fatal("Expected nothing out of range")
+	}
+
+	// Walking back from the tail gives the same order reversed
+	i := len(sorted) - 1
+	for x := zs.zsl.tail; x != nil; x = x.backward {
+		if x.member != sorted[i].Member {
+			t.Fatalf("Expected %s walking back, got %s", sorted[i].Member, x.member)
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatalf("Expected to walk back over every member, %d left", i+1)
+	}
+}
@@ -2,126 +2,1915 @@ package main
 
 import (
 	"errors"
+	"math"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/keshavchand/backendInternAssignment/queue"
 )
 
-type Command interface{}
+type Command interface{}
+
+type Set struct {
+	Command
+
+	Key    string
+	Value  string
+	Expiry *time.Time
+
+	XX      bool // Set if key exists
+	NX      bool // Set if key doesn't exists
+	KeepTTL bool // Keep the expiry of the previous value
+	Get     bool // Reply with the previous value
+}
+
+type Get struct {
+	Command
+
+	Key string
+}
+
+// QPUSH key [PRIORITY n] [DELAY seconds | AT unix-time-seconds] value [value ...]
+type QPush struct {
+	Command
+
+	Key      string
+	Value    []string
+	Priority int
+	// Nil pushes right away
+	At *time.Time
+}
+
+// BQPUSH key timeout [PRIORITY n] value [value ...], waits for room in a
+// full queue with the BLOCK policy
+type BQPush struct {
+	Command
+
+	Key      string
+	Value    []string
+	Priority int
+	Timeout  *time.Time
+}
+
+// QPUSHFRONT key value [value ...]
+type QPushFront struct {
+	Command
+
+	Key   string
+	Value []string
+}
+
+// QPOP key [LEASE seconds]
+type QPop struct {
+	Command
+
+	Key string
+	// Zero pops the value for good
+	Lease time.Duration
+}
+
+// QPOPBACK key
+type QPopBack struct {
+	Command
+
+	Key string
+}
+
+// QLEN key
+type QLen struct {
+	Command
+
+	Key string
+}
+
+// QPEEK key
+type QPeek struct {
+	Command
+
+	Key string
+}
+
+// QRANGE key start stop
+type QRange struct {
+	Command
+
+	Key   string
+	Start int
+	Stop  int
+}
+
+// QREM key count value
+type QRem struct {
+	Command
+
+	Key   string
+	Count int
+	Value string
+}
+
+// BQPOP key [key ...] timeout [LEASE seconds], the timeout is optional with
+// a single key and no lease
+type BQPop struct {
+	Command
+
+	Keys    []string
+	Timeout *time.Time
+	Lease   time.Duration
+}
+
+// QMOVE source destination and BQMOVE source destination timeout
+type QMove struct {
+	Command
+
+	Source      string
+	Destination string
+	// Nil doesn't wait
+	Timeout *time.Time
+}
+
+// QACK key receipt
+type QAck struct {
+	Command
+
+	Key     string
+	Receipt string
+}
+
+// QNACK key receipt
+type QNack struct {
+	Command
+
+	Key     string
+	Receipt string
+}
+
+// QSETDLQ key deadletterkey maxdeliveries, zero maxdeliveries removes it
+type QSetDLQ struct {
+	Command
+
+	Key           string
+	DeadLetterKey string
+	MaxDeliveries int
+}
+
+// QSETCAP key capacity [REJECT | BLOCK | DROPOLDEST], zero capacity removes
+// the limit
+type QSetCap struct {
+	Command
+
+	Key      string
+	Capacity int
+	Policy   OverflowPolicy
+}
+
+// QDLQ key [count]
+type QDLQ struct {
+	Command
+
+	Key   string
+	Count int
+}
+
+// QREDRIVE key [count]
+type QRedrive struct {
+	Command
+
+	Key   string
+	Count int
+}
+
+// XADD key id|* field value [field value ...]
+type XAdd struct {
+	Command
+
+	Key string
+	// Nil picks the next ID
+	ID     *StreamID
+	Fields []string
+}
+
+// XRANGE key start|- end|+ [COUNT n]
+type XRange struct {
+	Command
+
+	Key   string
+	Start StreamID
+	End   StreamID
+	Count int
+}
+
+// XLEN key
+type XLen struct {
+	Command
+
+	Key string
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM] and XGROUP DESTROY key group
+type XGroup struct {
+	Command
+
+	Key    string
+	Group  string
+	Create bool
+	// Nil reads only the entries added after the group is created
+	ID       *StreamID
+	MkStream bool
+}
+
+// XREADGROUP GROUP group consumer [COUNT n] [BLOCK milliseconds] STREAMS key [key ...] id|> [id|> ...]
+type XReadGroup struct {
+	Command
+
+	Group    string
+	Consumer string
+	Count    int
+	// Nil doesn't wait
+	Timeout *time.Time
+	Keys    []string
+	// Nil, given as >, reads entries never delivered to the group
+	IDs []*StreamID
+}
+
+// XACK key group id [id ...]
+type XAck struct {
+	Command
+
+	Key   string
+	Group string
+	IDs   []StreamID
+}
+
+// XCLAIM key group consumer min-idle-milliseconds id [id ...]
+type XClaim struct {
+	Command
+
+	Key      string
+	Group    string
+	Consumer string
+	MinIdle  time.Duration
+	IDs      []StreamID
+}
+
+// XPENDING key group
+type XPending struct {
+	Command
+
+	Key   string
+	Group string
+}
+
+// HSET key field value [field value ...]
+type HSet struct {
+	Command
+
+	Key         string
+	FieldValues []string
+}
+
+// HGET key field
+type HGet struct {
+	Command
+
+	Key   string
+	Field string
+}
+
+// HMGET key field [field ...]
+type HMGet struct {
+	Command
+
+	Key    string
+	Fields []string
+}
+
+// HDEL key field [field ...]
+type HDel struct {
+	Command
+
+	Key    string
+	Fields []string
+}
+
+// HEXISTS key field
+type HExists struct {
+	Command
+
+	Key   string
+	Field string
+}
+
+// HLEN key
+type HLen struct {
+	Command
+
+	Key string
+}
+
+// HGETALL, HKEYS and HVALS
+type HGetAll struct {
+	Command
+
+	Key    string
+	Fields bool
+	Values bool
+}
+
+// HINCRBY key field delta
+type HIncrBy struct {
+	Command
+
+	Key   string
+	Field string
+	Delta int64
+}
+
+// SADD key member [member ...]
+type SAdd struct {
+	Command
+
+	Key     string
+	Members []string
+}
+
+// SREM key member [member ...]
+type SRem struct {
+	Command
+
+	Key     string
+	Members []string
+}
+
+// SISMEMBER key member
+type SIsMember struct {
+	Command
+
+	Key    string
+	Member string
+}
+
+// SMEMBERS key
+type SMembers struct {
+	Command
+
+	Key string
+}
+
+// SCARD key
+type SCard struct {
+	Command
+
+	Key string
+}
+
+// SPOP key [count] and SRANDMEMBER key [count], only SRANDMEMBER takes a
+// negative count
+type SPop struct {
+	Command
+
+	Key   string
+	Count int
+	// Reply with an array, as when a count is given
+	Array bool
+	// Keep the members, SRANDMEMBER
+	Peek bool
+}
+
+// SINTER, SUNION and SDIFF key [key ...], and their STORE variants which
+// take the destination first
+type SCombine struct {
+	Command
+
+	Op          SetOp
+	Keys        []string
+	Store       bool
+	Destination string
+}
+
+// ZADD key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...],
+// INCR takes a single score and member
+type ZAdd struct {
+	Command
+
+	Key     string
+	Members []ZMember
+	Options ZAddOptions
+	// Add the score to the member's instead, see ZIncrBy
+	Incr bool
+}
+
+// ZREM key member [member ...]
+type ZRem struct {
+	Command
+
+	Key     string
+	Members []string
+}
+
+// ZSCORE key member
+type ZScore struct {
+	Command
+
+	Key    string
+	Member string
+}
+
+// ZRANK key member and ZREVRANK key member
+type ZRank struct {
+	Command
+
+	Key    string
+	Member string
+	Rev    bool
+}
+
+// ZCARD key
+type ZCard struct {
+	Command
+
+	Key string
+}
+
+// ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+// [WITHSCORES], with REV a score or lex range is given from max to min
+type ZRange struct {
+	Command
+
+	Key        string
+	Query      ZRangeQuery
+	WithScores bool
+}
+
+// ZPOPMIN key [count] and ZPOPMAX key [count]
+type ZPop struct {
+	Command
+
+	Key   string
+	Count int
+	Max   bool
+}
+
+// BZPOPMIN key [key ...] timeout and BZPOPMAX key [key ...] timeout
+type BZPop struct {
+	Command
+
+	Keys    []string
+	Timeout *time.Time
+	Max     bool
+}
+
+// PUBLISH channel message
+type Publish struct {
+	Command
+
+	Channel string
+	Message string
+}
+
+type MGet struct {
+	Command
+
+	Keys []string
+}
+
+// MSET and MSETNX
+type MSet struct {
+	Command
+
+	Keys   []string
+	Values []string
+	NX     bool // Set none unless no key exists
+}
+
+type Del struct {
+	Command
+
+	Keys []string
+}
+
+type Exists struct {
+	Command
+
+	Keys []string
+}
+
+type TTL struct {
+	Command
+
+	Key          string
+	Milliseconds bool // PTTL
+}
+
+// EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT all resolve to an absolute time
+type Expire struct {
+	Command
+
+	Key string
+	At  time.Time
+}
+
+type Persist struct {
+	Command
+
+	Key string
+}
+
+type Type struct {
+	Command
+
+	Key string
+}
+
+// INCR, DECR, INCRBY and DECRBY
+type IncrBy struct {
+	Command
+
+	Key   string
+	Delta int64
+}
+
+type IncrByFloat struct {
+	Command
+
+	Key   string
+	Delta float64
+}
+
+type BGRewriteAOF struct {
+	Command
+}
+
+type Save struct {
+	Command
+
+	Background bool // BGSAVE
+}
+
+func ParseCommand(command string) (Command, error) {
+	parts, err := Tokenize(command)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseArgs(parts)
+}
+
+// ParseArgs parses an already split command, as received from a RESP client.
+// The command name is case insensitive.
+func ParseArgs(parts []string) (Command, error) {
+	if len(parts) < 1 {
+		return nil, ErrorInvalidCommand
+	}
+
+	switch strings.ToUpper(parts[0]) {
+	case "SET":
+		return parseSetCommand(parts[1:])
+	case "GET":
+		return parseGetCommand(parts[1:])
+	case "QPUSH":
+		return parseQPushCommand(parts[1:])
+	case "BQPUSH":
+		return parseBQPushCommand(parts[1:])
+	case "QPUSHFRONT":
+		return parseQPushFrontCommand(parts[1:])
+	case "QPOP":
+		return parseQPopCommand(parts[1:])
+	case "QPOPBACK":
+		return parseQPopBackCommand(parts[1:])
+	case "QLEN":
+		return parseQLenCommand(parts[1:])
+	case "QPEEK":
+		return parseQPeekCommand(parts[1:])
+	case "QRANGE":
+		return parseQRangeCommand(parts[1:])
+	case "QREM":
+		return parseQRemCommand(parts[1:])
+	case "BQPOP":
+		return parseBQPopCommand(parts[1:])
+	case "QMOVE":
+		return parseQMoveCommand(parts[1:], false)
+	case "BQMOVE":
+		return parseQMoveCommand(parts[1:], true)
+	case "QACK":
+		return parseQAckCommand(parts[1:])
+	case "QNACK":
+		return parseQNackCommand(parts[1:])
+	case "QSETDLQ":
+		return parseQSetDLQCommand(parts[1:])
+	case "QSETCAP":
+		return parseQSetCapCommand(parts[1:])
+	case "QDLQ":
+		return parseQDLQCommand(parts[1:])
+	case "QREDRIVE":
+		return parseQRedriveCommand(parts[1:])
+	case "XADD":
+		return parseXAddCommand(parts[1:])
+	case "XRANGE":
+		return parseXRangeCommand(parts[1:])
+	case "XLEN":
+		return parseXLenCommand(parts[1:])
+	case "XGROUP":
+		return parseXGroupCommand(parts[1:])
+	case "XREADGROUP":
+		return parseXReadGroupCommand(parts[1:])
+	case "XACK":
+		return parseXAckCommand(parts[1:])
+	case "XCLAIM":
+		return parseXClaimCommand(parts[1:])
+	case "XPENDING":
+		return parseXPendingCommand(parts[1:])
+	case "HSET":
+		return parseHSetCommand(parts[1:])
+	case "HGET":
+		return parseHGetCommand(parts[1:])
+	case "HMGET":
+		return parseHMGetCommand(parts[1:])
+	case "HDEL":
+		return parseHDelCommand(parts[1:])
+	case "HEXISTS":
+		return parseHExistsCommand(parts[1:])
+	case "HLEN":
+		return parseHLenCommand(parts[1:])
+	case "HGETALL":
+		return parseHGetAllCommand(parts[1:], true, true)
+	case "HKEYS":
+		return parseHGetAllCommand(parts[1:], true, false)
+	case "HVALS":
+		return parseHGetAllCommand(parts[1:], false, true)
+	case "HINCRBY":
+		return parseHIncrByCommand(parts[1:])
+	case "SADD":
+		return parseSAddCommand(parts[1:])
+	case "SREM":
+		return parseSRemCommand(parts[1:])
+	case "SISMEMBER":
+		return parseSIsMemberCommand(parts[1:])
+	case "SMEMBERS":
+		return parseSMembersCommand(parts[1:])
+	case "SCARD":
+		return parseSCardCommand(parts[1:])
+	case "SPOP":
+		return parseSPopCommand(parts[1:], false)
+	case "SRANDMEMBER":
+		return parseSPopCommand(parts[1:], true)
+	case "SINTER":
+		return parseSCombineCommand(parts[1:], SetInter, false)
+	case "SUNION":
+		return parseSCombineCommand(parts[1:], SetUnion, false)
+	case "SDIFF":
+		return parseSCombineCommand(parts[1:], SetDiff, false)
+	case "SINTERSTORE":
+		return parseSCombineCommand(parts[1:], SetInter, true)
+	case "SUNIONSTORE":
+		return parseSCombineCommand(parts[1:], SetUnion, true)
+	case "SDIFFSTORE":
+		return parseSCombineCommand(parts[1:], SetDiff, true)
+	case "ZADD":
+		return parseZAddCommand(parts[1:])
+	case "ZREM":
+		return parseZRemCommand(parts[1:])
+	case "ZSCORE":
+		return parseZScoreCommand(parts[1:])
+	case "ZRANK":
+		return parseZRankCommand(parts[1:], false)
+	case "ZREVRANK":
+		return parseZRankCommand(parts[1:], true)
+	case "ZCARD":
+		return parseZCardCommand(parts[1:])
+	case "ZRANGE":
+		return parseZRangeCommand(parts[1:])
+	case "ZPOPMIN":
+		return parseZPopCommand(parts[1:], false)
+	case "ZPOPMAX":
+		return parseZPopCommand(parts[1:], true)
+	case "BZPOPMIN":
+		return parseBZPopCommand(parts[1:], false)
+	case "BZPOPMAX":
+		return parseBZPopCommand(parts[1:], true)
+	case "PUBLISH":
+		return parsePublishCommand(parts[1:])
+	case "MGET":
+		return parseMGetCommand(parts[1:])
+	case "MSET":
+		return parseMSetCommand(parts[1:], false)
+	case "MSETNX":
+		return parseMSetCommand(parts[1:], true)
+	case "DEL":
+		return parseDelCommand(parts[1:])
+	case "EXISTS":
+		return parseExistsCommand(parts[1:])
+	case "TTL":
+		return parseTTLCommand(parts[1:], false)
+	case "PTTL":
+		return parseTTLCommand(parts[1:], true)
+	case "EXPIRE":
+		return parseExpireCommand(parts[1:], time.Second, false)
+	case "PEXPIRE":
+		return parseExpireCommand(parts[1:], time.Millisecond, false)
+	case "EXPIREAT":
+		return parseExpireCommand(parts[1:], time.Second, true)
+	case "PEXPIREAT":
+		return parseExpireCommand(parts[1:], time.Millisecond, true)
+	case "PERSIST":
+		return parsePersistCommand(parts[1:])
+	case "TYPE":
+		return parseTypeCommand(parts[1:])
+	case "INCR":
+		return parseIncrCommand(parts[1:], 1)
+	case "DECR":
+		return parseIncrCommand(parts[1:], -1)
+	case "INCRBY":
+		return parseIncrByCommand(parts[1:], 1)
+	case "DECRBY":
+		return parseIncrByCommand(parts[1:], -1)
+	case "INCRBYFLOAT":
+		return parseIncrByFloatCommand(parts[1:])
+	case "BGREWRITEAOF":
+		return parseBGRewriteAOFCommand(parts[1:])
+	case "SAVE":
+		return parseSaveCommand(parts[1:], false)
+	case "BGSAVE":
+		return parseSaveCommand(parts[1:], true)
+	default:
+		return nil, ErrorInvalidCommand
+	}
+}
+
+var (
+	ErrorInvalidCommand             = errors.New("invalid command")
+	ErrorInvalidGetCommand          = errors.New("invalid get command")
+	ErrorInvalidSetCommand          = errors.New("invalid set command")
+	ErrorSetExpiryConflict          = errors.New("invalid set command: only one of EX, PX, EXAT, PXAT and KEEPTTL is allowed")
+	ErrorSetConditionConflict       = errors.New("invalid set command: NX and XX are mutually exclusive")
+	ErrorInvalidQPushCommand        = errors.New("invalid qpush command")
+	ErrorInvalidBQPushCommand       = errors.New("invalid bqpush command")
+	ErrorInvalidQPushFrontCommand   = errors.New("invalid qpushfront command")
+	ErrorInvalidQPopCommand         = errors.New("invalid qpop command")
+	ErrorInvalidQPopBackCommand     = errors.New("invalid qpopback command")
+	ErrorInvalidQLenCommand         = errors.New("invalid qlen command")
+	ErrorInvalidQPeekCommand        = errors.New("invalid qpeek command")
+	ErrorInvalidQRangeCommand       = errors.New("invalid qrange command")
+	ErrorInvalidQRemCommand         = errors.New("invalid qrem command")
+	ErrorInvalidBQPopCommand        = errors.New("invalid bqpop command")
+	ErrorInvalidQMoveCommand        = errors.New("invalid qmove command")
+	ErrorInvalidQAckCommand         = errors.New("invalid qack command")
+	ErrorInvalidQNackCommand        = errors.New("invalid qnack command")
+	ErrorInvalidQSetDLQCommand      = errors.New("invalid qsetdlq command")
+	ErrorInvalidQSetCapCommand      = errors.New("invalid qsetcap command")
+	ErrorInvalidQDLQCommand         = errors.New("invalid qdlq command")
+	ErrorInvalidQRedriveCommand     = errors.New("invalid qredrive command")
+	ErrorInvalidXAddCommand         = errors.New("invalid xadd command")
+	ErrorInvalidXRangeCommand       = errors.New("invalid xrange command")
+	ErrorInvalidXLenCommand         = errors.New("invalid xlen command")
+	ErrorInvalidXGroupCommand       = errors.New("invalid xgroup command")
+	ErrorInvalidXReadGroupCommand   = errors.New("invalid xreadgroup command")
+	ErrorInvalidXAckCommand         = errors.New("invalid xack command")
+	ErrorInvalidXClaimCommand       = errors.New("invalid xclaim command")
+	ErrorInvalidXPendingCommand     = errors.New("invalid xpending command")
+	ErrorInvalidHSetCommand         = errors.New("invalid hset command")
+	ErrorInvalidHGetCommand         = errors.New("invalid hget command")
+	ErrorInvalidHMGetCommand        = errors.New("invalid hmget command")
+	ErrorInvalidHDelCommand         = errors.New("invalid hdel command")
+	ErrorInvalidHExistsCommand      = errors.New("invalid hexists command")
+	ErrorInvalidHLenCommand         = errors.New("invalid hlen command")
+	ErrorInvalidHGetAllCommand      = errors.New("invalid hgetall command")
+	ErrorInvalidHIncrByCommand      = errors.New("invalid hincrby command")
+	ErrorInvalidSAddCommand         = errors.New("invalid sadd command")
+	ErrorInvalidSRemCommand         = errors.New("invalid srem command")
+	ErrorInvalidSIsMemberCommand    = errors.New("invalid sismember command")
+	ErrorInvalidSMembersCommand     = errors.New("invalid smembers command")
+	ErrorInvalidSCardCommand        = errors.New("invalid scard command")
+	ErrorInvalidSPopCommand         = errors.New("invalid spop command")
+	ErrorInvalidSCombineCommand     = errors.New("invalid set combination command")
+	ErrorInvalidZAddCommand         = errors.New("invalid zadd command")
+	ErrorInvalidZRemCommand         = errors.New("invalid zrem command")
+	ErrorInvalidZScoreCommand       = errors.New("invalid zscore command")
+	ErrorInvalidZRankCommand        = errors.New("invalid zrank command")
+	ErrorInvalidZCardCommand        = errors.New("invalid zcard command")
+	ErrorInvalidZRangeCommand       = errors.New("invalid zrange command")
+	ErrorInvalidZPopCommand         = errors.New("invalid zpop command")
+	ErrorInvalidBZPopCommand        = errors.New("invalid bzpop command")
+	ErrorInvalidPublishCommand      = errors.New("invalid publish command")
+	ErrorInvalidMGetCommand         = errors.New("invalid mget command")
+	ErrorInvalidMSetCommand         = errors.New("invalid mset command")
+	ErrorInvalidDelCommand          = errors.New("invalid del command")
+	ErrorInvalidExistsCommand       = errors.New("invalid exists command")
+	ErrorInvalidTTLCommand          = errors.New("invalid ttl command")
+	ErrorInvalidExpireCommand       = errors.New("invalid expire command")
+	ErrorInvalidPersistCommand      = errors.New("invalid persist command")
+	ErrorInvalidTypeCommand         = errors.New("invalid type command")
+	ErrorInvalidIncrCommand         = errors.New("invalid incr command")
+	ErrorInvalidIncrByFloatCommand  = errors.New("invalid incrbyfloat command")
+	ErrorInvalidBGRewriteAOFCommand = errors.New("invalid bgrewriteaof command")
+	ErrorInvalidSaveCommand         = errors.New("invalid save command")
+)
+
+func parseQPushCommand(parts []string) (qpush QPush, nil error) {
+	qpush, ok := parseQPushArgs(parts, true)
+	if !ok {
+		return qpush, ErrorInvalidQPushCommand
+	}
+	return
+}
+
+// Parses key [PRIORITY n] [DELAY seconds | AT unix-time-seconds] value [value ...],
+// DELAY and AT are only options if delays is set
+func parseQPushArgs(parts []string, delays bool) (qpush QPush, ok bool) {
+	if len(parts) < 2 {
+		return qpush, false
+	}
+
+	qpush.Key = parts[0]
+	parts = parts[1:]
+
+	// An option needs a value after it, otherwise it is the value
+	hasPriority, hasAt := false, false
+	for len(parts) >= 3 {
+		option := strings.ToUpper(parts[0])
+		switch {
+		case option == "PRIORITY" && !hasPriority:
+			priority, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return qpush, false
+			}
+			qpush.Priority = priority
+			hasPriority = true
+
+		case (option == "DELAY" || option == "AT") && delays && !hasAt:
+			seconds, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || seconds < 0 || seconds > math.MaxInt64/int64(time.Second) {
+				return qpush, false
+			}
+			qpush.At = new(time.Time)
+			if option == "DELAY" {
+				*qpush.At = time.Now().Add(time.Duration(seconds) * time.Second)
+			} else {
+				*qpush.At = time.Unix(seconds, 0)
+			}
+			hasAt = true
+
+		case option == "PRIORITY" || option == "DELAY" || option == "AT":
+			return qpush, false
+
+		default:
+			qpush.Value = parts
+			return qpush, true
+		}
+		parts = parts[2:]
+	}
+
+	qpush.Value = parts
+	return qpush, true
+}
+
+func parseBQPushCommand(parts []string) (bqpush BQPush, nil error) {
+	if len(parts) < 3 {
+		return bqpush, ErrorInvalidBQPushCommand
+	}
+
+	timeout, err := strconv.Atoi(parts[1])
+	if err != nil || timeout < 0 {
+		return bqpush, ErrorInvalidBQPushCommand
+	}
+
+	// A delayed push has nothing to wait for
+	qpush, ok := parseQPushArgs(append([]string{parts[0]}, parts[2:]...), false)
+	if !ok {
+		return bqpush, ErrorInvalidBQPushCommand
+	}
+
+	bqpush.Key = qpush.Key
+	bqpush.Value = qpush.Value
+	bqpush.Priority = qpush.Priority
+	bqpush.Timeout = new(time.Time)
+	*bqpush.Timeout = time.Now().Add(time.Duration(timeout) * time.Second)
+	return
+}
+
+func parseGetCommand(parts []string) (get Get, nil error) {
+	if len(parts) < 1 {
+		return get, ErrorInvalidGetCommand
+	}
+
+	get.Key = parts[0]
+	return
+}
+
+func parseQPopCommand(parts []string) (qpop QPop, nil error) {
+	if len(parts) != 1 && len(parts) != 3 {
+		return qpop, ErrorInvalidQPopCommand
+	}
+
+	qpop.Key = parts[0]
+	if len(parts) == 3 {
+		lease, ok := parseLease(parts[1:])
+		if !ok {
+			return qpop, ErrorInvalidQPopCommand
+		}
+		qpop.Lease = lease
+	}
+	return
+}
+
+func parseQPushFrontCommand(parts []string) (qpush QPushFront, nil error) {
+	if len(parts) < 2 {
+		return qpush, ErrorInvalidQPushFrontCommand
+	}
+
+	qpush.Key = parts[0]
+	qpush.Value = parts[1:]
+	return
+}
+
+func parseQPopBackCommand(parts []string) (qpop QPopBack, nil error) {
+	if len(parts) != 1 {
+		return qpop, ErrorInvalidQPopBackCommand
+	}
+
+	qpop.Key = parts[0]
+	return
+}
+
+func parseQLenCommand(parts []string) (qlen QLen, nil error) {
+	if len(parts) != 1 {
+		return qlen, ErrorInvalidQLenCommand
+	}
+
+	qlen.Key = parts[0]
+	return
+}
+
+func parseQPeekCommand(parts []string) (qpeek QPeek, nil error) {
+	if len(parts) != 1 {
+		return qpeek, ErrorInvalidQPeekCommand
+	}
+
+	qpeek.Key = parts[0]
+	return
+}
+
+func parseQRangeCommand(parts []string) (qrange QRange, nil error) {
+	if len(parts) != 3 {
+		return qrange, ErrorInvalidQRangeCommand
+	}
+
+	start, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return qrange, ErrorInvalidQRangeCommand
+	}
+	stop, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return qrange, ErrorInvalidQRangeCommand
+	}
+
+	qrange.Key = parts[0]
+	qrange.Start = start
+	qrange.Stop = stop
+	return
+}
+
+func parseQRemCommand(parts []string) (qrem QRem, nil error) {
+	if len(parts) != 3 {
+		return qrem, ErrorInvalidQRemCommand
+	}
+
+	count, err := strconv.Atoi(parts[1])
+	// The count is negated for removals from the end
+	if err != nil || count == math.MinInt {
+		return qrem, ErrorInvalidQRemCommand
+	}
+
+	qrem.Key = parts[0]
+	qrem.Count = count
+	qrem.Value = parts[2]
+	return
+}
+
+// Parses LEASE seconds
+func parseLease(parts []string) (time.Duration, bool) {
+	if !strings.EqualFold(parts[0], "LEASE") {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || seconds <= 0 || seconds > math.MaxInt64/int64(time.Second) {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func parseBQPopCommand(parts []string) (bqpop BQPop, nil error) {
+	if len(parts) < 1 {
+		return bqpop, ErrorInvalidBQPopCommand
+	}
+
+	// A lease needs the timeout, so there are at least a key and a timeout before it
+	if n := len(parts); n >= 4 && strings.EqualFold(parts[n-2], "LEASE") {
+		lease, ok := parseLease(parts[n-2:])
+		if !ok {
+			return bqpop, ErrorInvalidBQPopCommand
+		}
+		bqpop.Lease = lease
+		parts = parts[:n-2]
+	}
+
+	if len(parts) < 2 {
+		bqpop.Keys = parts
+		return bqpop, nil
+	}
+
+	bqpop.Keys = parts[:len(parts)-1]
+	timeout, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil || timeout < 0 {
+		return bqpop, ErrorInvalidBQPopCommand
+	}
+	bqpop.Timeout = new(time.Time)
+	*bqpop.Timeout = time.Now().Add(time.Duration(timeout) * time.Second)
+
+	return
+}
+
+// blocking is set for BQMOVE, which takes a timeout after the keys
+func parseQMoveCommand(parts []string, blocking bool) (qmove QMove, nil error) {
+	if (!blocking && len(parts) != 2) || (blocking && len(parts) != 3) || parts[1] == "" {
+		return qmove, ErrorInvalidQMoveCommand
+	}
+
+	qmove.Source = parts[0]
+	qmove.Destination = parts[1]
+	if blocking {
+		timeout, err := strconv.Atoi(parts[2])
+		if err != nil || timeout < 0 {
+			return qmove, ErrorInvalidQMoveCommand
+		}
+		qmove.Timeout = new(time.Time)
+		*qmove.Timeout = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+	return
+}
+
+func parseQAckCommand(parts []string) (qack QAck, nil error) {
+	if len(parts) != 2 {
+		return qack, ErrorInvalidQAckCommand
+	}
+
+	qack.Key = parts[0]
+	qack.Receipt = parts[1]
+	return
+}
+
+func parseQNackCommand(parts []string) (qnack QNack, nil error) {
+	if len(parts) != 2 {
+		return qnack, ErrorInvalidQNackCommand
+	}
+
+	qnack.Key = parts[0]
+	qnack.Receipt = parts[1]
+	return
+}
+
+func parseQSetDLQCommand(parts []string) (qsetdlq QSetDLQ, nil error) {
+	if len(parts) != 3 || parts[0] == parts[1] {
+		return qsetdlq, ErrorInvalidQSetDLQCommand
+	}
+
+	maxDeliveries, err := strconv.Atoi(parts[2])
+	if err != nil || maxDeliveries < 0 {
+		return qsetdlq, ErrorInvalidQSetDLQCommand
+	}
+
+	qsetdlq.Key = parts[0]
+	qsetdlq.DeadLetterKey = parts[1]
+	qsetdlq.MaxDeliveries = maxDeliveries
+	return
+}
+
+func parseQSetCapCommand(parts []string) (qsetcap QSetCap, nil error) {
+	if len(parts) != 2 && len(parts) != 3 {
+		return qsetcap, ErrorInvalidQSetCapCommand
+	}
+
+	capacity, err := strconv.Atoi(parts[1])
+	if err != nil || capacity < 0 {
+		return qsetcap, ErrorInvalidQSetCapCommand
+	}
+
+	qsetcap.Key = parts[0]
+	qsetcap.Capacity = capacity
+	if len(parts) == 3 {
+		policy, ok := queue.ParseOverflowPolicy(strings.ToUpper(parts[2]))
+		if !ok {
+			return qsetcap, ErrorInvalidQSetCapCommand
+		}
+		qsetcap.Policy = policy
+	}
+	return
+}
+
+func parseQDLQCommand(parts []string) (qdlq QDLQ, nil error) {
+	key, count, ok := parseKeyAndCount(parts)
+	if !ok {
+		return qdlq, ErrorInvalidQDLQCommand
+	}
+
+	qdlq.Key = key
+	qdlq.Count = count
+	return
+}
+
+func parseQRedriveCommand(parts []string) (qredrive QRedrive, nil error) {
+	key, count, ok := parseKeyAndCount(parts)
+	if !ok {
+		return qredrive, ErrorInvalidQRedriveCommand
+	}
+
+	qredrive.Key = key
+	qredrive.Count = count
+	return
+}
+
+// Parses key [count], without a count there is no limit
+func parseKeyAndCount(parts []string) (string, int, bool) {
+	if len(parts) != 1 && len(parts) != 2 {
+		return "", 0, false
+	}
+	if len(parts) == 1 {
+		return parts[0], math.MaxInt, true
+	}
+
+	count, err := strconv.Atoi(parts[1])
+	if err != nil || count <= 0 {
+		return "", 0, false
+	}
+	return parts[0], count, true
+}
+
+func parseXAddCommand(parts []string) (xadd XAdd, nil error) {
+	if len(parts) < 4 || len(parts)%2 != 0 {
+		return xadd, ErrorInvalidXAddCommand
+	}
+
+	xadd.Key = parts[0]
+	if parts[1] != "*" {
+		id, ok := parseStreamID(parts[1], 0)
+		// 0-0 is never greater than the last ID
+		if !ok || id == (StreamID{}) {
+			return xadd, ErrorInvalidXAddCommand
+		}
+		xadd.ID = &id
+	}
+	xadd.Fields = parts[2:]
+	return
+}
+
+func parseXRangeCommand(parts []string) (xrange XRange, nil error) {
+	if len(parts) != 3 && len(parts) != 5 {
+		return xrange, ErrorInvalidXRangeCommand
+	}
+
+	// A start or end without a sequence number includes the whole millisecond
+	if parts[1] != "-" {
+		start, ok := parseStreamID(parts[1], 0)
+		if !ok {
+			return xrange, ErrorInvalidXRangeCommand
+		}
+		xrange.Start = start
+	}
+	xrange.End = maxStreamID
+	if parts[2] != "+" {
+		end, ok := parseStreamID(parts[2], math.MaxUint64)
+		if !ok {
+			return xrange, ErrorInvalidXRangeCommand
+		}
+		xrange.End = end
+	}
+
+	xrange.Key = parts[0]
+	xrange.Count = math.MaxInt
+	if len(parts) == 5 {
+		count, ok := parseCount(parts[3:])
+		if !ok {
+			return xrange, ErrorInvalidXRangeCommand
+		}
+		xrange.Count = count
+	}
+	return
+}
+
+// Parses COUNT n
+func parseCount(parts []string) (int, bool) {
+	if !strings.EqualFold(parts[0], "COUNT") {
+		return 0, false
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil || count <= 0 {
+		return 0, false
+	}
+	return count, true
+}
+
+func parseXLenCommand(parts []string) (xlen XLen, nil error) {
+	if len(parts) != 1 {
+		return xlen, ErrorInvalidXLenCommand
+	}
+
+	xlen.Key = parts[0]
+	return
+}
+
+func parseXGroupCommand(parts []string) (xgroup XGroup, nil error) {
+	if len(parts) < 1 {
+		return xgroup, ErrorInvalidXGroupCommand
+	}
+
+	switch strings.ToUpper(parts[0]) {
+	case "CREATE":
+		if len(parts) != 4 && len(parts) != 5 {
+			return xgroup, ErrorInvalidXGroupCommand
+		}
+		if len(parts) == 5 && !strings.EqualFold(parts[4], "MKSTREAM") {
+			return xgroup, ErrorInvalidXGroupCommand
+		}
+		if parts[3] != "$" {
+			id, ok := parseStreamID(parts[3], 0)
+			if !ok {
+				return xgroup, ErrorInvalidXGroupCommand
+			}
+			xgroup.ID = &id
+		}
+		xgroup.Create = true
+		xgroup.MkStream = len(parts) == 5
+
+	case "DESTROY":
+		if len(parts) != 3 {
+			return xgroup, ErrorInvalidXGroupCommand
+		}
+
+	default:
+		return xgroup, ErrorInvalidXGroupCommand
+	}
+
+	xgroup.Key = parts[1]
+	xgroup.Group = parts[2]
+	return
+}
+
+func parseXReadGroupCommand(parts []string) (xread XReadGroup, nil error) {
+	if len(parts) < 6 || !strings.EqualFold(parts[0], "GROUP") {
+		return xread, ErrorInvalidXReadGroupCommand
+	}
+
+	xread.Group = parts[1]
+	xread.Consumer = parts[2]
+	xread.Count = math.MaxInt
+	parts = parts[3:]
+
+	hasCount, hasBlock := false, false
+	for len(parts) >= 2 && !strings.EqualFold(parts[0], "STREAMS") {
+		switch option := strings.ToUpper(parts[0]); {
+		case option == "COUNT" && !hasCount:
+			count, ok := parseCount(parts)
+			if !ok {
+				return xread, ErrorInvalidXReadGroupCommand
+			}
+			xread.Count = count
+			hasCount = true
+
+		case option == "BLOCK" && !hasBlock:
+			ms, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || ms < 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+				return xread, ErrorInvalidXReadGroupCommand
+			}
+			xread.Timeout = new(time.Time)
+			*xread.Timeout = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			hasBlock = true
+
+		default:
+			return xread, ErrorInvalidXReadGroupCommand
+		}
+		parts = parts[2:]
+	}
+
+	// STREAMS then as many IDs as keys
+	if len(parts) < 3 || len(parts)%2 != 1 || !strings.EqualFold(parts[0], "STREAMS") {
+		return xread, ErrorInvalidXReadGroupCommand
+	}
+	parts = parts[1:]
+	n := len(parts) / 2
+
+	xread.Keys = parts[:n]
+	for _, arg := range parts[n:] {
+		var id *StreamID
+		if arg != ">" {
+			parsed, ok := parseStreamID(arg, 0)
+			if !ok {
+				return xread, ErrorInvalidXReadGroupCommand
+			}
+			id = &parsed
+		}
+		xread.IDs = append(xread.IDs, id)
+	}
+	return
+}
+
+func parseXAckCommand(parts []string) (xack XAck, nil error) {
+	if len(parts) < 3 {
+		return xack, ErrorInvalidXAckCommand
+	}
+
+	ids, ok := parseStreamIDs(parts[2:])
+	if !ok {
+		return xack, ErrorInvalidXAckCommand
+	}
+
+	xack.Key = parts[0]
+	xack.Group = parts[1]
+	xack.IDs = ids
+	return
+}
+
+func parseXClaimCommand(parts []string) (xclaim XClaim, nil error) {
+	if len(parts) < 5 {
+		return xclaim, ErrorInvalidXClaimCommand
+	}
+
+	ms, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || ms < 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+		return xclaim, ErrorInvalidXClaimCommand
+	}
+	ids, ok := parseStreamIDs(parts[4:])
+	if !ok {
+		return xclaim, ErrorInvalidXClaimCommand
+	}
+
+	xclaim.Key = parts[0]
+	xclaim.Group = parts[1]
+	xclaim.Consumer = parts[2]
+	xclaim.MinIdle = time.Duration(ms) * time.Millisecond
+	xclaim.IDs = ids
+	return
+}
+
+func parseXPendingCommand(parts []string) (xpending XPending, nil error) {
+	if len(parts) != 2 {
+		return xpending, ErrorInvalidXPendingCommand
+	}
+
+	xpending.Key = parts[0]
+	xpending.Group = parts[1]
+	return
+}
+
+func parseHSetCommand(parts []string) (hset HSet, nil error) {
+	if len(parts) < 3 || len(parts)%2 != 1 {
+		return hset, ErrorInvalidHSetCommand
+	}
+
+	hset.Key = parts[0]
+	hset.FieldValues = parts[1:]
+	return
+}
+
+func parseHGetCommand(parts []string) (hget HGet, nil error) {
+	if len(parts) != 2 {
+		return hget, ErrorInvalidHGetCommand
+	}
+
+	hget.Key = parts[0]
+	hget.Field = parts[1]
+	return
+}
+
+func parseHMGetCommand(parts []string) (hmget HMGet, nil error) {
+	if len(parts) < 2 {
+		return hmget, ErrorInvalidHMGetCommand
+	}
 
-type Set struct {
-	Command
+	hmget.Key = parts[0]
+	hmget.Fields = parts[1:]
+	return
+}
 
-	Key    string
-	Value  string
-	Expiry *time.Time
+func parseHDelCommand(parts []string) (hdel HDel, nil error) {
+	if len(parts) < 2 {
+		return hdel, ErrorInvalidHDelCommand
+	}
 
-	XX bool // Set if key exists
-	NX bool // Set if key doesn't exists
+	hdel.Key = parts[0]
+	hdel.Fields = parts[1:]
+	return
 }
 
-type Get struct {
-	Command
+func parseHExistsCommand(parts []string) (hexists HExists, nil error) {
+	if len(parts) != 2 {
+		return hexists, ErrorInvalidHExistsCommand
+	}
 
-	Key string
+	hexists.Key = parts[0]
+	hexists.Field = parts[1]
+	return
 }
 
-type QPush struct {
-	Command
+func parseHLenCommand(parts []string) (hlen HLen, nil error) {
+	if len(parts) != 1 {
+		return hlen, ErrorInvalidHLenCommand
+	}
 
-	Key   string
-	Value []string
+	hlen.Key = parts[0]
+	return
 }
 
-type QPop struct {
-	Command
+// HKEYS only wants the fields and HVALS only the values
+func parseHGetAllCommand(parts []string, fields, values bool) (hgetall HGetAll, nil error) {
+	if len(parts) != 1 {
+		return hgetall, ErrorInvalidHGetAllCommand
+	}
 
-	Key string
+	hgetall.Key = parts[0]
+	hgetall.Fields = fields
+	hgetall.Values = values
+	return
 }
 
-type BQPop struct {
-	Command
+func parseHIncrByCommand(parts []string) (hincrby HIncrBy, nil error) {
+	if len(parts) != 3 {
+		return hincrby, ErrorInvalidHIncrByCommand
+	}
 
-	Key     string
-	Timeout *time.Time
+	delta, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return hincrby, ErrorInvalidHIncrByCommand
+	}
+
+	hincrby.Key = parts[0]
+	hincrby.Field = parts[1]
+	hincrby.Delta = delta
+	return
 }
 
-func ParseCommand(command string) (Command, error) {
-	parts := strings.Split(command, " ")
+func parseSAddCommand(parts []string) (sadd SAdd, nil error) {
 	if len(parts) < 2 {
-		return nil, ErrorInvalidCommand
+		return sadd, ErrorInvalidSAddCommand
 	}
 
-	switch parts[0] {
-	case "SET":
-		return parseSetCommand(parts[1:])
-	case "GET":
-		return parseGetCommand(parts[1:])
-	case "QPUSH":
-		return parseQPushCommand(parts[1:])
-	case "QPOP":
-		return parseQPopCommand(parts[1:])
-	case "BQPOP":
-		return parseBQPopCommand(parts[1:])
-	default:
-		return nil, ErrorInvalidCommand
+	sadd.Key = parts[0]
+	sadd.Members = parts[1:]
+	return
+}
+
+func parseSRemCommand(parts []string) (srem SRem, nil error) {
+	if len(parts) < 2 {
+		return srem, ErrorInvalidSRemCommand
 	}
+
+	srem.Key = parts[0]
+	srem.Members = parts[1:]
+	return
 }
 
-var (
-	ErrorInvalidCommand      = errors.New("invalid command")
-	ErrorInvalidGetCommand   = errors.New("invalid get command")
-	ErrorInvalidSetCommand   = errors.New("invalid set command")
-	ErrorInvalidQPushCommand = errors.New("invalid qpush command")
-	ErrorInvalidQPopCommand  = errors.New("invalid qpop command")
-	ErrorInvalidBQPopCommand = errors.New("invalid bqpop command")
-)
+func parseSIsMemberCommand(parts []string) (sismember SIsMember, nil error) {
+	if len(parts) != 2 {
+		return sismember, ErrorInvalidSIsMemberCommand
+	}
 
-func parseQPushCommand(parts []string) (qpush QPush, nil error) {
+	sismember.Key = parts[0]
+	sismember.Member = parts[1]
+	return
+}
+
+func parseSMembersCommand(parts []string) (smembers SMembers, nil error) {
+	if len(parts) != 1 {
+		return smembers, ErrorInvalidSMembersCommand
+	}
+
+	smembers.Key = parts[0]
+	return
+}
+
+func parseSCardCommand(parts []string) (scard SCard, nil error) {
+	if len(parts) != 1 {
+		return scard, ErrorInvalidSCardCommand
+	}
+
+	scard.Key = parts[0]
+	return
+}
+
+// peek is set for SRANDMEMBER
+func parseSPopCommand(parts []string, peek bool) (spop SPop, nil error) {
+	if len(parts) != 1 && len(parts) != 2 {
+		return spop, ErrorInvalidSPopCommand
+	}
+
+	spop.Key = parts[0]
+	spop.Count = 1
+	spop.Peek = peek
+	if len(parts) == 2 {
+		count, err := strconv.Atoi(parts[1])
+		// The count is negated for SRANDMEMBER with repeats
+		if err != nil || (count < 0 && !peek) || count < -maxRandomMembers {
+			return spop, ErrorInvalidSPopCommand
+		}
+		spop.Count = count
+		spop.Array = true
+	}
+	return
+}
+
+// store is set for the STORE variants
+func parseSCombineCommand(parts []string, op SetOp, store bool) (scombine SCombine, nil error) {
+	if len(parts) < 1 || (store && len(parts) < 2) {
+		return scombine, ErrorInvalidSCombineCommand
+	}
+
+	scombine.Op = op
+	scombine.Store = store
+	if store {
+		scombine.Destination = parts[0]
+		parts = parts[1:]
+	}
+	scombine.Keys = parts
+	return
+}
+
+func parseZAddCommand(parts []string) (zadd ZAdd, nil error) {
+	if len(parts) < 1 {
+		return zadd, ErrorInvalidZAddCommand
+	}
+	zadd.Key = parts[0]
+	parts = parts[1:]
+
+options:
+	for len(parts) > 0 {
+		switch strings.ToUpper(parts[0]) {
+		case "NX":
+			zadd.Options.NX = true
+		case "XX":
+			zadd.Options.XX = true
+		case "GT":
+			zadd.Options.GT = true
+		case "LT":
+			zadd.Options.LT = true
+		case "CH":
+			zadd.Options.CH = true
+		case "INCR":
+			zadd.Incr = true
+		default:
+			break options
+		}
+		parts = parts[1:]
+	}
+
+	o := zadd.Options
+	if (o.NX && (o.XX || o.GT || o.LT)) || (o.GT && o.LT) {
+		return zadd, ErrorInvalidZAddCommand
+	}
+	if len(parts) == 0 || len(parts)%2 != 0 || (zadd.Incr && len(parts) != 2) {
+		return zadd, ErrorInvalidZAddCommand
+	}
+
+	for i := 0; i < len(parts); i += 2 {
+		score, ok := parseScore(parts[i])
+		if !ok {
+			return zadd, ErrorInvalidZAddCommand
+		}
+		zadd.Members = append(zadd.Members, ZMember{Member: parts[i+1], Score: score})
+	}
+	return
+}
+
+func parseZRemCommand(parts []string) (zrem ZRem, nil error) {
 	if len(parts) < 2 {
-		return qpush, ErrorInvalidQPushCommand
+		return zrem, ErrorInvalidZRemCommand
 	}
 
-	qpush.Key = parts[0]
-	qpush.Value = parts[1:]
+	zrem.Key = parts[0]
+	zrem.Members = parts[1:]
 	return
 }
 
-func parseGetCommand(parts []string) (get Get, nil error) {
+func parseZScoreCommand(parts []string) (zscore ZScore, nil error) {
+	if len(parts) != 2 {
+		return zscore, ErrorInvalidZScoreCommand
+	}
+
+	zscore.Key = parts[0]
+	zscore.Member = parts[1]
+	return
+}
+
+// rev is set for ZREVRANK
+func parseZRankCommand(parts []string, rev bool) (zrank ZRank, nil error) {
+	if len(parts) != 2 {
+		return zrank, ErrorInvalidZRankCommand
+	}
+
+	zrank.Key = parts[0]
+	zrank.Member = parts[1]
+	zrank.Rev = rev
+	return
+}
+
+func parseZCardCommand(parts []string) (zcard ZCard, nil error) {
+	if len(parts) != 1 {
+		return zcard, ErrorInvalidZCardCommand
+	}
+
+	zcard.Key = parts[0]
+	return
+}
+
+func parseZRangeCommand(parts []string) (zrange ZRange, nil error) {
+	if len(parts) < 3 {
+		return zrange, ErrorInvalidZRangeCommand
+	}
+	zrange.Key = parts[0]
+	start, stop := parts[1], parts[2]
+
+	q := &zrange.Query
+	q.Count = -1
+	limit := false
+	for i := 3; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "BYSCORE":
+			q.By = ZRangeByScore
+		case "BYLEX":
+			q.By = ZRangeByLex
+		case "REV":
+			q.Rev = true
+		case "WITHSCORES":
+			zrange.WithScores = true
+		case "LIMIT":
+			if i+2 >= len(parts) {
+				return zrange, ErrorInvalidZRangeCommand
+			}
+			offset, err := strconv.Atoi(parts[i+1])
+			if err != nil || offset < 0 {
+				return zrange, ErrorInvalidZRangeCommand
+			}
+			count, err := strconv.Atoi(parts[i+2])
+			if err != nil {
+				return zrange, ErrorInvalidZRangeCommand
+			}
+			q.Offset, q.Count = offset, count
+			limit = true
+			i += 2
+		default:
+			return zrange, ErrorInvalidZRangeCommand
+		}
+	}
+	if (limit && q.By == ZRangeByIndex) || (zrange.WithScores && q.By == ZRangeByLex) {
+		return zrange, ErrorInvalidZRangeCommand
+	}
+
+	// Score and lex ranges are given from max to min with REV
+	if q.Rev && q.By != ZRangeByIndex {
+		start, stop = stop, start
+	}
+
+	ok := true
+	switch q.By {
+	case ZRangeByIndex:
+		var err1, err2 error
+		q.Start, err1 = strconv.Atoi(start)
+		q.Stop, err2 = strconv.Atoi(stop)
+		ok = err1 == nil && err2 == nil
+	case ZRangeByScore:
+		var ok1, ok2 bool
+		q.Score.Min, q.Score.MinExclusive, ok1 = parseScoreBound(start)
+		q.Score.Max, q.Score.MaxExclusive, ok2 = parseScoreBound(stop)
+		ok = ok1 && ok2
+	case ZRangeByLex:
+		var ok1, ok2 bool
+		q.Lex.Min, q.Lex.MinExclusive, q.Lex.MinUnbounded, ok1 = parseLexBound(start, "-")
+		q.Lex.Max, q.Lex.MaxExclusive, q.Lex.MaxUnbounded, ok2 = parseLexBound(stop, "+")
+		ok = ok1 && ok2
+	}
+	if !ok {
+		return zrange, ErrorInvalidZRangeCommand
+	}
+	return
+}
+
+// Parses a score, or an exclusive one after (
+func parseScoreBound(s string) (score float64, exclusive, ok bool) {
+	exclusive = strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	score, ok = parseScore(s)
+	return score, exclusive, ok
+}
+
+// Parses [member, (member for an exclusive bound, or unbounded for the
+// whole side
+func parseLexBound(s, unbounded string) (member string, exclusive, isUnbounded, ok bool) {
+	switch {
+	case s == unbounded:
+		return "", false, true, true
+	case strings.HasPrefix(s, "["):
+		return s[1:], false, false, true
+	case strings.HasPrefix(s, "("):
+		return s[1:], true, false, true
+	}
+	return "", false, false, false
+}
+
+// max is set for ZPOPMAX
+func parseZPopCommand(parts []string, max bool) (zpop ZPop, nil error) {
+	if len(parts) != 1 && len(parts) != 2 {
+		return zpop, ErrorInvalidZPopCommand
+	}
+
+	zpop.Key = parts[0]
+	zpop.Count = 1
+	zpop.Max = max
+	if len(parts) == 2 {
+		count, err := strconv.Atoi(parts[1])
+		if err != nil || count < 0 {
+			return zpop, ErrorInvalidZPopCommand
+		}
+		zpop.Count = count
+	}
+	return
+}
+
+// max is set for BZPOPMAX. The timeout is in seconds, like BQPOP's.
+func parseBZPopCommand(parts []string, max bool) (bzpop BZPop, nil error) {
+	if len(parts) < 2 {
+		return bzpop, ErrorInvalidBZPopCommand
+	}
+
+	bzpop.Keys = parts[:len(parts)-1]
+	bzpop.Max = max
+	timeout, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil || timeout < 0 {
+		return bzpop, ErrorInvalidBZPopCommand
+	}
+	bzpop.Timeout = new(time.Time)
+	*bzpop.Timeout = time.Now().Add(time.Duration(timeout) * time.Second)
+	return
+}
+
+func parsePublishCommand(parts []string) (publish Publish, nil error) {
+	if len(parts) != 2 {
+		return publish, ErrorInvalidPublishCommand
+	}
+
+	publish.Channel = parts[0]
+	publish.Message = parts[1]
+	return
+}
+
+func parseMGetCommand(parts []string) (mget MGet, nil error) {
 	if len(parts) < 1 {
-		return get, ErrorInvalidGetCommand
+		return mget, ErrorInvalidMGetCommand
 	}
 
-	get.Key = parts[0]
+	mget.Keys = parts
 	return
 }
 
-func parseQPopCommand(parts []string) (qpop QPop, nil error) {
+func parseMSetCommand(parts []string, nx bool) (mset MSet, nil error) {
+	if len(parts) < 2 || len(parts)%2 != 0 {
+		return mset, ErrorInvalidMSetCommand
+	}
+
+	for i := 0; i < len(parts); i += 2 {
+		mset.Keys = append(mset.Keys, parts[i])
+		mset.Values = append(mset.Values, parts[i+1])
+	}
+	mset.NX = nx
+	return
+}
+
+func parseDelCommand(parts []string) (del Del, nil error) {
 	if len(parts) < 1 {
-		return qpop, ErrorInvalidQPopCommand
+		return del, ErrorInvalidDelCommand
 	}
 
-	qpop.Key = parts[0]
+	del.Keys = parts
 	return
 }
 
-func parseBQPopCommand(parts []string) (bqpop BQPop, nil error) {
+func parseExistsCommand(parts []string) (exists Exists, nil error) {
 	if len(parts) < 1 {
-		return bqpop, ErrorInvalidBQPopCommand
+		return exists, ErrorInvalidExistsCommand
 	}
 
-	bqpop.Key = parts[0]
-	if len(parts) < 2 {
-		return bqpop, nil
+	exists.Keys = parts
+	return
+}
+
+func parseTTLCommand(parts []string, milliseconds bool) (ttl TTL, nil error) {
+	if len(parts) != 1 {
+		return ttl, ErrorInvalidTTLCommand
 	}
 
-	timeout, err := strconv.Atoi(parts[1])
-	if err != nil || timeout < 0 {
-		return bqpop, ErrorInvalidBQPopCommand
+	ttl.Key = parts[0]
+	ttl.Milliseconds = milliseconds
+	return
+}
+
+// The amount is in unit, either relative to now or since the unix epoch
+func parseExpireCommand(parts []string, unit time.Duration, absolute bool) (expire Expire, nil error) {
+	if len(parts) != 2 {
+		return expire, ErrorInvalidExpireCommand
 	}
-	bqpop.Timeout = new(time.Time)
-	*bqpop.Timeout = time.Now().Add(time.Duration(timeout) * time.Second)
 
+	amount, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return expire, ErrorInvalidExpireCommand
+	}
+
+	// Keeps the conversion to a duration from overflowing
+	limit := int64(math.MaxInt64 / unit)
+	if amount > limit || amount < -limit {
+		return expire, ErrorInvalidExpireCommand
+	}
+
+	expire.Key = parts[0]
+	if absolute {
+		expire.At = time.Unix(0, 0).Add(time.Duration(amount) * unit)
+	} else {
+		expire.At = time.Now().Add(time.Duration(amount) * unit)
+	}
+	return
+}
+
+func parsePersistCommand(parts []string) (persist Persist, nil error) {
+	if len(parts) != 1 {
+		return persist, ErrorInvalidPersistCommand
+	}
+
+	persist.Key = parts[0]
+	return
+}
+
+func parseTypeCommand(parts []string) (typ Type, nil error) {
+	if len(parts) != 1 {
+		return typ, ErrorInvalidTypeCommand
+	}
+
+	typ.Key = parts[0]
+	return
+}
+
+func parseIncrCommand(parts []string, delta int64) (incr IncrBy, nil error) {
+	if len(parts) != 1 {
+		return incr, ErrorInvalidIncrCommand
+	}
+
+	incr.Key = parts[0]
+	incr.Delta = delta
+	return
+}
+
+// sign is -1 for DECRBY
+func parseIncrByCommand(parts []string, sign int64) (incr IncrBy, nil error) {
+	if len(parts) != 2 {
+		return incr, ErrorInvalidIncrCommand
+	}
+
+	delta, err := strconv.ParseInt(parts[1], 10, 64)
+	// The negation of the smallest int64 doesn't fit in an int64
+	if err != nil || (sign < 0 && delta == math.MinInt64) {
+		return incr, ErrorInvalidIncrCommand
+	}
+
+	incr.Key = parts[0]
+	incr.Delta = sign * delta
+	return
+}
+
+func parseIncrByFloatCommand(parts []string) (incr IncrByFloat, nil error) {
+	if len(parts) != 2 {
+		return incr, ErrorInvalidIncrByFloatCommand
+	}
+
+	delta, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return incr, ErrorInvalidIncrByFloatCommand
+	}
+
+	incr.Key = parts[0]
+	incr.Delta = delta
+	return
+}
+
+func parseBGRewriteAOFCommand(parts []string) (bgRewrite BGRewriteAOF, nil error) {
+	if len(parts) != 0 {
+		return bgRewrite, ErrorInvalidBGRewriteAOFCommand
+	}
+	return
+}
+
+func parseSaveCommand(parts []string, background bool) (save Save, nil error) {
+	if len(parts) != 0 {
+		return save, ErrorInvalidSaveCommand
+	}
+
+	save.Background = background
 	return
 }
 
@@ -139,32 +1928,56 @@ func parseSetCommand(parts []string) (set Set, nil error) {
 		return
 	}
 
+	hasExpiry := false
 	parts = parts[2:]
 	for len(parts) > 0 {
-		cmd := parts[0]
+		cmd := strings.ToUpper(parts[0])
 
 		switch cmd {
-		case "EX":
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpiry {
+				return set, ErrorSetExpiryConflict
+			}
+			hasExpiry = true
+
 			if len(parts) < 2 {
 				return set, ErrorInvalidSetCommand
 			}
-			expiry, err := strconv.Atoi(parts[1])
-			if err != nil || expiry < 0 {
-				return set, ErrorInvalidSetCommand
+			expiry, err := parseSetExpiry(cmd, parts[1])
+			if err != nil {
+				return set, err
 			}
 
-			set.Expiry = new(time.Time)
-			*set.Expiry = time.Now().Add(time.Duration(expiry) * time.Second)
+			set.Expiry = expiry
 			parts = parts[2:]
 
+		case "KEEPTTL":
+			if hasExpiry {
+				return set, ErrorSetExpiryConflict
+			}
+			hasExpiry = true
+
+			set.KeepTTL = true
+			parts = parts[1:]
+
 		case "XX":
+			if set.NX {
+				return set, ErrorSetConditionConflict
+			}
 			set.XX = true
 			parts = parts[1:]
 
 		case "NX":
+			if set.XX {
+				return set, ErrorSetConditionConflict
+			}
 			set.NX = true
 			parts = parts[1:]
 
+		case "GET":
+			set.Get = true
+			parts = parts[1:]
+
 		default:
 			return set, ErrorInvalidSetCommand
 		}
@@ -172,3 +1985,27 @@ func parseSetCommand(parts []string) (set Set, nil error) {
 
 	return set, nil
 }
+
+// EX and PX are relative to now, EXAT and PXAT are unix timestamps
+func parseSetExpiry(option, amount string) (*time.Time, error) {
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil || n < 0 {
+		return nil, ErrorInvalidSetCommand
+	}
+
+	unit := time.Second
+	if option == "PX" || option == "PXAT" {
+		unit = time.Millisecond
+	}
+	if n > int64(math.MaxInt64/unit) {
+		return nil, ErrorInvalidSetCommand
+	}
+
+	expiry := new(time.Time)
+	if option == "EXAT" || option == "PXAT" {
+		*expiry = time.Unix(0, 0).Add(time.Duration(n) * unit)
+	} else {
+		*expiry = time.Now().Add(time.Duration(n) * unit)
+	}
+	return expiry, nil
+}
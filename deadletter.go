@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+var ErrorNoDeadLetterQueue = errors.New("no dead letter queue configured")
+
+// Values of a queue leased maxDeliveries times without being acknowledged
+// are pushed to the queue at key instead of going back
+type deadLetterConfig struct {
+	key           string
+	maxDeliveries int
+}
+
+// QSetDeadLetter configures the dead letter queue of key, zero maxDeliveries
+// removes it. Fails with ErrorWrongType if deadLetterKey holds another type.
+func (s *Storage) QSetDeadLetter(key, deadLetterKey string, maxDeliveries int) error {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	if maxDeliveries > 0 {
+		if _, err := s.queueLocked(deadLetterKey); err != nil {
+			return err
+		}
+	}
+	s.setDeadLetterLocked(key, deadLetterKey, maxDeliveries)
+	return nil
+}
+
+// Replays a QSETDLQ log entry or restores one from a snapshot. The dead
+// letter key was checked when it was first set, and may hold another type by
+// now, see requeueLocked.
+func (s *Storage) restoreDeadLetter(key, deadLetterKey string, maxDeliveries int) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	s.setDeadLetterLocked(key, deadLetterKey, maxDeliveries)
+}
+
+// Must be called with kvLock held
+func (s *Storage) setDeadLetterLocked(key, deadLetterKey string, maxDeliveries int) {
+	if maxDeliveries <= 0 {
+		delete(s.deadLetters, key)
+	} else {
+		s.deadLetters[key] = deadLetterConfig{key: deadLetterKey, maxDeliveries: maxDeliveries}
+	}
+	s.log("QSETDLQ", key, deadLetterKey, strconv.Itoa(maxDeliveries))
+}
+
+// QDeadLetters returns up to count values of the dead letter queue of key,
+// in the order they would be popped, without removing them
+func (s *Storage) QDeadLetters(key string, count int) ([]string, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	c, found := s.deadLetters[key]
+	if !found {
+		return nil, ErrorNoDeadLetterQueue
+	}
+
+	queue, err := s.queueLocked(c.key)
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	if queue != nil {
+		for node := queue.head; node != nil && len(values) < count; node = node.next {
+			values = append(values, node.value)
+		}
+	}
+	return values, nil
+}
+
+// QRedrive moves up to count values from the dead letter queue of key back
+// onto key, with their delivery counts reset. Returns how many were moved.
+func (s *Storage) QRedrive(key string, count int) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	c, found := s.deadLetters[key]
+	if !found {
+		return 0, ErrorNoDeadLetterQueue
+	}
+
+	dlq, err := s.queueLocked(c.key)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.queueLocked(key); err != nil {
+		return 0, err
+	}
+	if dlq == nil || dlq.head == nil || count <= 0 {
+		return 0, nil
+	}
+
+	moved := 0
+	for ; moved < count && dlq.head != nil; moved++ {
+		node := dlq.pop()
+		node.deliveries = 0
+		s.pushLocked(key, node, node)
+	}
+	s.log("QREDRIVE", key, strconv.Itoa(moved))
+
+	s.admitLocked(c.key, dlq)
+	s.removeIfEmptyLocked(c.key, dlq)
+	return moved, nil
+}
+
+// Replays a QDELIVERIES log entry, written by rewrites right after the
+// queue's values. The counts are in the order the values are popped.
+func (s *Storage) setDeliveries(key string, deliveries []int) error {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	queue, _ := s.queueLocked(key)
+	if queue == nil {
+		return ErrorInvalidLogEntry
+	}
+
+	i := 0
+	for node := queue.head; node != nil; node = node.next {
+		if i == len(deliveries) {
+			return ErrorInvalidLogEntry
+		}
+		node.deliveries = deliveries[i]
+		i++
+	}
+	if i != len(deliveries) {
+		return ErrorInvalidLogEntry
+	}
+	return nil
+}
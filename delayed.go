@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/heap"
+	"strconv"
+	"time"
+)
+
+// Values pushed with QPushAt, invisible to pops until at
+type delayedPush struct {
+	key      string
+	values   []string
+	priority int
+	at       time.Time
+
+	seq   uint64 // Keeps pushes due at the same time in order
+	index int    // In the delayed heap
+}
+
+type delayedHeap []*delayedPush
+
+func (h delayedHeap) Len() int { return len(h) }
+
+func (h delayedHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h delayedHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *delayedHeap) Push(x any) {
+	d := x.(*delayedPush)
+	d.index = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *delayedHeap) Pop() any {
+	old := *h
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return d
+}
+
+// QPushAt is QPushPriority once at is reached, waking blocked consumers
+// then. Times in the past push right away. Only those can fail with
+// ErrorQueueFull, due values always go in, unless the key holds another type
+// by then.
+func (s *Storage) QPushAt(key string, values []string, priority int, at time.Time) error {
+	if len(values) <= 0 {
+		return nil
+	}
+
+	// The log has millisecond precision
+	at = time.UnixMilli(at.UnixMilli())
+	if !at.After(time.Now()) {
+		return s.QPushPriority(key, values, priority)
+	}
+
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	if _, err := s.queueLocked(key); err != nil {
+		return err
+	}
+	s.delayLocked(key, values, priority, at)
+	s.log(delayedLogEntry(key, values, priority, at)...)
+	return nil
+}
+
+func delayedLogEntry(key string, values []string, priority int, at time.Time) []string {
+	entry := []string{"QPUSHAT", key, strconv.FormatInt(at.UnixMilli(), 10), strconv.Itoa(priority)}
+	return append(entry, values...)
+}
+
+// Must be called with kvLock held
+func (s *Storage) delayLocked(key string, values []string, priority int, at time.Time) {
+	s.delayedSeq++
+	heap.Push(&s.delayed, &delayedPush{
+		key:      key,
+		values:   values,
+		priority: priority,
+		at:       at,
+		seq:      s.delayedSeq,
+	})
+}
+
+// Pushes everything due by now, in the order it is due. Nothing is promoted
+// by the clock while the log is replayed, the log says when it happened.
+// Must be called with kvLock held.
+func (s *Storage) promoteLocked(now time.Time) {
+	if s.loading.Load() {
+		return
+	}
+	s.promoteDueLocked(now)
+}
+
+// Must be called with kvLock held
+func (s *Storage) promoteDueLocked(now time.Time) {
+	if len(s.delayed) == 0 || s.delayed[0].at.After(now) {
+		return
+	}
+
+	s.log("QPROMOTE", strconv.FormatInt(now.UnixMilli(), 10))
+	for len(s.delayed) > 0 && !s.delayed[0].at.After(now) {
+		d := heap.Pop(&s.delayed).(*delayedPush)
+		first, last := newQueueNodes(d.values, d.priority)
+		s.pushLocked(d.key, first, last)
+	}
+}
+
+// Replays a QPROMOTE log entry
+func (s *Storage) promoteAt(at time.Time) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	s.promoteDueLocked(at)
+}
+
+// Replays a QPUSHAT log entry, or restores a delayed push from a snapshot
+func (s *Storage) restoreDelayed(key string, values []string, priority int, at time.Time) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	s.delayLocked(key, values, priority, at)
+}
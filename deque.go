@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// QPushFront pushes values where the next pop takes them from, one after
+// another, so the last one is popped first. They only go before the values
+// of the default priority, see QPushPriority.
+func (s *Storage) QPushFront(key string, value []string) error {
+	return s.push(key, value, 0, true, nil)
+}
+
+// QPopBack pops the value that would be popped last
+func (s *Storage) QPopBack(key string) (string, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	s.promoteLocked(time.Now())
+
+	queue, err := s.queueLocked(key)
+	if err != nil {
+		return "", err
+	}
+	if queue == nil || queue.head == nil {
+		return "", ErrorEmptyQueue
+	}
+
+	node := queue.popBack()
+	s.log("QPOPBACK", key)
+
+	s.admitLocked(key, queue)
+	s.removeIfEmptyLocked(key, queue)
+	return node.value, nil
+}
+
+// QLen returns the number of values in the queue, leased and delayed values
+// aren't counted
+func (s *Storage) QLen(key string) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	s.promoteLocked(time.Now())
+
+	queue, err := s.queueLocked(key)
+	if queue == nil {
+		return 0, err
+	}
+	return queue.length, nil
+}
+
+// QPeek returns the value the next pop would return, without removing it
+func (s *Storage) QPeek(key string) (string, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	s.promoteLocked(time.Now())
+
+	queue, err := s.queueLocked(key)
+	if err != nil {
+		return "", err
+	}
+	if queue == nil || queue.head == nil {
+		return "", ErrorEmptyQueue
+	}
+	return queue.head.value, nil
+}
+
+// QRange returns the values from start to stop, both included, in the order
+// they would be popped. Negative indexes count from the end, -1 being the
+// value popped last.
+func (s *Storage) QRange(key string, start, stop int) ([]string, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	s.promoteLocked(time.Now())
+
+	values := []string{}
+	queue, err := s.queueLocked(key)
+	if queue == nil {
+		return values, err
+	}
+
+	if start < 0 {
+		start += queue.length
+	}
+	if stop < 0 {
+		stop += queue.length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= queue.length {
+		stop = queue.length - 1
+	}
+	if start > stop {
+		return values, nil
+	}
+
+	// Walks to start from the closer end
+	node := queue.head
+	if start <= queue.length/2 {
+		for i := 0; i < start; i++ {
+			node = node.next
+		}
+	} else {
+		node = queue.tail
+		for i := queue.length - 1; i > start; i-- {
+			node = node.prev
+		}
+	}
+
+	for i := start; i <= stop; i++ {
+		values = append(values, node.value)
+		node = node.next
+	}
+	return values, nil
+}
+
+// QRem removes up to count values equal to value, starting with the next one
+// popped, or the last one popped for a negative count. Zero count removes
+// them all. Returns how many were removed.
+func (s *Storage) QRem(key string, count int, value string) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+	s.promoteLocked(time.Now())
+
+	queue, err := s.queueLocked(key)
+	if queue == nil {
+		return 0, err
+	}
+
+	removed := 0
+	backwards := count < 0
+	if backwards {
+		count = -count
+	}
+
+	node := queue.head
+	if backwards {
+		node = queue.tail
+	}
+	for node != nil && (count == 0 || removed < count) {
+		next := node.next
+		if backwards {
+			next = node.prev
+		}
+		if node.value == value {
+			queue.unlink(node)
+			removed++
+		}
+		node = next
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+	if backwards {
+		count = -count
+	}
+	s.log("QREM", key, strconv.Itoa(count), value)
+
+	s.admitLocked(key, queue)
+	s.removeIfEmptyLocked(key, queue)
+	return removed, nil
+}
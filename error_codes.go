@@ -0,0 +1,61 @@
+package main
+
+import "errors"
+
+// Stable, machine readable error codes for JSON clients
+const (
+	ErrorCodeGeneric        = "ERROR"
+	ErrorCodeSyntax         = "SYNTAX_ERROR"
+	ErrorCodeUnknownCommand = "UNKNOWN_COMMAND"
+	ErrorCodeKeyNotFound    = "KEY_NOT_FOUND"
+	ErrorCodeKeyExists      = "KEY_EXISTS"
+	ErrorCodeWrongType      = "WRONG_TYPE"
+	ErrorCodeQueueEmpty     = "QUEUE_EMPTY"
+	ErrorCodeQueueFull      = "QUEUE_FULL"
+	ErrorCodeNotInteger     = "NOT_INTEGER"
+	ErrorCodeNotFloat       = "NOT_FLOAT"
+	ErrorCodeOverflow       = "OVERFLOW"
+	ErrorCodeDisabled       = "DISABLED"
+	ErrorCodeInProgress     = "IN_PROGRESS"
+	ErrorCodeNoDeadLetter   = "NO_DEAD_LETTER_QUEUE"
+	ErrorCodeStreamID       = "STREAM_ID_TOO_OLD"
+	ErrorCodeStreamFull     = "STREAM_FULL"
+	ErrorCodeNoGroup        = "NO_GROUP"
+	ErrorCodeGroupExists    = "GROUP_EXISTS"
+)
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrorInvalidCommand, ErrorCodeUnknownCommand},
+	{ErrorKeyNotFound, ErrorCodeKeyNotFound},
+	{ErrorKeyExists, ErrorCodeKeyExists},
+	{ErrorWrongType, ErrorCodeWrongType},
+	{ErrorEmptyQueue, ErrorCodeQueueEmpty},
+	{ErrorQueueFull, ErrorCodeQueueFull},
+	{ErrorNotInteger, ErrorCodeNotInteger},
+	{ErrorNotFloat, ErrorCodeNotFloat},
+	{ErrorOverflow, ErrorCodeOverflow},
+	{ErrorNaNOrInfinity, ErrorCodeOverflow},
+	{ErrorScoreNaN, ErrorCodeNotFloat},
+	{ErrorAOFDisabled, ErrorCodeDisabled},
+	{ErrorSnapshotDisabled, ErrorCodeDisabled},
+	{ErrorRewriteInProgress, ErrorCodeInProgress},
+	{ErrorSaveInProgress, ErrorCodeInProgress},
+	{ErrorNoDeadLetterQueue, ErrorCodeNoDeadLetter},
+	{ErrorStreamIDTooOld, ErrorCodeStreamID},
+	{ErrorStreamFull, ErrorCodeStreamFull},
+	{ErrorNoGroup, ErrorCodeNoGroup},
+	{ErrorGroupExists, ErrorCodeGroupExists},
+}
+
+// errorCode returns the code of err, or fallback if it has none
+func errorCode(err error, fallback string) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return fallback
+}
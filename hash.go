@@ -0,0 +1,197 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Returns the hash at key, nil if there is none. Must be called with kvLock
+// held.
+func (s *Storage) hashLocked(key string) (map[string]string, error) {
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		return nil, nil
+	}
+	if v.hash == nil {
+		return nil, ErrorWrongType
+	}
+	return v.hash, nil
+}
+
+// HSet sets the fields of the hash at key from alternating fields and
+// values, creating it if needed. Returns how many fields are new.
+func (s *Storage) HSet(key string, fieldValues []string) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	hash, err := s.hashLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	if hash == nil {
+		hash = make(map[string]string)
+		s.replaceLocked(key, Value{hash: hash})
+	}
+
+	added := 0
+	for i := 0; i+1 < len(fieldValues); i += 2 {
+		if _, found := hash[fieldValues[i]]; !found {
+			added++
+		}
+		hash[fieldValues[i]] = fieldValues[i+1]
+	}
+	s.log(append([]string{"HSET", key}, fieldValues...)...)
+	return added, nil
+}
+
+// HGet fails with ErrorKeyNotFound if either the key or the field is missing
+func (s *Storage) HGet(key, field string) (string, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	hash, err := s.hashLocked(key)
+	if err != nil {
+		return "", err
+	}
+	value, found := hash[field]
+	if !found {
+		return "", ErrorKeyNotFound
+	}
+	return value, nil
+}
+
+// HMGet returns the value of every field, found is false for missing fields
+func (s *Storage) HMGet(key string, fields ...string) (values []string, found []bool, err error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	hash, err := s.hashLocked(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values = make([]string, len(fields))
+	found = make([]bool, len(fields))
+	for i, field := range fields {
+		values[i], found[i] = hash[field]
+	}
+	return values, found, nil
+}
+
+// HDel removes the fields and returns how many of them existed. The key is
+// removed with its last field.
+func (s *Storage) HDel(key string, fields ...string) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	hash, err := s.hashLocked(key)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := []string{"HDEL", key}
+	for _, field := range fields {
+		if _, found := hash[field]; found {
+			delete(hash, field)
+			entry = append(entry, field)
+		}
+	}
+	if len(entry) == 2 {
+		return 0, nil
+	}
+
+	if len(hash) == 0 {
+		delete(s.KV, key)
+	}
+	s.log(entry...)
+	return len(entry) - 2, nil
+}
+
+func (s *Storage) HExists(key, field string) (bool, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	hash, err := s.hashLocked(key)
+	if err != nil {
+		return false, err
+	}
+	_, found := hash[field]
+	return found, nil
+}
+
+func (s *Storage) HLen(key string) (int, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	hash, err := s.hashLocked(key)
+	return len(hash), err
+}
+
+// HGetAll returns alternating fields and values, ordered by field
+func (s *Storage) HGetAll(key string) ([]string, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	hash, err := s.hashLocked(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldValues := make([]string, 0, 2*len(hash))
+	for _, field := range sortedFields(hash) {
+		fieldValues = append(fieldValues, field, hash[field])
+	}
+	return fieldValues, nil
+}
+
+func sortedFields(hash map[string]string) []string {
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// HIncrBy adds delta to the integer stored in the field, a missing field
+// counts as 0
+func (s *Storage) HIncrBy(key, field string, delta int64) (int64, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	hash, err := s.hashLocked(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if value, found := hash[field]; found {
+		n, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, ErrorNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrorOverflow
+	}
+
+	if hash == nil {
+		hash = make(map[string]string)
+		s.replaceLocked(key, Value{hash: hash})
+	}
+	n += delta
+	hash[field] = strconv.FormatInt(n, 10)
+	// Logged as the result, like IncrBy
+	s.log("HSET", key, field, hash[field])
+	return n, nil
+}
+
+// Every field as one HSET, expiry is logged on its own
+func hashLogEntry(key string, hash map[string]string) []string {
+	entry := []string{"HSET", key}
+	for _, field := range sortedFields(hash) {
+		entry = append(entry, field, hash[field])
+	}
+	return entry
+}
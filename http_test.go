@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -74,4 +77,173 @@ func TestHttp(t *testing.T) {
 	if resp.Error != "queue is empty" {
 		t.Fatalf("Expected error in response got %+v", resp)
 	}
+
+	req.Command = "TYPE hello"
+	processJson()
+	if resp.Error != "" || resp.Value != "string" {
+		t.Fatalf("Expected string in response got %+v", resp)
+	}
+
+	req.Command = "TYPE list_a"
+	processJson()
+	if resp.Error != "" || resp.Value != "none" {
+		t.Fatalf("Expected none in response got %+v", resp)
+	}
+}
+
+func TestHttpArrays(t *testing.T) {
+	storage = NewStorage()
+
+	send := func(command string) (resp struct {
+		Value any    `json:"value"`
+		Error string `json:"error"`
+	}) {
+		var buffer bytes.Buffer
+		json.NewEncoder(&buffer).Encode(map[string]string{"command": command})
+
+		w := httptest.NewRecorder()
+		HandleCommand(w, httptest.NewRequest("GET", "/", &buffer))
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return
+	}
+
+	if resp := send("MSET a 1 b 2"); resp.Error != "" || resp.Value != nil {
+		t.Fatalf("Expected empty response got %+v", resp)
+	}
+
+	resp := send("MGET a missing b")
+	values, ok := resp.Value.([]any)
+	if !ok || len(values) != 3 || values[0] != "1" || values[1] != nil || values[2] != "2" {
+		t.Fatalf("Expected [1 null 2] got %+v", resp)
+	}
+
+	if resp := send("MSETNX a 3 c 4"); resp.Value != "0" {
+		t.Fatalf("Expected 0 got %+v", resp)
+	}
+
+	// A leased value comes with its receipt
+	send("QPUSH jobs j")
+	resp = send("QPOP jobs LEASE 30")
+	values, ok = resp.Value.([]any)
+	if !ok || len(values) != 2 || values[0] != "j" {
+		t.Fatalf("Expected [j receipt] got %+v", resp)
+	}
+	if resp := send("QACK jobs " + values[1].(string)); resp.Value != "1" {
+		t.Fatalf("Expected 1 got %+v", resp)
+	}
+}
+
+func TestHttpTyped(t *testing.T) {
+	storage = NewStorage()
+
+	send := func(command string) (int, string) {
+		var buffer bytes.Buffer
+		json.NewEncoder(&buffer).Encode(map[string]string{"command": command})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", &buffer)
+		r.Header.Set(APIVersionHeader, "2")
+
+		HandleCommand(w, r)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	testCases := []struct {
+		command string
+		status  int
+		body    string
+	}{
+		{"SET hello world", 200, `{"type":"string","value":"OK"}`},
+		{"SET empty ''", 200, `{"type":"string","value":"OK"}`},
+		{"GET hello", 200, `{"type":"string","value":"world"}`},
+		{"GET empty", 200, `{"type":"string","value":""}`},
+		{"SET hello again GET", 200, `{"type":"string","value":"world"}`},
+		{"SET other value GET", 200, `{"type":"null"}`},
+		{"INCR counter", 200, `{"type":"integer","value":1}`},
+		{"MGET hello missing", 200, `{"type":"array","value":[{"type":"string","value":"again"},{"type":"null"}]}`},
+		{"GET missing", 400, `{"type":"error","error":{"code":"KEY_NOT_FOUND","message":"key not found"}}`},
+		{"QPOP queue", 400, `{"type":"error","error":{"code":"QUEUE_EMPTY","message":"queue is empty"}}`},
+		{"INCR hello", 400, `{"type":"error","error":{"code":"NOT_INTEGER","message":"value is not an integer or out of range"}}`},
+		{"FOO bar", 400, `{"type":"error","error":{"code":"UNKNOWN_COMMAND","message":"invalid command"}}`},
+		{"GET", 400, `{"type":"error","error":{"code":"SYNTAX_ERROR","message":"invalid get command"}}`},
+		{"HSET user name ann age 30", 200, `{"type":"integer","value":2}`},
+		{"HGETALL user", 200, `{"type":"map","value":{"age":{"type":"string","value":"30"},"name":{"type":"string","value":"ann"}}}`},
+		{"GET user", 400, `{"type":"error","error":{"code":"WRONG_TYPE","message":"operation against a key holding the wrong kind of value"}}`},
+		{"HGET hello name", 400, `{"type":"error","error":{"code":"WRONG_TYPE","message":"operation against a key holding the wrong kind of value"}}`},
+		{"ZADD board 10 bob 2.5 ann", 200, `{"type":"integer","value":2}`},
+		{"ZRANGE board 0 -1 WITHSCORES", 200, `{"type":"array","value":[{"type":"string","value":"ann"},{"type":"string","value":"2.5"},{"type":"string","value":"bob"},{"type":"string","value":"10"}]}`},
+		{"ZADD board INCR -inf ann", 200, `{"type":"string","value":"-inf"}`},
+		{"ZREVRANK board ann", 200, `{"type":"integer","value":1}`},
+		{"ZADD board XX INCR 1 carl", 200, `{"type":"null"}`},
+		{"ZADD board INCR inf ann", 400, `{"type":"error","error":{"code":"NOT_FLOAT","message":"resulting score is not a number"}}`},
+		{"QPUSH jobs a", 200, `{"type":"string","value":"OK"}`},
+		{"TYPE jobs", 200, `{"type":"string","value":"queue"}`},
+		{"TYPE board", 200, `{"type":"string","value":"zset"}`},
+		{"TYPE missing", 200, `{"type":"string","value":"none"}`},
+		{"QPUSH hello a", 400, `{"type":"error","error":{"code":"WRONG_TYPE","message":"operation against a key holding the wrong kind of value"}}`},
+		{"GET jobs", 400, `{"type":"error","error":{"code":"WRONG_TYPE","message":"operation against a key holding the wrong kind of value"}}`},
+	}
+
+	for idx, tc := range testCases {
+		status, body := send(tc.command)
+		if status != tc.status || body != tc.body {
+			t.Errorf("%d: %s: Expected %d %s, got %d %s", idx, tc.command, tc.status, tc.body, status, body)
+		}
+	}
+}
+
+func TestHttpSubscribe(t *testing.T) {
+	storage = NewStorage()
+
+	server := httptest.NewServer(http.HandlerFunc(HandleSubscribe))
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a bad request without channels, got %+v %+v", resp, err)
+	}
+
+	resp, err := http.Get(server.URL + "/subscribe?channel=news&pattern=n*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", ct)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	for _, expected := range []string{
+		"event: subscribe\ndata: {\"channel\":\"news\",\"count\":1}\n",
+		"event: psubscribe\ndata: {\"count\":2,\"pattern\":\"n*\"}\n",
+	} {
+		if event := readEvent(); event != expected {
+			t.Fatalf("Expected %q, got %q", expected, event)
+		}
+	}
+
+	if n := storage.Publish("news", "hello"); n != 2 {
+		t.Fatalf("Expected 2 receivers, got %d", n)
+	}
+	for _, expected := range []string{
+		"event: message\ndata: {\"channel\":\"news\",\"message\":\"hello\"}\n",
+		"event: message\ndata: {\"pattern\":\"n*\",\"channel\":\"news\",\"message\":\"hello\"}\n",
+	} {
+		if event := readEvent(); event != expected {
+			t.Fatalf("Expected %q, got %q", expected, event)
+		}
+	}
 }
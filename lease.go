@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// How often expired leases are put back on their queue and delayed pushes
+// are promoted
+const queueTimerInterval = 100 * time.Millisecond
+
+// A value handed out by a reliable pop, waiting to be acknowledged
+type queueLease struct {
+	key      string
+	receipt  string
+	deadline time.Time
+
+	// Out of the queue, its deliveries include this one
+	node *QueueNode
+
+	index int // In the reaper heap
+}
+
+// leaseHeap orders leases by deadline, so the reaper only looks at expired ones
+type leaseHeap []*queueLease
+
+func (h leaseHeap) Len() int           { return len(h) }
+func (h leaseHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h leaseHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *leaseHeap) Push(x any) {
+	l := x.(*queueLease)
+	l.index = len(*h)
+	*h = append(*h, l)
+}
+
+func (h *leaseHeap) Pop() any {
+	old := *h
+	l := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return l
+}
+
+func newReceipt() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Must be called with kvLock held
+func (s *Storage) leaseLocked(key string, node *QueueNode, receipt string, deadline time.Time) *queueLease {
+	l := &queueLease{
+		key:      key,
+		receipt:  receipt,
+		deadline: deadline,
+		node:     node,
+	}
+	s.leases[receipt] = l
+	heap.Push(&s.leaseHeap, l)
+	return l
+}
+
+// Must be called with kvLock held
+func (s *Storage) releaseLocked(l *queueLease) {
+	delete(s.leases, l.receipt)
+	heap.Remove(&s.leaseHeap, l.index)
+}
+
+// QAck deletes a leased value for good.
+// Returns false if the lease doesn't exist or already ran out.
+func (s *Storage) QAck(key, receipt string) bool {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	l, found := s.leases[receipt]
+	if !found || l.key != key {
+		return false
+	}
+
+	s.releaseLocked(l)
+	s.log("QACK", key, receipt)
+	return true
+}
+
+// QNack gives a leased value back before its lease runs out, it is the next
+// one to be popped unless it goes to the dead letter queue. Returns false if the lease doesn't exist or already ran out.
+func (s *Storage) QNack(key, receipt string) bool {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	l, found := s.leases[receipt]
+	if !found || l.key != key {
+		return false
+	}
+
+	s.requeueLocked(l)
+	return true
+}
+
+// Must be called with kvLock held
+func (s *Storage) requeueLocked(l *queueLease) {
+	s.releaseLocked(l)
+	s.log("QNACK", l.key, l.receipt)
+
+	// Kept on its queue if the dead letter key holds another type by now
+	if c, found := s.deadLetters[l.key]; found && l.node.deliveries >= c.maxDeliveries {
+		if s.pushLocked(c.key, l.node, l.node) == nil {
+			return
+		}
+	}
+	s.pushFrontLocked(l.key, l.node)
+}
+
+// Replays a QLEASE log entry, the receipt and deadline are the ones handed out
+func (s *Storage) popLeased(key, receipt string, deadline time.Time) error {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	queue, _ := s.queueLocked(key)
+	if queue == nil || queue.head == nil {
+		return ErrorEmptyQueue
+	}
+
+	node := queue.pop()
+	s.removeIfEmptyLocked(key, queue)
+	node.deliveries++
+	s.leaseLocked(key, node, receipt, deadline)
+	return nil
+}
+
+// Restores a lease from a rewritten log or a snapshot
+func (s *Storage) restoreLease(key, value string, priority, deliveries int, receipt string, deadline time.Time) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	node := &QueueNode{value: value, priority: priority, deliveries: deliveries}
+	s.leaseLocked(key, node, receipt, deadline)
+}
+
+func (s *Storage) runQueueTimers() {
+	ticker := time.NewTicker(queueTimerInterval)
+
+	for {
+		<-ticker.C
+		now := time.Now()
+		s.reapLeases(now)
+
+		s.kvLock.Lock()
+		s.promoteLocked(now)
+		s.kvLock.Unlock()
+	}
+}
+
+// Puts every lease that ran out by now back at the head of its queue. The
+// log has every expiry in it, so nothing runs out while it is replayed.
+func (s *Storage) reapLeases(now time.Time) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	if s.loading.Load() {
+		return
+	}
+
+	for len(s.leaseHeap) > 0 && !s.leaseHeap[0].deadline.After(now) {
+		s.requeueLocked(s.leaseHeap[0])
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 )
@@ -14,12 +16,44 @@ import (
 var storage *Storage
 
 func main() {
+	httpAddr := flag.String("http", ":8080", "address of the JSON over HTTP endpoint")
+	respAddr := flag.String("resp", ":6379", "address of the Redis protocol listener, empty to disable")
+	appendOnly := flag.Bool("appendonly", false, "log every mutation and replay the log on startup")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "path of the append only file")
+	appendFsync := flag.String("appendfsync", "everysec", "when to fsync the append only file: always, everysec or no")
+	dbFilename := flag.String("dbfilename", "dump.bia", "path of the snapshot written by SAVE and loaded on startup, empty to disable")
+	flag.IntVar(&subscriberBuffer, "subscriberbuffer", subscriberBuffer, "messages buffered for a subscriber before it is disconnected")
+	flag.Parse()
+
+	if subscriberBuffer < 1 {
+		log.Fatal("subscriberbuffer must be at least 1")
+	}
+
 	storage = NewStorage()
 
+	var fsync FsyncPolicy
+	if *appendOnly {
+		var err error
+		fsync, err = ParseFsyncPolicy(*appendFsync)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := loadStorage(storage, *dbFilename, *appendOnly, *appendFilename, fsync); err != nil {
+		log.Fatal(err)
+	}
+
+	if *respAddr != "" {
+		go func() {
+			log.Fatal(ListenRESP(*respAddr))
+		}()
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", HandleCommand)
+	mux.HandleFunc("/subscribe", HandleSubscribe)
 	server := http.Server{
-		Addr:         ":8080",
+		Addr:         *httpAddr,
 		Handler:      mux,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
@@ -28,6 +62,37 @@ func main() {
 	server.ListenAndServe()
 }
 
+// The append only file has every write, so the snapshot is only loaded when
+// there is no log yet. The log then starts out with the snapshot contents.
+func loadStorage(s *Storage, snapshotPath string, appendOnly bool, aofPath string, fsync FsyncPolicy) error {
+	if appendOnly {
+		if _, err := os.Stat(aofPath); err == nil {
+			s.EnableSnapshots(snapshotPath)
+			return s.EnableAOF(aofPath, fsync)
+		}
+	}
+
+	if snapshotPath != "" {
+		err := s.LoadSnapshot(snapshotPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.EnableSnapshots(snapshotPath)
+	}
+
+	if appendOnly {
+		if err := s.EnableAOF(aofPath, fsync); err != nil {
+			return err
+		}
+		return s.RewriteAOF()
+	}
+	return nil
+}
+
+// Clients sending 2 get typed responses, the others the original
+// {value, error} ones
+const APIVersionHeader = "X-API-Version"
+
 func HandleCommand(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Command string `json:"command"`
@@ -40,32 +105,49 @@ func HandleCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var resp struct {
-		Value string `json:"value,omitempty"`
-		Error string `json:"error,omitempty"`
-	}
+	legacy := r.Header.Get(APIVersionHeader) != "2"
 
 	command, err := ParseCommand(req.Command)
 	if err != nil {
-		resp.Error = err.Error()
-		sendResponseJson(w, http.StatusBadRequest, resp)
+		sendCommandResponse(w, legacy, nil, err, ErrorCodeSyntax)
 		return
 	}
 
 	value, err := processCommand(command)
+	sendCommandResponse(w, legacy, value, err, ErrorCodeGeneric)
+}
+
+// fallbackCode is used for errors without a code of their own
+func sendCommandResponse(w http.ResponseWriter, legacy bool, value Reply, err error, fallbackCode string) {
+	status := http.StatusOK
 	if err != nil {
-		resp.Error = err.Error()
-		sendResponseJson(w, http.StatusBadRequest, resp)
+		status = http.StatusBadRequest
+	}
+
+	if legacy {
+		var resp struct {
+			Value any    `json:"value,omitempty"`
+			Error string `json:"error,omitempty"`
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Value = replyValue(value)
+		}
+		sendResponseJson(w, status, resp)
 		return
 	}
 
-	resp.Value = value
-	sendResponseJson(w, http.StatusOK, resp)
+	if err != nil {
+		sendResponseJson(w, status, errorResponse(err, fallbackCode))
+		return
+	}
+	sendResponseJson(w, status, typedReply(value))
 }
 
 func sendResponseJson(w http.ResponseWriter, status int, r any) {
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(r)
 }
 
@@ -103,31 +185,530 @@ func jsonParsingError(w http.ResponseWriter, r *http.Request, err error) {
 	}
 }
 
-func processCommand(c Command) (str string, err error) {
+func processCommand(c Command) (Reply, error) {
 	switch c := c.(type) {
 	case Set:
-		if c.XX {
-			err = storage.SetIfExists(c.Key, c.Value, c.Expiry)
-		} else if c.NX {
-			err = storage.SetIfDoesntExists(c.Key, c.Value, c.Expiry)
-		} else {
-			storage.Set(c.Key, c.Value, c.Expiry)
+		old, found, err := storage.SetWithOptions(c.Key, c.Value, c.Expiry, SetOptions{
+			XX:      c.XX,
+			NX:      c.NX,
+			KeepTTL: c.KeepTTL,
+			Get:     c.Get,
+		})
+		if c.Get {
+			// A failed condition isn't an error when asking for the previous value
+			if err != nil && err != ErrorKeyNotFound && err != ErrorKeyExists {
+				return nil, err
+			}
+			if !found {
+				return nil, nil
+			}
+			return old, nil
 		}
-		return
+		if err != nil {
+			return nil, err
+		}
+		return StatusOK, nil
 
 	case Get:
-		return storage.Get(c.Key)
+		return stringReply(storage.Get(c.Key))
+
+	case MGet:
+		values, found := storage.MGet(c.Keys...)
+		reply := make([]Reply, len(values))
+		for i := range values {
+			if found[i] {
+				reply[i] = values[i]
+			}
+		}
+		return reply, nil
+
+	case MSet:
+		ok := storage.MSet(c.Keys, c.Values, c.NX)
+		if c.NX {
+			return boolReply(ok), nil
+		}
+		return StatusOK, nil
+
+	case IncrBy:
+		n, err := storage.IncrBy(c.Key, c.Delta)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+
+	case IncrByFloat:
+		return stringReply(storage.IncrByFloat(c.Key, c.Delta))
+
+	case Del:
+		return storage.Del(c.Keys...), nil
+
+	case Exists:
+		return storage.Exists(c.Keys...), nil
+
+	case TTL:
+		expiry, err := storage.Expiry(c.Key)
+		switch {
+		case err == ErrorKeyNotFound:
+			return int64(-2), nil
+		case err != nil:
+			return nil, err
+		case expiry == nil:
+			return int64(-1), nil
+		}
+
+		remaining := time.Until(*expiry)
+		if c.Milliseconds {
+			return remaining.Milliseconds(), nil
+		}
+		return int64(remaining.Round(time.Second) / time.Second), nil
+
+	case Expire:
+		return boolReply(storage.Expire(c.Key, c.At)), nil
+
+	case Persist:
+		return boolReply(storage.Persist(c.Key)), nil
+
+	case Type:
+		return Status(storage.Type(c.Key)), nil
 
 	case QPush:
-		storage.QPush(c.Key, c.Value)
-		return
+		var err error
+		if c.At != nil {
+			err = storage.QPushAt(c.Key, c.Value, c.Priority, *c.At)
+		} else {
+			err = storage.QPushPriority(c.Key, c.Value, c.Priority)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return StatusOK, nil
+
+	case BQPush:
+		if err := storage.QPushTimeout(c.Key, c.Value, c.Priority, c.Timeout); err != nil {
+			return nil, err
+		}
+		return StatusOK, nil
+
+	case QPushFront:
+		if err := storage.QPushFront(c.Key, c.Value); err != nil {
+			return nil, err
+		}
+		return StatusOK, nil
+
+	case QPopBack:
+		return stringReply(storage.QPopBack(c.Key))
+
+	case QLen:
+		return intReply(storage.QLen(c.Key))
+
+	case QPeek:
+		return stringReply(storage.QPeek(c.Key))
+
+	case QRange:
+		return membersReply(storage.QRange(c.Key, c.Start, c.Stop))
+
+	case QRem:
+		return intReply(storage.QRem(c.Key, c.Count, c.Value))
 
 	case QPop:
-		return storage.QPop(c.Key)
+		if c.Lease == 0 {
+			return stringReply(storage.QPop(c.Key))
+		}
+		popped, err := storage.QPopAny([]string{c.Key}, nil, c.Lease)
+		if err != nil {
+			return nil, err
+		}
+		return []Reply{popped.Value, popped.Receipt}, nil
 
 	case BQPop:
-		return storage.QPopTimeout(c.Key, c.Timeout)
+		popped, err := storage.QPopAny(c.Keys, c.Timeout, c.Lease)
+		if err != nil {
+			return nil, err
+		}
+		// Waiting on several queues needs to say which one the value came from,
+		// and a leased value needs its receipt
+		reply := []Reply{popped.Value}
+		if len(c.Keys) > 1 {
+			reply = []Reply{popped.Key, popped.Value}
+		}
+		if c.Lease != 0 {
+			reply = append(reply, popped.Receipt)
+		}
+		if len(reply) == 1 {
+			return popped.Value, nil
+		}
+		return reply, nil
+
+	case QMove:
+		return stringReply(storage.QMove(c.Source, c.Destination, c.Timeout))
+
+	case QAck:
+		return boolReply(storage.QAck(c.Key, c.Receipt)), nil
+
+	case QNack:
+		return boolReply(storage.QNack(c.Key, c.Receipt)), nil
+
+	case QSetDLQ:
+		if err := storage.QSetDeadLetter(c.Key, c.DeadLetterKey, c.MaxDeliveries); err != nil {
+			return nil, err
+		}
+		return StatusOK, nil
+
+	case QSetCap:
+		storage.QSetCapacity(c.Key, c.Capacity, c.Policy)
+		return StatusOK, nil
+
+	case QDLQ:
+		values, err := storage.QDeadLetters(c.Key, c.Count)
+		if err != nil {
+			return nil, err
+		}
+		reply := make([]Reply, len(values))
+		for i, v := range values {
+			reply[i] = v
+		}
+		return reply, nil
+
+	case QRedrive:
+		moved, err := storage.QRedrive(c.Key, c.Count)
+		if err != nil {
+			return nil, err
+		}
+		return int64(moved), nil
+
+	case XAdd:
+		id, err := storage.XAdd(c.Key, c.ID, c.Fields)
+		if err != nil {
+			return nil, err
+		}
+		return id.String(), nil
+
+	case XRange:
+		entries, err := storage.XRange(c.Key, c.Start, c.End, c.Count)
+		if err != nil {
+			return nil, err
+		}
+		return entriesReply(entries), nil
+
+	case XLen:
+		return intReply(storage.XLen(c.Key))
+
+	case XGroup:
+		if !c.Create {
+			destroyed, err := storage.XGroupDestroy(c.Key, c.Group)
+			if err != nil {
+				return nil, err
+			}
+			return boolReply(destroyed), nil
+		}
+		if err := storage.XGroupCreate(c.Key, c.Group, c.ID, c.MkStream); err != nil {
+			return nil, err
+		}
+		return StatusOK, nil
+
+	case XReadGroup:
+		read, err := storage.XReadGroup(c.Group, c.Consumer, c.Keys, c.IDs, c.Count, c.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		// Nothing new, same as a timeout
+		if len(read) == 0 {
+			return nil, nil
+		}
+		reply := make([]Reply, len(read))
+		for i, r := range read {
+			reply[i] = []Reply{r.Key, entriesReply(r.Entries)}
+		}
+		return reply, nil
+
+	case XAck:
+		return intReply(storage.XAck(c.Key, c.Group, c.IDs))
+
+	case XClaim:
+		entries, err := storage.XClaim(c.Key, c.Group, c.Consumer, c.MinIdle, c.IDs)
+		if err != nil {
+			return nil, err
+		}
+		return entriesReply(entries), nil
+
+	case XPending:
+		pending, err := storage.XPending(c.Key, c.Group)
+		if err != nil {
+			return nil, err
+		}
+		reply := make([]Reply, len(pending))
+		for i, p := range pending {
+			reply[i] = []Reply{p.ID.String(), p.Consumer, p.Idle.Milliseconds(), int64(p.Deliveries)}
+		}
+		return reply, nil
+
+	case HSet:
+		added, err := storage.HSet(c.Key, c.FieldValues)
+		if err != nil {
+			return nil, err
+		}
+		return int64(added), nil
+
+	case HGet:
+		return stringReply(storage.HGet(c.Key, c.Field))
+
+	case HMGet:
+		values, found, err := storage.HMGet(c.Key, c.Fields...)
+		if err != nil {
+			return nil, err
+		}
+		reply := make([]Reply, len(values))
+		for i := range values {
+			if found[i] {
+				reply[i] = values[i]
+			}
+		}
+		return reply, nil
+
+	case HDel:
+		deleted, err := storage.HDel(c.Key, c.Fields...)
+		if err != nil {
+			return nil, err
+		}
+		return int64(deleted), nil
+
+	case HExists:
+		found, err := storage.HExists(c.Key, c.Field)
+		if err != nil {
+			return nil, err
+		}
+		return boolReply(found), nil
+
+	case HLen:
+		n, err := storage.HLen(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		return int64(n), nil
+
+	case HGetAll:
+		fieldValues, err := storage.HGetAll(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		if c.Fields && c.Values {
+			reply := make(Map, len(fieldValues))
+			for i, v := range fieldValues {
+				reply[i] = v
+			}
+			return reply, nil
+		}
+		// Every other one, starting with the first value for HVALS
+		reply := make([]Reply, 0, len(fieldValues)/2)
+		start := 0
+		if c.Values {
+			start = 1
+		}
+		for i := start; i < len(fieldValues); i += 2 {
+			reply = append(reply, fieldValues[i])
+		}
+		return reply, nil
+
+	case HIncrBy:
+		n, err := storage.HIncrBy(c.Key, c.Field, c.Delta)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+
+	case SAdd:
+		added, err := storage.SAdd(c.Key, c.Members...)
+		if err != nil {
+			return nil, err
+		}
+		return int64(added), nil
+
+	case SRem:
+		removed, err := storage.SRem(c.Key, c.Members...)
+		if err != nil {
+			return nil, err
+		}
+		return int64(removed), nil
+
+	case SIsMember:
+		found, err := storage.SIsMember(c.Key, c.Member)
+		if err != nil {
+			return nil, err
+		}
+		return boolReply(found), nil
+
+	case SMembers:
+		return membersReply(storage.SMembers(c.Key))
+
+	case SCard:
+		n, err := storage.SCard(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		return int64(n), nil
+
+	case SPop:
+		var members []string
+		var err error
+		if c.Peek {
+			members, err = storage.SRandMember(c.Key, c.Count)
+		} else {
+			members, err = storage.SPop(c.Key, c.Count)
+		}
+		if err != nil || c.Array {
+			return membersReply(members, err)
+		}
+		if len(members) == 0 {
+			return nil, nil
+		}
+		return members[0], nil
+
+	case SCombine:
+		if !c.Store {
+			return membersReply(storage.SCombine(c.Op, c.Keys...))
+		}
+		n, err := storage.SCombineStore(c.Op, c.Destination, c.Keys...)
+		if err != nil {
+			return nil, err
+		}
+		return int64(n), nil
+
+	case ZAdd:
+		if c.Incr {
+			score, applied, err := storage.ZIncrBy(c.Key, c.Members[0].Member, c.Members[0].Score, c.Options)
+			if err != nil || !applied {
+				// Ruled out by NX, XX, GT or LT, which Redis answers with a null
+				return nil, err
+			}
+			return formatScore(score), nil
+		}
+		n, err := storage.ZAdd(c.Key, c.Members, c.Options)
+		if err != nil {
+			return nil, err
+		}
+		return int64(n), nil
+
+	case ZRem:
+		removed, err := storage.ZRem(c.Key, c.Members...)
+		if err != nil {
+			return nil, err
+		}
+		return int64(removed), nil
+
+	case ZScore:
+		score, err := storage.ZScore(c.Key, c.Member)
+		if err != nil {
+			return nil, err
+		}
+		return formatScore(score), nil
+
+	case ZRank:
+		rank, err := storage.ZRank(c.Key, c.Member, c.Rev)
+		if err != nil {
+			return nil, err
+		}
+		return int64(rank), nil
+
+	case ZCard:
+		n, err := storage.ZCard(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		return int64(n), nil
+
+	case ZRange:
+		members, err := storage.ZRange(c.Key, c.Query)
+		if err != nil {
+			return nil, err
+		}
+		return scoredReply(members, c.WithScores), nil
+
+	case ZPop:
+		members, err := storage.ZPop(c.Key, c.Count, c.Max)
+		if err != nil {
+			return nil, err
+		}
+		return scoredReply(members, true), nil
+
+	case BZPop:
+		popped, err := storage.BZPop(c.Keys, c.Max, c.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return []Reply{popped.Key, popped.Member, formatScore(popped.Score)}, nil
+
+	case Publish:
+		return int64(storage.Publish(c.Channel, c.Message)), nil
+
+	case BGRewriteAOF:
+		if err := storage.BackgroundRewriteAOF(); err != nil {
+			return nil, err
+		}
+		return Status("Background append only file rewriting started"), nil
+
+	case Save:
+		if c.Background {
+			if err := storage.BackgroundSave(); err != nil {
+				return nil, err
+			}
+			return Status("Background saving started"), nil
+		}
+
+		if err := storage.Save(); err != nil {
+			return nil, err
+		}
+		return StatusOK, nil
+	}
+
+	return nil, nil
+}
+
+// Every entry is its ID and its fields and values
+func entriesReply(entries []StreamEntry) Reply {
+	reply := make([]Reply, len(entries))
+	for i, e := range entries {
+		fields := make([]Reply, len(e.Fields))
+		for j, f := range e.Fields {
+			fields[j] = f
+		}
+		reply[i] = []Reply{e.ID.String(), fields}
+	}
+	return reply
+}
+
+func membersReply(members []string, err error) (Reply, error) {
+	if err != nil {
+		return nil, err
+	}
+	reply := make([]Reply, len(members))
+	for i, m := range members {
+		reply[i] = m
 	}
+	return reply, nil
+}
+
+// Members, each followed by its score with withScores
+func scoredReply(members []ZMember, withScores bool) Reply {
+	reply := make([]Reply, 0, len(members))
+	for _, m := range members {
+		reply = append(reply, m.Member)
+		if withScores {
+			reply = append(reply, formatScore(m.Score))
+		}
+	}
+	return reply
+}
 
-	return
+func intReply(n int, err error) (Reply, error) {
+	if err != nil {
+		return nil, err
+	}
+	return int64(n), nil
+}
+
+func stringReply(s string, err error) (Reply, error) {
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
 }
@@ -0,0 +1,14 @@
+package main
+
+import "time"
+
+// QMove pops the next value of source and pushes it onto destination in one
+// step, so the value is never only in the client's hands. It waits until
+// timeout for a value if source is empty, a nil timeout doesn't wait.
+//
+// The value keeps its priority and delivery count, and goes in even if
+// destination is full: it is bounded by what source lets in.
+func (s *Storage) QMove(source, destination string, timeout *time.Time) (string, error) {
+	popped, err := s.popAny([]string{source}, timeout, &queueWaiter{moveTo: destination})
+	return popped.Value, err
+}
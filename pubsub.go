@@ -0,0 +1,279 @@
+package main
+
+import (
+	"sort"
+)
+
+// Messages buffered for a subscriber before it is disconnected
+var subscriberBuffer = 1024
+
+// A published message as delivered to a subscriber. Pattern is set when it
+// matched a pattern subscription rather than the channel itself.
+type Message struct {
+	Pattern string `json:"pattern,omitempty"`
+	Channel string `json:"channel"`
+	Payload string `json:"message"`
+}
+
+// Subscriber receives the messages published to its channels and patterns.
+// Publishers never wait for a subscriber: one whose buffer is full is
+// disconnected, unsubscribing it from everything and closing Messages.
+type Subscriber struct {
+	messages chan Message
+	// Guarded by pubsubLock
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	closed   bool
+}
+
+// The subscriber count after subscribing to or unsubscribing from Name
+type SubscriptionChange struct {
+	Name  string
+	Count int
+}
+
+func NewSubscriber(buffer int) *Subscriber {
+	return &Subscriber{
+		messages: make(chan Message, buffer),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+// Messages is closed once the subscriber is disconnected, after the messages
+// already buffered
+func (sub *Subscriber) Messages() <-chan Message {
+	return sub.messages
+}
+
+// Must be called with pubsubLock held
+func (sub *Subscriber) countLocked() int {
+	return len(sub.channels) + len(sub.patterns)
+}
+
+func (s *Storage) Subscribe(sub *Subscriber, channels ...string) []SubscriptionChange {
+	return s.subscribe(sub, channels, false)
+}
+
+// PSubscribe subscribes to every channel matching the glob patterns, see
+// globMatch
+func (s *Storage) PSubscribe(sub *Subscriber, patterns ...string) []SubscriptionChange {
+	return s.subscribe(sub, patterns, true)
+}
+
+// Unsubscribe without channels unsubscribes from every channel
+func (s *Storage) Unsubscribe(sub *Subscriber, channels ...string) []SubscriptionChange {
+	return s.unsubscribe(sub, channels, false)
+}
+
+// PUnsubscribe without patterns unsubscribes from every pattern
+func (s *Storage) PUnsubscribe(sub *Subscriber, patterns ...string) []SubscriptionChange {
+	return s.unsubscribe(sub, patterns, true)
+}
+
+func (s *Storage) subscribe(sub *Subscriber, names []string, pattern bool) []SubscriptionChange {
+	s.pubsubLock.Lock()
+	defer s.pubsubLock.Unlock()
+
+	index, own := s.channels, sub.channels
+	if pattern {
+		index, own = s.patterns, sub.patterns
+	}
+
+	changes := make([]SubscriptionChange, 0, len(names))
+	for _, name := range names {
+		// A disconnected subscriber gets nothing more
+		if !sub.closed {
+			if index[name] == nil {
+				index[name] = make(map[*Subscriber]struct{})
+			}
+			index[name][sub] = struct{}{}
+			own[name] = struct{}{}
+		}
+		changes = append(changes, SubscriptionChange{Name: name, Count: sub.countLocked()})
+	}
+	return changes
+}
+
+func (s *Storage) unsubscribe(sub *Subscriber, names []string, pattern bool) []SubscriptionChange {
+	s.pubsubLock.Lock()
+	defer s.pubsubLock.Unlock()
+
+	index, own := s.channels, sub.channels
+	if pattern {
+		index, own = s.patterns, sub.patterns
+	}
+
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	changes := make([]SubscriptionChange, 0, len(names))
+	for _, name := range names {
+		delete(own, name)
+		if subs, found := index[name]; found {
+			delete(subs, sub)
+			if len(subs) == 0 {
+				delete(index, name)
+			}
+		}
+		changes = append(changes, SubscriptionChange{Name: name, Count: sub.countLocked()})
+	}
+	return changes
+}
+
+// CloseSubscriber unsubscribes sub from everything and closes its messages
+func (s *Storage) CloseSubscriber(sub *Subscriber) {
+	s.pubsubLock.Lock()
+	defer s.pubsubLock.Unlock()
+	s.disconnectLocked(sub)
+}
+
+// Must be called with pubsubLock held
+func (s *Storage) disconnectLocked(sub *Subscriber) {
+	if sub.closed {
+		return
+	}
+
+	for name := range sub.channels {
+		delete(s.channels[name], sub)
+		if len(s.channels[name]) == 0 {
+			delete(s.channels, name)
+		}
+	}
+	for name := range sub.patterns {
+		delete(s.patterns[name], sub)
+		if len(s.patterns[name]) == 0 {
+			delete(s.patterns, name)
+		}
+	}
+	sub.channels = make(map[string]struct{})
+	sub.patterns = make(map[string]struct{})
+	sub.closed = true
+	close(sub.messages)
+}
+
+// Publish sends message to the subscribers of channel and of the patterns
+// matching it. Returns the number of deliveries, a subscriber of both the
+// channel and a pattern counts twice.
+func (s *Storage) Publish(channel, message string) int {
+	s.pubsubLock.Lock()
+	defer s.pubsubLock.Unlock()
+
+	receivers := 0
+	for sub := range s.channels[channel] {
+		if s.sendLocked(sub, Message{Channel: channel, Payload: message}) {
+			receivers++
+		}
+	}
+	for pattern, subs := range s.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for sub := range subs {
+			if s.sendLocked(sub, Message{Pattern: pattern, Channel: channel, Payload: message}) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// Disconnects the subscriber instead of waiting when its buffer is full.
+// Must be called with pubsubLock held.
+func (s *Storage) sendLocked(sub *Subscriber, m Message) bool {
+	if sub.closed {
+		return false
+	}
+
+	select {
+	case sub.messages <- m:
+		return true
+	default:
+		s.disconnectLocked(sub)
+		return false
+	}
+}
+
+// globMatch matches s against a Redis style glob pattern: * for any run of
+// characters, ? for any one, [abc], [^abc] and [a-z] for sets, and \ to
+// escape the next character
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	// Where the last star was and the character it has matched up to
+	star, starI := -1, 0
+
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, starI = p, i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if next, ok := globMatchOne(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+		// Let the last star match one more character
+		if star < 0 {
+			return false
+		}
+		starI++
+		p, i = star+1, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Matches c against the pattern element at p, other than a star. Returns
+// where the next element starts.
+func globMatchOne(pattern string, p int, c byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+
+	case '\\':
+		if p+1 < len(pattern) {
+			return p + 2, pattern[p+1] == c
+		}
+
+	case '[':
+		i := p + 1
+		negate := i < len(pattern) && pattern[i] == '^'
+		if negate {
+			i++
+		}
+
+		matched := false
+		for ; i < len(pattern) && pattern[i] != ']'; i++ {
+			switch {
+			case pattern[i] == '\\' && i+1 < len(pattern):
+				i++
+				matched = matched || pattern[i] == c
+			case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+				lo, hi := pattern[i], pattern[i+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				matched = matched || (lo <= c && c <= hi)
+				i += 2
+			default:
+				matched = matched || pattern[i] == c
+			}
+		}
+		// An unterminated set ends with the pattern
+		if i < len(pattern) {
+			i++
+		}
+		return i, matched != negate
+	}
+
+	return p + 1, pattern[p] == c
+}
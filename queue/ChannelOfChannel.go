@@ -2,7 +2,6 @@ package queue
 
 import (
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -11,6 +10,16 @@ type QueueSet struct {
 	QueueRequestInfo
 	Key   string
 	Value []string
+	Resp  chan Resp
+	// Waits for room until then when the policy is OverflowBlock, may be nil
+	Timeout *time.Time
+}
+
+type QueueSetCapacity struct {
+	QueueRequestInfo
+	Key      string
+	Capacity int
+	Policy   OverflowPolicy
 }
 
 type Resp struct {
@@ -42,22 +51,43 @@ var ChannelPool = sync.Pool{
 	},
 }
 
+// Sent by the timer of a waiter that ran out of time
+type queueWaiterTimeout struct {
+	QueueRequestInfo
+	Key    string
+	Waiter *qiWaiter
+}
+
+// Sent by the timer of a producer that ran out of time
+type queueProducerTimeout struct {
+	QueueRequestInfo
+	Key      string
+	Producer *qiProducer
+}
+
+// Everything is owned by the Manager goroutine, so no locking is needed
 type QI struct {
-	c chan string
-	r *atomic.Bool // true iff already begin waited on by a reader
+	values []string
+	// Blocked readers, longest waiting first
+	waiters []*qiWaiter
+	// Blocked writers of a full queue, longest waiting first
+	producers []*qiProducer
 }
 
-func newQI() *QI {
-	return &QI{
-		c: make(chan string, 100),
-		r: &atomic.Bool{},
-	}
+type qiWaiter struct {
+	resp  chan Resp
+	timer *time.Timer
+}
+
+type qiProducer struct {
+	values []string
+	resp   chan Resp
+	timer  *time.Timer
 }
 
 func (q *ChannelofChannels) Manager() {
 	qinfo := make(map[string]*QI)
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	limits := make(map[string]Limit)
 
 	for {
 		info, ok := <-q.RequestQueue
@@ -69,22 +99,42 @@ func (q *ChannelofChannels) Manager() {
 		case QueueSet:
 			queue, found := qinfo[qs.Key]
 			if !found {
-				queue = newQI()
+				queue = new(QI)
 				qinfo[qs.Key] = queue
 			}
 
-			for _, v := range qs.Value {
-				queue.c <- v
+			limit := limits[qs.Key]
+			switch {
+			case len(queue.producers) == 0 && limit.Fits(len(queue.values), len(queue.waiters), len(qs.Value)):
+				queue.push(qs.Value)
+				qs.Resp <- Resp{}
+
+			case limit.Policy == OverflowDropOldest:
+				queue.push(qs.Value)
+				for len(queue.values) > limit.Capacity {
+					queue.pop()
+				}
+				qs.Resp <- Resp{}
+
+			case !limit.Blocks(len(qs.Value), qs.Timeout):
+				qs.Resp <- Resp{Error: ErrorQueueFull}
+
+			default:
+				// Never wait here, every other queue would wait as well
+				p := &qiProducer{values: qs.Value, resp: qs.Resp}
+				key := qs.Key
+				p.timer = time.AfterFunc(time.Until(*qs.Timeout), func() {
+					q.RequestQueue <- queueProducerTimeout{Key: key, Producer: p}
+				})
+				queue.producers = append(queue.producers, p)
+			}
+			if queue.empty() {
+				delete(qinfo, qs.Key)
 			}
 
 		case QueueGet:
 			queue, found := qinfo[qs.Key]
-			if !found {
-				qs.Resp <- Resp{Error: ErrorEmptyQueue}
-				continue
-			}
-
-			if len(queue.c) == 0 {
+			if !found || len(queue.values) == 0 {
 				qs.Resp <- Resp{Error: ErrorEmptyQueue}
 				continue
 			}
@@ -92,40 +142,143 @@ func (q *ChannelofChannels) Manager() {
 			// Note: No need to check the len of Resp channel
 			// It is provided by the client from the channel pool
 			// Either it is newly created or put in the pool
-			c := <-queue.c
-			qs.Resp <- Resp{Value: c}
+			qs.Resp <- Resp{Value: queue.pop()}
+			queue.admit(limits[qs.Key])
+			if queue.empty() {
+				delete(qinfo, qs.Key)
+			}
 
 		case QueueGetTimeout:
 			queue, found := qinfo[qs.Key]
+			if found && len(queue.values) > 0 {
+				qs.Resp <- Resp{Value: queue.pop()}
+				queue.admit(limits[qs.Key])
+				if queue.empty() {
+					delete(qinfo, qs.Key)
+				}
+				continue
+			}
+
 			if !found {
-				queue = newQI()
+				queue = new(QI)
 				qinfo[qs.Key] = queue
 			}
 
-			if !queue.r.CompareAndSwap(false, true) {
-				qs.Resp <- Resp{Error: ErrorManyWaiterOnQueue}
+			w := &qiWaiter{resp: qs.Resp}
+			key := qs.Key
+			w.timer = time.AfterFunc(time.Until(qs.Time), func() {
+				q.RequestQueue <- queueWaiterTimeout{Key: key, Waiter: w}
+			})
+			queue.waiters = append(queue.waiters, w)
+
+		case QueueSetCapacity:
+			if qs.Capacity <= 0 {
+				delete(limits, qs.Key)
+			} else {
+				limits[qs.Key] = Limit{Capacity: qs.Capacity, Policy: qs.Policy}
+			}
+			if queue, found := qinfo[qs.Key]; found {
+				queue.admit(limits[qs.Key])
+			}
+
+		case queueWaiterTimeout:
+			queue, found := qinfo[qs.Key]
+			if !found {
 				continue
 			}
 
-			wg.Add(1)
-			go func(queue *QI) {
-				defer wg.Done()
+			// The waiter may have been served before its timeout got here
+			for i, w := range queue.waiters {
+				if w == qs.Waiter {
+					queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+					w.resp <- Resp{Error: ErrorEmptyQueue}
+					break
+				}
+			}
+			if queue.empty() {
+				delete(qinfo, qs.Key)
+			}
+
+		case queueProducerTimeout:
+			queue, found := qinfo[qs.Key]
+			if !found {
+				continue
+			}
 
-				select {
-				case c := <-queue.c:
-					qs.Resp <- Resp{Value: c}
-				case <-time.After(time.Until(qs.Time)):
-					qs.Resp <- Resp{Error: ErrorEmptyQueue}
+			// Same as queueWaiterTimeout, it may have been pushed already
+			for i, p := range queue.producers {
+				if p == qs.Producer {
+					queue.producers = append(queue.producers[:i], queue.producers[i+1:]...)
+					p.resp <- Resp{Error: ErrorQueueFull}
+					break
 				}
+			}
+			if queue.empty() {
+				delete(qinfo, qs.Key)
+			}
+		}
+	}
+}
+
+// Appends the values, handing them to blocked readers first
+func (q *QI) push(values []string) {
+	q.values = append(q.values, values...)
+	for len(q.waiters) > 0 && len(q.values) > 0 {
+		w := q.waiters[0]
+		q.waiters = q.waiters[1:]
+		w.timer.Stop()
+
+		// Note: the waiter is blocked receiving, this doesn't block
+		w.resp <- Resp{Value: q.pop()}
+	}
+}
 
-				queue.r.Store(false)
-			}(queue)
+// Pushes the values of blocked writers that fit now, in the order they
+// started waiting
+func (q *QI) admit(limit Limit) {
+	for len(q.producers) > 0 {
+		p := q.producers[0]
+		if !limit.Fits(len(q.values), len(q.waiters), len(p.values)) {
+			return
 		}
+		q.producers = q.producers[1:]
+		p.timer.Stop()
+
+		q.push(p.values)
+		p.resp <- Resp{}
+	}
+}
+
+func (q *QI) pop() string {
+	v := q.values[0]
+	q.values[0] = ""
+	q.values = q.values[1:]
+	return v
+}
+
+func (q *QI) empty() bool {
+	return len(q.values) == 0 && len(q.waiters) == 0 && len(q.producers) == 0
+}
+
+func (q *ChannelofChannels) QPush(key string, value []string) error {
+	return q.QPushTimeout(key, value, nil)
+}
+
+func (q *ChannelofChannels) QPushTimeout(key string, value []string, timeout *time.Time) error {
+	if len(value) <= 0 {
+		return nil
 	}
+
+	resp := ChannelPool.Get().(chan Resp)
+	q.RequestQueue <- QueueSet{Key: key, Value: value, Resp: resp, Timeout: timeout}
+	r := <-resp
+	ChannelPool.Put(resp)
+	return r.Error
 }
 
-func (q *ChannelofChannels) QPush(key string, value []string) {
-	q.RequestQueue <- QueueSet{Key: key, Value: value}
+// SetCapacity limits the queue at key, zero capacity removes the limit
+func (q *ChannelofChannels) SetCapacity(key string, capacity int, policy OverflowPolicy) {
+	q.RequestQueue <- QueueSetCapacity{Key: key, Capacity: capacity, Policy: policy}
 }
 
 func (q *ChannelofChannels) QPop(key string) (string, error) {
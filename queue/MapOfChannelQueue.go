@@ -2,91 +2,280 @@ package queue
 
 import (
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
+// Channel size of a queue without a limit, it is swapped for a bigger one
+// whenever it is full
+const defaultChannelCapacity = 100
+
+// Values wait in the channel. Every send and receive happens under the lock,
+// so the channel can be swapped for one of another size without losing
+// values or the order of the readers waiting on it.
 type MapOfChannelQueue struct {
-	q      chan string
-	locked atomic.Bool
+	q chan string
+
+	// Blocked readers, longest waiting first. They only wait on an empty
+	// channel, and a push hands them values before the channel gets any.
+	waiters []*mapOfChannelWaiter
+
+	// Signalled after a receive or a bigger channel, wakes the writer
+	// waiting for room
+	room chan struct{}
+	// Held by the writer waiting for room, the runtime queues the others
+	// in the order they started waiting
+	turn chan struct{}
 }
 
-func MOCQ() *MapOfChannelQueue {
+// A push hands the value to the waiter under the lock, so it is never lost
+// or given twice when the waiter times out at the same moment
+type mapOfChannelWaiter struct {
+	value  string
+	served bool
+	ready  chan struct{} // closed once served
+}
+
+func MOCQ(capacity int) *MapOfChannelQueue {
 	return &MapOfChannelQueue{
-		q:      make(chan string, 100),
-		locked: atomic.Bool{},
+		q:    make(chan string, capacity),
+		room: make(chan struct{}, 1),
+		turn: make(chan struct{}, 1),
 	}
 }
 
 type MapOfChannel struct {
-	Queue map[string]*MapOfChannelQueue
-	lock  sync.Mutex
+	Queue  map[string]*MapOfChannelQueue
+	limits map[string]Limit
+	lock   sync.Mutex
 }
 
-func (q *MapOfChannel) QPush(key string, value []string) {
-	q.lock.Lock()
-
+// Must be called with the lock held
+func (q *MapOfChannel) queueLocked(key string) *MapOfChannelQueue {
 	queue, found := q.Queue[key]
 	if !found {
-		queue = MOCQ()
+		capacity := q.limits[key].Capacity
+		if capacity == 0 {
+			capacity = defaultChannelCapacity
+		}
+		queue = MOCQ(capacity)
 		q.Queue[key] = queue
 	}
+	return queue
+}
 
-	q.lock.Unlock()
+// Removes the queue once nothing is in it or waiting on it. A writer waiting
+// for its turn means another one holds it. Must be called with the lock held.
+func (q *MapOfChannel) deleteIdleLocked(key string, queue *MapOfChannelQueue) {
+	if len(queue.q) == 0 && len(queue.waiters) == 0 && len(queue.turn) == 0 && q.Queue[key] == queue {
+		delete(q.Queue, key)
+	}
+}
+
+// Swaps the channel for one of the given size, moving the values over. Must
+// be called with the lock held.
+func (queue *MapOfChannelQueue) resizeLocked(capacity int) {
+	// The channel is sized for the values already there
+	if capacity < len(queue.q) {
+		capacity = len(queue.q)
+	}
+	q := make(chan string, capacity)
+	for len(queue.q) > 0 {
+		q <- <-queue.q
+	}
+	queue.q = q
+	queue.madeRoom()
+}
 
+// Sends the values if they all fit, nothing else sends while the lock is
+// held so the sends don't block. Values always fit a queue without a limit,
+// its channel grows. Must be called with the lock held.
+func (queue *MapOfChannelQueue) sendLocked(limit Limit, value []string) bool {
+	if !limit.Fits(len(queue.q), len(queue.waiters), len(value)) {
+		return false
+	}
+	value = queue.serveWaitersLocked(value)
+	if limit.Capacity == 0 && cap(queue.q)-len(queue.q) < len(value) {
+		queue.resizeLocked(2*cap(queue.q) + len(value))
+	}
 	for _, v := range value {
 		queue.q <- v
 	}
+	return true
 }
 
-func (q *MapOfChannel) QPop(key string) (string, error) {
-	q.lock.Lock()
-	queue, found := q.Queue[key]
-	q.lock.Unlock()
-	if !found {
-		return "", ErrorEmptyQueue
+// Hands values to the longest waiting readers and returns the ones left. Must
+// be called with the lock held.
+func (queue *MapOfChannelQueue) serveWaitersLocked(value []string) []string {
+	for len(queue.waiters) > 0 && len(value) > 0 {
+		w := queue.waiters[0]
+		queue.waiters = queue.waiters[1:]
+
+		w.value = value[0]
+		w.served = true
+		close(w.ready)
+		value = value[1:]
+	}
+	return value
+}
+
+func (q *MapOfChannel) QPush(key string, value []string) error {
+	return q.QPushTimeout(key, value, nil)
+}
+
+func (q *MapOfChannel) QPushTimeout(key string, value []string, timeout *time.Time) error {
+	if len(value) <= 0 {
+		return nil
+	}
+
+	var timer *time.Timer
+	if timeout != nil {
+		timer = time.NewTimer(time.Until(*timeout))
+		defer timer.Stop()
+	}
+
+	for {
+		q.lock.Lock()
+		queue := q.queueLocked(key)
+		limit := q.limits[key]
+
+		if len(queue.turn) == 0 && queue.sendLocked(limit, value) {
+			q.lock.Unlock()
+			return nil
+		}
+
+		if limit.Policy == OverflowDropOldest {
+			for _, v := range queue.serveWaitersLocked(value) {
+				for len(queue.q) >= limit.Capacity {
+					<-queue.q
+				}
+				queue.q <- v
+			}
+			q.lock.Unlock()
+			return nil
+		}
+
+		if !limit.Blocks(len(value), timeout) {
+			q.deleteIdleLocked(key, queue)
+			q.lock.Unlock()
+			return ErrorQueueFull
+		}
+		q.lock.Unlock()
+
+		select {
+		case queue.turn <- struct{}{}:
+		case <-timer.C:
+			return ErrorQueueFull
+		}
+
+		if done, err := q.waitRoom(key, queue, value, timer); done {
+			return err
+		}
 	}
+}
+
+// Pushes the values once there is room, the caller holds the queue's turn.
+// Returns false when the queue was removed and the push must be retried.
+func (q *MapOfChannel) waitRoom(key string, queue *MapOfChannelQueue, value []string, timer *time.Timer) (bool, error) {
+	defer func() {
+		q.lock.Lock()
+		<-queue.turn
+		q.deleteIdleLocked(key, queue)
+		q.lock.Unlock()
+	}()
 
-	if !queue.locked.CompareAndSwap(false, true) {
-		return "", ErrorManyWaiterOnQueue
+	for {
+		q.lock.Lock()
+		if q.Queue[key] != queue {
+			q.lock.Unlock()
+			return false, nil
+		}
+		if queue.sendLocked(q.limits[key], value) {
+			q.lock.Unlock()
+			return true, nil
+		}
+		q.lock.Unlock()
+
+		select {
+		case <-queue.room:
+		case <-timer.C:
+			return true, ErrorQueueFull
+		}
 	}
-	defer queue.locked.Store(false)
+}
 
+// Wakes the writer waiting for room, must be called after every receive
+func (queue *MapOfChannelQueue) madeRoom() {
 	select {
-	case c := <-queue.q:
-		return c, nil
+	case queue.room <- struct{}{}:
 	default:
-		return "", ErrorEmptyQueue
 	}
 }
 
+func (q *MapOfChannel) QPop(key string) (string, error) {
+	return q.QPopTimeout(key, nil)
+}
+
 func (q *MapOfChannel) QPopTimeout(key string, t *time.Time) (string, error) {
 	q.lock.Lock()
+
 	queue, found := q.Queue[key]
-	if !found {
-		queue = MOCQ()
-		q.Queue[key] = queue
+	if found && len(queue.q) > 0 {
+		defer q.lock.Unlock()
+		c := <-queue.q
+		queue.madeRoom()
+		q.deleteIdleLocked(key, queue)
+		return c, nil
 	}
+	if t == nil {
+		q.lock.Unlock()
+		return "", ErrorEmptyQueue
+	}
+
+	queue = q.queueLocked(key)
+	w := &mapOfChannelWaiter{ready: make(chan struct{})}
+	queue.waiters = append(queue.waiters, w)
 	q.lock.Unlock()
 
-	if !queue.locked.CompareAndSwap(false, true) {
-		return "", ErrorManyWaiterOnQueue
+	timer := time.NewTimer(time.Until(*t))
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return w.value, nil
+	case <-timer.C:
 	}
-	defer queue.locked.Store(false)
 
-	if t == nil {
-		select {
-		case c := <-queue.q:
-			return c, nil
-		default:
-			return "", ErrorEmptyQueue
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if w.served {
+		return w.value, nil
+	}
+
+	for i, other := range queue.waiters {
+		if other == w {
+			queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+			break
 		}
 	}
+	q.deleteIdleLocked(key, queue)
+	return "", ErrorEmptyQueue
+}
 
-	select {
-	case <-time.After(time.Until(*t)):
-		return "", ErrorEmptyQueue
-	case c := <-queue.q:
-		return c, nil
+// SetCapacity limits the queue at key, zero capacity removes the limit.
+// Values already there are kept even when they don't fit anymore.
+func (q *MapOfChannel) SetCapacity(key string, capacity int, policy OverflowPolicy) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if capacity <= 0 {
+		delete(q.limits, key)
+		capacity = defaultChannelCapacity
+	} else {
+		q.limits[key] = Limit{Capacity: capacity, Policy: policy}
+	}
+
+	if queue, found := q.Queue[key]; found {
+		queue.resizeLocked(capacity)
 	}
 }
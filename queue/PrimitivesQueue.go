@@ -5,13 +5,6 @@ import (
 	"time"
 )
 
-type WaitingStatus int
-
-const (
-	NoWaiting WaitingStatus = iota
-	CurrentlyWaiting
-)
-
 type QueueNode struct {
 	value string
 	next  *QueueNode
@@ -20,13 +13,33 @@ type QueueNode struct {
 type PrimitiveQueue struct {
 	head   *QueueNode
 	tail   *QueueNode
-	status WaitingStatus
-	cond   *sync.Cond
+	length int
+
+	// Blocked readers, longest waiting first
+	waiters []*primitiveWaiter
+	// Blocked writers of a full queue, longest waiting first
+	producers []*primitiveProducer
+}
+
+// A push hands the value to the waiter under the lock, so it is never lost
+// or given twice when the waiter times out at the same moment
+type primitiveWaiter struct {
+	value  string
+	served bool
+	ready  chan struct{} // closed once served
+}
+
+// Same as primitiveWaiter, a pop pushes the values once they fit
+type primitiveProducer struct {
+	values []string
+	served bool
+	ready  chan struct{} // closed once pushed
 }
 
 type OneToManyQueuePrimitive struct {
-	lock  sync.Mutex
-	Queue map[string]*PrimitiveQueue
+	lock   sync.Mutex
+	Queue  map[string]*PrimitiveQueue
+	limits map[string]Limit
 }
 
 var NodePool = sync.Pool{
@@ -35,11 +48,76 @@ var NodePool = sync.Pool{
 	},
 }
 
-func (q *OneToManyQueuePrimitive) QPush(key string, value []string) {
+func (q *OneToManyQueuePrimitive) QPush(key string, value []string) error {
+	return q.QPushTimeout(key, value, nil)
+}
+
+func (q *OneToManyQueuePrimitive) QPushTimeout(key string, value []string, timeout *time.Time) error {
 	if len(value) <= 0 {
-		return
+		return nil
 	}
 
+	q.lock.Lock()
+
+	queue, found := q.Queue[key]
+	if !found {
+		queue = new(PrimitiveQueue)
+		q.Queue[key] = queue
+	}
+
+	limit := q.limits[key]
+	switch {
+	case len(queue.producers) == 0 && limit.Fits(queue.length, len(queue.waiters), len(value)):
+		q.pushLocked(queue, value)
+		q.lock.Unlock()
+		return nil
+
+	case limit.Policy == OverflowDropOldest:
+		q.pushLocked(queue, value)
+		for queue.length > limit.Capacity {
+			q.takeLocked(queue)
+		}
+		q.lock.Unlock()
+		return nil
+
+	case !limit.Blocks(len(value), timeout):
+		q.deleteIdleLocked(key, queue)
+		q.lock.Unlock()
+		return ErrorQueueFull
+	}
+
+	p := &primitiveProducer{values: value, ready: make(chan struct{})}
+	queue.producers = append(queue.producers, p)
+	q.lock.Unlock()
+
+	timer := time.NewTimer(time.Until(*timeout))
+	defer timer.Stop()
+
+	select {
+	case <-p.ready:
+		return nil
+	case <-timer.C:
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if p.served {
+		return nil
+	}
+
+	for i, other := range queue.producers {
+		if other == p {
+			queue.producers = append(queue.producers[:i], queue.producers[i+1:]...)
+			break
+		}
+	}
+	q.deleteIdleLocked(key, queue)
+	return ErrorQueueFull
+}
+
+// Must be called with the lock held
+func (q *OneToManyQueuePrimitive) pushLocked(queue *PrimitiveQueue, value []string) {
 	head := NodePool.Get().(*QueueNode)
 	head.value = value[0]
 	head.next = nil
@@ -50,14 +128,6 @@ func (q *OneToManyQueuePrimitive) QPush(key string, value []string) {
 		tail = tail.next
 	}
 
-	q.lock.Lock()
-	defer q.lock.Unlock()
-
-	queue, found := q.Queue[key]
-	if !found {
-		queue = new(PrimitiveQueue)
-	}
-
 	if queue.head == nil {
 		queue.head = head
 		queue.tail = tail
@@ -65,11 +135,15 @@ func (q *OneToManyQueuePrimitive) QPush(key string, value []string) {
 		queue.tail.next = head
 		queue.tail = tail
 	}
+	queue.length += len(value)
 
-	q.Queue[key] = queue
+	for len(queue.waiters) > 0 && queue.head != nil {
+		w := queue.waiters[0]
+		queue.waiters = queue.waiters[1:]
 
-	if queue.status == CurrentlyWaiting {
-		queue.cond.Signal()
+		w.value = q.takeLocked(queue)
+		w.served = true
+		close(w.ready)
 	}
 }
 
@@ -77,64 +151,111 @@ func (q *OneToManyQueuePrimitive) QPop(key string) (string, error) {
 	return q.QPopTimeout(key, nil)
 }
 
-func (q *OneToManyQueuePrimitive) QPopTimeout(key string, time *time.Time) (string, error) {
+func (q *OneToManyQueuePrimitive) QPopTimeout(key string, timeout *time.Time) (string, error) {
 	q.lock.Lock()
-	defer q.lock.Unlock()
 
 	queue, found := q.Queue[key]
+	if found && queue.head != nil {
+		defer q.lock.Unlock()
+		return q.popLocked(key, queue), nil
+	}
+	if timeout == nil {
+		q.lock.Unlock()
+		return "", ErrorEmptyQueue
+	}
+
 	if !found {
-		if time == nil {
-			return "", ErrorEmptyQueue
-		}
 		queue = new(PrimitiveQueue)
 		q.Queue[key] = queue
 	}
+	w := &primitiveWaiter{ready: make(chan struct{})}
+	queue.waiters = append(queue.waiters, w)
+	q.lock.Unlock()
 
-	for queue.head == nil {
-		if time == nil {
-			return "", ErrorEmptyQueue
-		}
+	timer := time.NewTimer(time.Until(*timeout))
+	defer timer.Stop()
 
-		err := q.waitForValue(queue, *time)
-		if err != nil {
-			return "", err
-		}
+	select {
+	case <-w.ready:
+		return w.value, nil
+	case <-timer.C:
+	}
 
-		time = nil
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if w.served {
+		return w.value, nil
 	}
 
-	node := queue.head
-	if queue.head == queue.tail {
-		// Only Element
-		queue.head = nil
-		queue.tail = nil
+	for i, other := range queue.waiters {
+		if other == w {
+			queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+			break
+		}
 	}
-	if queue.head == nil {
-		delete(q.Queue, key)
+	q.deleteIdleLocked(key, queue)
+	return "", ErrorEmptyQueue
+}
+
+// SetCapacity limits the queue at key, zero capacity removes the limit
+func (q *OneToManyQueuePrimitive) SetCapacity(key string, capacity int, policy OverflowPolicy) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if capacity <= 0 {
+		delete(q.limits, key)
 	} else {
-		queue.head = queue.head.next
-		q.Queue[key] = queue
+		q.limits[key] = Limit{Capacity: capacity, Policy: policy}
 	}
 
-	NodePool.Put(node)
-	return node.value, nil
+	if queue, found := q.Queue[key]; found {
+		q.admitLocked(key, queue)
+	}
 }
 
-// Errors if queue is already begin waited on
-func (qP *OneToManyQueuePrimitive) waitForValue(q *PrimitiveQueue, timeout time.Time) error {
-	if q.status == CurrentlyWaiting {
-		return ErrorManyWaiterOnQueue
+// Must be called with the lock held on a non empty queue
+func (q *OneToManyQueuePrimitive) popLocked(key string, queue *PrimitiveQueue) string {
+	value := q.takeLocked(queue)
+	q.admitLocked(key, queue)
+	q.deleteIdleLocked(key, queue)
+	return value
+}
+
+// Must be called with the lock held on a non empty queue
+func (q *OneToManyQueuePrimitive) takeLocked(queue *PrimitiveQueue) string {
+	node := queue.head
+	queue.head = node.next
+	if queue.head == nil {
+		queue.tail = nil
 	}
+	queue.length--
+
+	value := node.value
+	NodePool.Put(node)
+	return value
+}
 
-	q.status = CurrentlyWaiting
-	q.cond = sync.NewCond(&qP.lock)
+// Pushes the values of blocked writers that fit now, in the order they
+// started waiting. Must be called with the lock held.
+func (q *OneToManyQueuePrimitive) admitLocked(key string, queue *PrimitiveQueue) {
+	limit := q.limits[key]
+	for len(queue.producers) > 0 {
+		p := queue.producers[0]
+		if !limit.Fits(queue.length, len(queue.waiters), len(p.values)) {
+			return
+		}
+		queue.producers = queue.producers[1:]
 
-	go func() {
-		<-time.After(time.Until(timeout))
-		q.cond.Signal()
-	}()
+		q.pushLocked(queue, p.values)
+		p.served = true
+		close(p.ready)
+	}
+}
 
-	q.cond.Wait()
-	q.status = NoWaiting
-	return nil
+// Must be called with the lock held
+func (q *OneToManyQueuePrimitive) deleteIdleLocked(key string, queue *PrimitiveQueue) {
+	if queue.head == nil && len(queue.waiters) == 0 && len(queue.producers) == 0 {
+		delete(q.Queue, key)
+	}
 }
@@ -0,0 +1,252 @@
+package queue
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type priorityItem struct {
+	value    string
+	priority int
+	seq      uint64 // Keeps values of the same priority in push order
+}
+
+// Highest priority first, then oldest first
+type priorityItems []priorityItem
+
+func (h priorityItems) Len() int { return len(h) }
+
+func (h priorityItems) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityItems) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityItems) Push(x any) { *h = append(*h, x.(priorityItem)) }
+
+func (h *priorityItems) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+type PriorityQueue struct {
+	items priorityItems
+	seq   uint64
+
+	// Blocked readers, longest waiting first
+	waiters []*primitiveWaiter
+	// Blocked writers of a full queue, longest waiting first
+	producers []*priorityProducer
+}
+
+type priorityProducer struct {
+	primitiveProducer
+	priority int
+}
+
+type OneToManyQueuePriority struct {
+	lock   sync.Mutex
+	Queue  map[string]*PriorityQueue
+	limits map[string]Limit
+}
+
+// QPush pushes at the default priority, zero
+func (q *OneToManyQueuePriority) QPush(key string, value []string) error {
+	return q.push(key, 0, value, nil)
+}
+
+func (q *OneToManyQueuePriority) QPushTimeout(key string, value []string, timeout *time.Time) error {
+	return q.push(key, 0, value, timeout)
+}
+
+// QPushPriority pushes values popped before every value of a lower priority,
+// and after the ones of the same priority already there
+func (q *OneToManyQueuePriority) QPushPriority(key string, priority int, value []string) error {
+	return q.push(key, priority, value, nil)
+}
+
+func (q *OneToManyQueuePriority) push(key string, priority int, value []string, timeout *time.Time) error {
+	if len(value) <= 0 {
+		return nil
+	}
+
+	q.lock.Lock()
+
+	queue, found := q.Queue[key]
+	if !found {
+		queue = new(PriorityQueue)
+		q.Queue[key] = queue
+	}
+
+	limit := q.limits[key]
+	switch {
+	case len(queue.producers) == 0 && limit.Fits(len(queue.items), len(queue.waiters), len(value)):
+		q.pushLocked(queue, priority, value)
+		q.lock.Unlock()
+		return nil
+
+	case limit.Policy == OverflowDropOldest:
+		q.pushLocked(queue, priority, value)
+		for len(queue.items) > limit.Capacity {
+			heap.Pop(&queue.items)
+		}
+		q.lock.Unlock()
+		return nil
+
+	case !limit.Blocks(len(value), timeout):
+		q.deleteIdleLocked(key, queue)
+		q.lock.Unlock()
+		return ErrorQueueFull
+	}
+
+	p := &priorityProducer{primitiveProducer{values: value, ready: make(chan struct{})}, priority}
+	queue.producers = append(queue.producers, p)
+	q.lock.Unlock()
+
+	timer := time.NewTimer(time.Until(*timeout))
+	defer timer.Stop()
+
+	select {
+	case <-p.ready:
+		return nil
+	case <-timer.C:
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if p.served {
+		return nil
+	}
+
+	for i, other := range queue.producers {
+		if other == p {
+			queue.producers = append(queue.producers[:i], queue.producers[i+1:]...)
+			break
+		}
+	}
+	q.deleteIdleLocked(key, queue)
+	return ErrorQueueFull
+}
+
+// Must be called with the lock held
+func (q *OneToManyQueuePriority) pushLocked(queue *PriorityQueue, priority int, value []string) {
+	for _, v := range value {
+		queue.seq++
+		heap.Push(&queue.items, priorityItem{value: v, priority: priority, seq: queue.seq})
+	}
+
+	for len(queue.waiters) > 0 && len(queue.items) > 0 {
+		w := queue.waiters[0]
+		queue.waiters = queue.waiters[1:]
+
+		w.value = heap.Pop(&queue.items).(priorityItem).value
+		w.served = true
+		close(w.ready)
+	}
+}
+
+func (q *OneToManyQueuePriority) QPop(key string) (string, error) {
+	return q.QPopTimeout(key, nil)
+}
+
+func (q *OneToManyQueuePriority) QPopTimeout(key string, timeout *time.Time) (string, error) {
+	q.lock.Lock()
+
+	queue, found := q.Queue[key]
+	if found && len(queue.items) > 0 {
+		defer q.lock.Unlock()
+		return q.popLocked(key, queue), nil
+	}
+	if timeout == nil {
+		q.lock.Unlock()
+		return "", ErrorEmptyQueue
+	}
+
+	if !found {
+		queue = new(PriorityQueue)
+		q.Queue[key] = queue
+	}
+	w := &primitiveWaiter{ready: make(chan struct{})}
+	queue.waiters = append(queue.waiters, w)
+	q.lock.Unlock()
+
+	timer := time.NewTimer(time.Until(*timeout))
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return w.value, nil
+	case <-timer.C:
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if w.served {
+		return w.value, nil
+	}
+
+	for i, other := range queue.waiters {
+		if other == w {
+			queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+			break
+		}
+	}
+	q.deleteIdleLocked(key, queue)
+	return "", ErrorEmptyQueue
+}
+
+// SetCapacity limits the queue at key, zero capacity removes the limit
+func (q *OneToManyQueuePriority) SetCapacity(key string, capacity int, policy OverflowPolicy) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if capacity <= 0 {
+		delete(q.limits, key)
+	} else {
+		q.limits[key] = Limit{Capacity: capacity, Policy: policy}
+	}
+
+	if queue, found := q.Queue[key]; found {
+		q.admitLocked(key, queue)
+	}
+}
+
+// Must be called with the lock held on a non empty queue
+func (q *OneToManyQueuePriority) popLocked(key string, queue *PriorityQueue) string {
+	item := heap.Pop(&queue.items).(priorityItem)
+	q.admitLocked(key, queue)
+	q.deleteIdleLocked(key, queue)
+	return item.value
+}
+
+// Pushes the values of blocked writers that fit now, in the order they
+// started waiting. Must be called with the lock held.
+func (q *OneToManyQueuePriority) admitLocked(key string, queue *PriorityQueue) {
+	limit := q.limits[key]
+	for len(queue.producers) > 0 {
+		p := queue.producers[0]
+		if !limit.Fits(len(queue.items), len(queue.waiters), len(p.values)) {
+			return
+		}
+		queue.producers = queue.producers[1:]
+
+		q.pushLocked(queue, p.priority, p.values)
+		p.served = true
+		close(p.ready)
+	}
+}
+
+// Must be called with the lock held
+func (q *OneToManyQueuePriority) deleteIdleLocked(key string, queue *PriorityQueue) {
+	if len(queue.items) == 0 && len(queue.waiters) == 0 && len(queue.producers) == 0 {
+		delete(q.Queue, key)
+	}
+}
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"log"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -16,6 +17,9 @@ func TestQueue(t *testing.T) {
 	t.Run("QueueTypeChannel", func(t *testing.T) {
 		_TestQueue(t, QueueTypeChannel)
 	})
+	t.Run("QueueTypePriority", func(t *testing.T) {
+		_TestQueue(t, QueueTypePriority)
+	})
 }
 
 func _TestQueue(t *testing.T, queueType int) {
@@ -42,8 +46,9 @@ func _TestQueue(t *testing.T, queueType int) {
 		expireTime := new(time.Time)
 		*expireTime = time.Now().Add(1 * time.Second)
 
+		// Queued behind the first waiter, which gets the value
 		_, err := queue.QPopTimeout("queue", expireTime)
-		if err != ErrorManyWaiterOnQueue {
+		if err != ErrorEmptyQueue {
 			t.Errorf("Expected error, got %+v", err)
 		}
 	}()
@@ -69,6 +74,9 @@ func TestParallelReader(t *testing.T) {
 	t.Run("QueueTypeChannel", func(t *testing.T) {
 		_TestParallelReader(t, QueueTypeChannel)
 	})
+	t.Run("QueueTypePriority", func(t *testing.T) {
+		_TestParallelReader(t, QueueTypePriority)
+	})
 }
 
 func _TestParallelReader(t *testing.T, queueType int) {
@@ -80,7 +88,7 @@ func _TestParallelReader(t *testing.T, queueType int) {
 	go func() {
 		time.Sleep(1 * time.Second)
 		_, err := queue.QPopTimeout("queue", expireTime)
-		if err != ErrorManyWaiterOnQueue {
+		if err != ErrorEmptyQueue {
 			t.Errorf("Expected error, got %+v", err)
 		}
 	}()
@@ -91,6 +99,100 @@ func _TestParallelReader(t *testing.T, queueType int) {
 	}
 }
 
+func TestFairReaders(t *testing.T) {
+	t.Run("QueueTypePrimitive", func(t *testing.T) {
+		_TestFairReaders(t, QueueTypePrimitive)
+	})
+	t.Run("QueueTypeMapOfChannel", func(t *testing.T) {
+		_TestFairReaders(t, QueueTypeMapOfChannel)
+	})
+	t.Run("QueueTypeChannel", func(t *testing.T) {
+		_TestFairReaders(t, QueueTypeChannel)
+	})
+	t.Run("QueueTypePriority", func(t *testing.T) {
+		_TestFairReaders(t, QueueTypePriority)
+	})
+}
+
+func _TestFairReaders(t *testing.T, queueType int) {
+	queue := QueueFactory(queueType)
+
+	expireTime := new(time.Time)
+	*expireTime = time.Now().Add(5 * time.Second)
+
+	// Readers start waiting in order, the sleep lets each one block first
+	const readers = 3
+	results := make([]chan string, readers)
+	for i := range results {
+		results[i] = make(chan string, 1)
+		go func(i int) {
+			v, err := queue.QPopTimeout("queue", expireTime)
+			if err != nil {
+				t.Errorf("%d: %+v", i, err)
+			}
+			results[i] <- v
+		}(i)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for i, v := range []string{"a", "b", "c"} {
+		queue.QPush("queue", []string{v})
+		if got := <-results[i]; got != v {
+			t.Fatalf("Expected reader %d to get %s, got %s", i, v, got)
+		}
+	}
+
+	// Changing the capacity while readers wait keeps their order
+	for i := range results {
+		go func(i int) {
+			v, err := queue.QPopTimeout("swapped", expireTime)
+			if err != nil {
+				t.Errorf("%d: %+v", i, err)
+			}
+			results[i] <- v
+		}(i)
+		time.Sleep(50 * time.Millisecond)
+	}
+	queue.SetCapacity("swapped", 10, OverflowReject)
+	queue.QPush("swapped", []string{"a", "b", "c"})
+	for i, v := range []string{"a", "b", "c"} {
+		if got := <-results[i]; got != v {
+			t.Fatalf("Expected reader %d to get %s, got %s", i, v, got)
+		}
+	}
+
+	// A reader that timed out doesn't take a value meant for the next one
+	short := new(time.Time)
+	*short = time.Now().Add(50 * time.Millisecond)
+	if _, err := queue.QPopTimeout("queue", short); err != ErrorEmptyQueue {
+		t.Fatalf("Expected error, got %+v", err)
+	}
+	queue.QPush("queue", []string{"d"})
+	if v, err := queue.QPop("queue"); err != nil || v != "d" {
+		t.Fatalf("Expected d, got %s %+v", v, err)
+	}
+}
+
+func TestMapOfChannelIdle(t *testing.T) {
+	queue := QueueFactory(QueueTypeMapOfChannel).(*MapOfChannel)
+
+	short := time.Now().Add(20 * time.Millisecond)
+	if _, err := queue.QPopTimeout("waited", &short); err != ErrorEmptyQueue {
+		t.Fatalf("Expected error, got %+v", err)
+	}
+	queue.QPush("popped", []string{"a"})
+	queue.QPop("popped")
+	queue.SetCapacity("rejected", 1, OverflowReject)
+	if err := queue.QPush("rejected", []string{"a", "b"}); err != ErrorQueueFull {
+		t.Fatalf("Expected full queue, got %+v", err)
+	}
+
+	// Queues with nothing in them or waiting on them are removed
+	if len(queue.Queue) != 0 {
+		t.Fatalf("Expected no queues, got %+v", queue.Queue)
+	}
+}
+
 func TestScenarios(t *testing.T) {
 	t.Run("QueueTypePrimitive", func(t *testing.T) {
 		_TestScenarios(t, QueueTypePrimitive)
@@ -101,6 +203,9 @@ func TestScenarios(t *testing.T) {
 	t.Run("QueueTypeChannel", func(t *testing.T) {
 		_TestScenarios(t, QueueTypeChannel)
 	})
+	t.Run("QueueTypePriority", func(t *testing.T) {
+		_TestScenarios(t, QueueTypePriority)
+	})
 }
 
 func _TestScenarios(t *testing.T, queueType int) {
@@ -163,6 +268,9 @@ func TestQueueFunctionality(t *testing.T) {
 	t.Run("QueueTypeChannel", func(t *testing.T) {
 		_TestQueueFunctionality(t, QueueTypeChannel)
 	})
+	t.Run("QueueTypePriority", func(t *testing.T) {
+		_TestQueueFunctionality(t, QueueTypePriority)
+	})
 }
 
 func _TestQueueFunctionality(t *testing.T, queueType int) {
@@ -180,3 +288,132 @@ func _TestQueueFunctionality(t *testing.T, queueType int) {
 		}
 	}
 }
+
+func TestPriorities(t *testing.T) {
+	queue := QueueFactory(QueueTypePriority).(PriorityQueuer)
+
+	queue.QPush("queue", []string{"low1", "low2"})
+	queue.QPushPriority("queue", 10, []string{"high1", "high2"})
+	queue.QPushPriority("queue", -1, []string{"lowest"})
+	queue.QPushPriority("queue", 10, []string{"high3"})
+
+	for _, expected := range []string{"high1", "high2", "high3", "low1", "low2", "lowest"} {
+		v, err := queue.QPop("queue")
+		if err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+	}
+	if _, err := queue.QPop("queue"); err != ErrorEmptyQueue {
+		t.Fatalf("Expected error, got %+v", err)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	t.Run("QueueTypePrimitive", func(t *testing.T) {
+		_TestCapacity(t, QueueTypePrimitive)
+	})
+	t.Run("QueueTypeMapOfChannel", func(t *testing.T) {
+		_TestCapacity(t, QueueTypeMapOfChannel)
+	})
+	t.Run("QueueTypeChannel", func(t *testing.T) {
+		_TestCapacity(t, QueueTypeChannel)
+	})
+	t.Run("QueueTypePriority", func(t *testing.T) {
+		_TestCapacity(t, QueueTypePriority)
+	})
+}
+
+func _TestCapacity(t *testing.T, queueType int) {
+	queue := QueueFactory(queueType)
+
+	expectPops := func(key string, expected ...string) {
+		t.Helper()
+		for _, e := range expected {
+			v, err := queue.QPop(key)
+			if err != nil || v != e {
+				t.Fatalf("Expected %s, got %s %+v", e, v, err)
+			}
+		}
+		if _, err := queue.QPop(key); err != ErrorEmptyQueue {
+			t.Fatalf("Expected empty queue, got %+v", err)
+		}
+	}
+
+	// Reject doesn't push any of the values that don't fit
+	queue.SetCapacity("reject", 2, OverflowReject)
+	if err := queue.QPush("reject", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.QPush("reject", []string{"b", "c"}); err != ErrorQueueFull {
+		t.Fatalf("Expected full queue, got %+v", err)
+	}
+	if err := queue.QPush("reject", []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	expectPops("reject", "a", "b")
+
+	// Drop oldest keeps the values pushed last
+	queue.SetCapacity("drop", 2, OverflowDropOldest)
+	queue.QPush("drop", []string{"a", "b"})
+	if err := queue.QPush("drop", []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+	expectPops("drop", "b", "c")
+
+	// Block fails once the timeout is reached, and QPush doesn't wait at all
+	queue.SetCapacity("block", 1, OverflowBlock)
+	queue.QPush("block", []string{"a"})
+	if err := queue.QPush("block", []string{"b"}); err != ErrorQueueFull {
+		t.Fatalf("Expected full queue, got %+v", err)
+	}
+	start := time.Now()
+	short := time.Now().Add(100 * time.Millisecond)
+	if err := queue.QPushTimeout("block", []string{"b"}, &short); err != ErrorQueueFull {
+		t.Fatalf("Expected full queue, got %+v", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("Returned before the timeout")
+	}
+
+	// Blocked writers are pushed by pops, in the order they started waiting
+	long := time.Now().Add(5 * time.Second)
+	done := make([]chan error, 2)
+	for i, v := range []string{"b", "c"} {
+		done[i] = make(chan error, 1)
+		go func(i int, v string) {
+			done[i] <- queue.QPushTimeout("block", []string{v}, &long)
+		}(i, v)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for i, expected := range []string{"a", "b"} {
+		v, err := queue.QPop("block")
+		if err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+		if err := <-done[i]; err != nil {
+			t.Fatalf("Writer %d: %+v", i, err)
+		}
+	}
+	expectPops("block", "c")
+
+	// Removing the limit lets everything in
+	queue.SetCapacity("reject", 0, OverflowReject)
+	if err := queue.QPush("reject", []string{"a", "b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	expectPops("reject", "a", "b", "c")
+
+	// Without a limit there is no cap at all
+	var values []string
+	for i := 0; i < 1000; i++ {
+		values = append(values, strconv.Itoa(i))
+		if err := queue.QPush("unlimited", []string{values[i]}); err != nil {
+			t.Fatalf("Push %d: %+v", i, err)
+		}
+	}
+	if err := queue.QPush("unlimited", values); err != nil {
+		t.Fatal(err)
+	}
+	expectPops("unlimited", append(values, values...)...)
+}
@@ -60,6 +60,7 @@ func BenchmarkQueuePushPop(b *testing.B) {
 		{"primitive", QueueTypePrimitive},
 		{"mapOfChannel", QueueTypeMapOfChannel},
 		{"channelOfChannel", QueueTypeChannel},
+		{"priority", QueueTypePriority},
 	}
 
 	const MaxGoroutineCount = 50
@@ -5,23 +5,93 @@ import (
 	"time"
 )
 
+// Queue is what every implementation here can do. Leased pops aren't part
+// of it: an expired lease goes back at the head of its queue, and the
+// mapofchannel queue keeps its values in a Go channel, which only takes
+// values at the tail. Leases are served by Storage's linked list alone, see
+// lease.go.
 type Queue interface {
-	QPush(string, []string)
+	QPush(string, []string) error
+	// Waits until the timeout for room when the queue is full and its policy
+	// is OverflowBlock, a nil timeout doesn't wait
+	QPushTimeout(string, []string, *time.Time) error
 	QPop(string) (string, error)
 	QPopTimeout(string, *time.Time) (string, error)
+	// Limits the queue to a number of values, zero is the default capacity
+	SetCapacity(string, int, OverflowPolicy)
+}
+
+// Implemented by QueueTypePriority, values with a higher priority are popped
+// first and values of the same priority in the order they were pushed
+type PriorityQueuer interface {
+	Queue
+	QPushPriority(string, int, []string) error
 }
 
 var (
-	ErrorKeyNotFound       = errors.New("key not found")
-	ErrorKeyExists         = errors.New("key already exists")
-	ErrorEmptyQueue        = errors.New("queue is empty")
-	ErrorManyWaiterOnQueue = errors.New("many waiter on queue")
+	ErrorKeyNotFound = errors.New("key not found")
+	ErrorKeyExists   = errors.New("key already exists")
+	ErrorEmptyQueue  = errors.New("queue is empty")
+	ErrorQueueFull   = errors.New("queue is full")
+)
+
+// What a push does when its values don't fit in the queue. A push is never
+// split, either all of its values are pushed or none.
+type OverflowPolicy int
+
+const (
+	// Fail with ErrorQueueFull
+	OverflowReject OverflowPolicy = iota
+	// Wait for room in QPushTimeout, other pushes fail with ErrorQueueFull
+	OverflowBlock
+	// Drop the values that would be popped next to make room, or the ones
+	// that would be popped last for pushes to the front
+	OverflowDropOldest
 )
 
+var overflowPolicyNames = []string{"REJECT", "BLOCK", "DROPOLDEST"}
+
+func (p OverflowPolicy) String() string {
+	return overflowPolicyNames[p]
+}
+
+// Whether p is one of the policies above
+func (p OverflowPolicy) Valid() bool {
+	return p >= 0 && int(p) < len(overflowPolicyNames)
+}
+
+// ParseOverflowPolicy takes the uppercase name String gives
+func ParseOverflowPolicy(s string) (OverflowPolicy, bool) {
+	for i, name := range overflowPolicyNames {
+		if name == s {
+			return OverflowPolicy(i), true
+		}
+	}
+	return 0, false
+}
+
+// Limit bounds the values clients push to a queue
+type Limit struct {
+	Capacity int // Zero for none
+	Policy   OverflowPolicy
+}
+
+// Fits reports whether n values fit next to length values, waiters of an
+// empty queue take values without them being stored
+func (l Limit) Fits(length, waiters, n int) bool {
+	return l.Capacity == 0 || length+n-waiters <= l.Capacity
+}
+
+// Blocks reports whether the push waits for room or fails right away
+func (l Limit) Blocks(n int, timeout *time.Time) bool {
+	return l.Policy == OverflowBlock && timeout != nil && n <= l.Capacity
+}
+
 const (
 	QueueTypePrimitive = iota
 	QueueTypeMapOfChannel
 	QueueTypeChannel
+	QueueTypePriority
 )
 
 func QueueFactory(t int) Queue {
@@ -29,11 +99,13 @@ func QueueFactory(t int) Queue {
 	case QueueTypePrimitive:
 		q := new(OneToManyQueuePrimitive)
 		q.Queue = make(map[string]*PrimitiveQueue, 0)
+		q.limits = make(map[string]Limit)
 		return q
 
 	case QueueTypeMapOfChannel:
 		q := new(MapOfChannel)
 		q.Queue = make(map[string]*MapOfChannelQueue, 0)
+		q.limits = make(map[string]Limit)
 		return q
 
 	case QueueTypeChannel:
@@ -41,6 +113,12 @@ func QueueFactory(t int) Queue {
 		q.RequestQueue = make(chan QueueRequestInfo, 100)
 		go q.Manager()
 		return q
+
+	case QueueTypePriority:
+		q := new(OneToManyQueuePriority)
+		q.Queue = make(map[string]*PriorityQueue, 0)
+		q.limits = make(map[string]Limit)
+		return q
 	default:
 		panic("NOT IMPLEMENTED")
 	}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Reply is the protocol independent result of a command.
+// It holds one of string, int64, []Reply, Map, Push, Status or nil for no
+// value.
+type Reply interface{}
+
+// Status is a short acknowledgement such as "OK", as opposed to a stored value
+type Status string
+
+const StatusOK Status = "OK"
+
+// Map holds alternating keys and values, in the order they are sent
+type Map []Reply
+
+// Push is data the server sends on its own, such as published messages. It is
+// a push frame for RESP3 clients and an array for RESP2 ones.
+type Push []Reply
+
+// Booleans are sent as 1 or 0, the way Redis does
+func boolReply(b bool) Reply {
+	if b {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+// replyValue renders a reply for JSON clients, which expect strings or arrays
+// of strings. StatusOK renders as no value, like the acknowledgements these
+// clients always got, and missing array elements as null.
+func replyValue(r Reply) any {
+	switch r := r.(type) {
+	case string:
+		return r
+	case int64:
+		return strconv.FormatInt(r, 10)
+	case []Reply:
+		values := make([]any, len(r))
+		for i, v := range r {
+			values[i] = replyValue(v)
+		}
+		return values
+	case Map:
+		return replyValue([]Reply(r))
+	case Status:
+		if r == StatusOK {
+			return nil
+		}
+		return string(r)
+	case nil:
+		return nil
+	default:
+		return fmt.Sprint(r)
+	}
+}
+
+// TypedReply is the JSON form of a reply, telling an empty string from a
+// null and a number from a string. Value is a string, an integer, an array
+// of TypedReply or an object of TypedReply, as named by Type.
+type TypedReply struct {
+	Type  string      `json:"type"`
+	Value any         `json:"value,omitempty"`
+	Error *ErrorReply `json:"error,omitempty"`
+}
+
+type ErrorReply struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeArray   = "array"
+	TypeMap     = "map"
+	TypeNull    = "null"
+	TypeError   = "error"
+)
+
+func typedReply(r Reply) TypedReply {
+	switch r := r.(type) {
+	case string:
+		return TypedReply{Type: TypeString, Value: r}
+	case Status:
+		return TypedReply{Type: TypeString, Value: string(r)}
+	case int64:
+		return TypedReply{Type: TypeInteger, Value: r}
+	case []Reply:
+		values := make([]TypedReply, len(r))
+		for i, v := range r {
+			values[i] = typedReply(v)
+		}
+		return TypedReply{Type: TypeArray, Value: values}
+	case Map:
+		values := make(map[string]TypedReply, len(r)/2)
+		for i := 0; i+1 < len(r); i += 2 {
+			values[fmt.Sprint(replyValue(r[i]))] = typedReply(r[i+1])
+		}
+		return TypedReply{Type: TypeMap, Value: values}
+	case nil:
+		return TypedReply{Type: TypeNull}
+	default:
+		return TypedReply{Type: TypeString, Value: fmt.Sprint(r)}
+	}
+}
+
+func errorResponse(err error, fallbackCode string) TypedReply {
+	return TypedReply{
+		Type: TypeError,
+		Error: &ErrorReply{
+			Code:    errorCode(err, fallbackCode),
+			Message: err.Error(),
+		},
+	}
+}
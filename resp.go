@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	RESP2 = 2
+	RESP3 = 3
+
+	maxInlineLength = 64 * 1024
+	maxBulkLength   = 512 * 1024 * 1024
+	maxArrayLength  = 1024 * 1024
+)
+
+var (
+	ErrorProtocol = errors.New("Protocol error")
+)
+
+func protocolError(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrorProtocol, fmt.Sprintf(format, a...))
+}
+
+// readRESPCommand reads one command, either a RESP array of bulk strings or
+// an inline command line as typed into telnet.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[0] != '*' {
+		line, err := readRESPLine(r, maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+		args, err := Tokenize(line)
+		if err != nil {
+			return nil, protocolError("%s", err)
+		}
+		return args, nil
+	}
+
+	line, err := readRESPLine(r, maxInlineLength)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > maxArrayLength {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+
+	args := make([]string, 0, minInt(count, 1024))
+	for i := 0; i < count; i++ {
+		line, err := readRESPLine(r, maxInlineLength)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$', got '%.1s'", line)
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLength {
+			return nil, protocolError("invalid bulk length")
+		}
+
+		// Grown as the bytes arrive, a declared length costs nothing until
+		// the client actually sends that much
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(size)+2); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		bulk := buf.Bytes()
+		if bulk[size] != '\r' || bulk[size+1] != '\n' {
+			return nil, protocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, string(bulk[:size]))
+	}
+
+	return args, nil
+}
+
+// Reads a CRLF (or bare LF) terminated line without the terminator.
+// A line cut short by the end of input is io.ErrUnexpectedEOF.
+func readRESPLine(r *bufio.Reader, limit int) (string, error) {
+	var sb strings.Builder
+	for {
+		chunk, err := r.ReadSlice('\n')
+		sb.Write(chunk)
+		if sb.Len() > limit {
+			return "", protocolError("too big inline request")
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && sb.Len() > 0:
+			return "", io.ErrUnexpectedEOF
+		case err != nil:
+			return "", err
+		}
+
+		line := strings.TrimSuffix(sb.String(), "\n")
+		return strings.TrimSuffix(line, "\r"), nil
+	}
+}
+
+func writeRESPReply(w *bufio.Writer, proto int, r Reply) {
+	switch r := r.(type) {
+	case nil:
+		if proto == RESP3 {
+			w.WriteString("_\r\n")
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+
+	case Status:
+		w.WriteString("+")
+		w.WriteString(string(r))
+		w.WriteString("\r\n")
+
+	case string:
+		fmt.Fprintf(w, "$%d\r\n", len(r))
+		w.WriteString(r)
+		w.WriteString("\r\n")
+
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", r)
+
+	case []Reply:
+		fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, v := range r {
+			writeRESPReply(w, proto, v)
+		}
+
+	case Push:
+		if proto == RESP3 {
+			fmt.Fprintf(w, ">%d\r\n", len(r))
+		} else {
+			fmt.Fprintf(w, "*%d\r\n", len(r))
+		}
+		for _, v := range r {
+			writeRESPReply(w, proto, v)
+		}
+
+	case Map:
+		if proto == RESP3 {
+			fmt.Fprintf(w, "%%%d\r\n", len(r)/2)
+		} else {
+			fmt.Fprintf(w, "*%d\r\n", len(r))
+		}
+		for _, v := range r {
+			writeRESPReply(w, proto, v)
+		}
+
+	default:
+		writeRESPError(w, fmt.Sprintf("ERR unsupported reply %T", r))
+	}
+}
+
+// Error messages must not contain newlines, the first word is the error kind
+func writeRESPError(w *bufio.Writer, msg string) {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	w.WriteString("-")
+	w.WriteString(msg)
+	w.WriteString("\r\n")
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var lastClientID atomic.Int64
+
+type respClient struct {
+	id    int64
+	proto int
+
+	// Set by the first subscription, its messages are written by forward
+	sub           *Subscriber
+	subscriptions int
+	// Guards the writer once messages are forwarded
+	wlock sync.Mutex
+}
+
+// ListenRESP serves the store over the Redis protocol until the listener fails
+func ListenRESP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handleRESPConn(conn)
+	}
+}
+
+func handleRESPConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	client := &respClient{
+		id:    lastClientID.Add(1),
+		proto: RESP2,
+	}
+	defer func() {
+		if client.sub != nil {
+			storage.CloseSubscriber(client.sub)
+		}
+	}()
+
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			if errors.Is(err, ErrorProtocol) {
+				writeRESPError(w, "ERR "+err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := client.execute(conn, w, args)
+
+		// Pipelined commands are answered in one write once the input is drained
+		if quit || r.Buffered() == 0 {
+			client.wlock.Lock()
+			err := w.Flush()
+			client.wlock.Unlock()
+			if err != nil {
+				log.Print(err.Error())
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// Commands a RESP2 client can send while subscribed, its replies and
+// messages would be indistinguishable otherwise
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+// Returns true if the connection should be closed
+func (c *respClient) execute(conn net.Conn, w *bufio.Writer, args []string) bool {
+	name := strings.ToUpper(args[0])
+	if c.subscriptions > 0 && c.proto == RESP2 && !subscribedCommands[name] {
+		c.writeError(w, "ERR Can't execute '"+strings.ToLower(args[0])+"': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+		return false
+	}
+
+	switch name {
+	case "PING":
+		switch {
+		case c.subscriptions > 0 && c.proto == RESP2:
+			message := ""
+			if len(args) > 1 {
+				message = args[1]
+			}
+			c.write(w, []Reply{"pong", message})
+		case len(args) > 1:
+			c.write(w, args[1])
+		default:
+			c.write(w, Status("PONG"))
+		}
+		return false
+
+	case "QUIT":
+		c.write(w, StatusOK)
+		return true
+
+	case "HELLO":
+		c.hello(w, args[1:])
+		return false
+
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		c.pubsub(conn, w, name, args[1:])
+		return false
+	}
+
+	command, err := ParseArgs(args)
+	if err != nil {
+		c.writeError(w, "ERR "+err.Error())
+		return false
+	}
+
+	value, err := processCommand(command)
+	switch {
+	case repliesNil(command) && (errors.Is(err, ErrorKeyNotFound) ||
+		errors.Is(err, ErrorKeyExists) ||
+		errors.Is(err, ErrorEmptyQueue)):
+		// Redis clients expect a null rather than an error for these
+		c.write(w, nil)
+	case errors.Is(err, ErrorWrongType):
+		c.writeError(w, "WRONGTYPE "+err.Error())
+	case err != nil:
+		c.writeError(w, "ERR "+err.Error())
+	default:
+		c.write(w, value)
+	}
+	return false
+}
+
+// Commands Redis answers with a null for a missing key, field or member, an
+// empty queue, a timeout or a SET condition that doesn't hold. Others fail
+// with the error, such as XGROUP CREATE on a missing stream.
+func repliesNil(c Command) bool {
+	switch c.(type) {
+	case Set, Get, HGet, ZScore, ZRank, BZPop,
+		QPop, BQPop, QPopBack, QPeek, QMove:
+		return true
+	}
+	return false
+}
+
+func (c *respClient) write(w *bufio.Writer, r Reply) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	writeRESPReply(w, c.proto, r)
+}
+
+func (c *respClient) writeError(w *bufio.Writer, msg string) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	writeRESPError(w, msg)
+}
+
+// Every channel or pattern is confirmed with a push of the command, the name
+// and the number of subscriptions left
+func (c *respClient) pubsub(conn net.Conn, w *bufio.Writer, command string, names []string) {
+	if len(names) == 0 && (command == "SUBSCRIBE" || command == "PSUBSCRIBE") {
+		c.writeError(w, "ERR wrong number of arguments for '"+strings.ToLower(command)+"' command")
+		return
+	}
+
+	if c.sub == nil {
+		c.sub = NewSubscriber(subscriberBuffer)
+		go c.forward(conn, w)
+	}
+
+	var changes []SubscriptionChange
+	switch command {
+	case "SUBSCRIBE":
+		changes = storage.Subscribe(c.sub, names...)
+	case "PSUBSCRIBE":
+		changes = storage.PSubscribe(c.sub, names...)
+	case "UNSUBSCRIBE":
+		changes = storage.Unsubscribe(c.sub, names...)
+	case "PUNSUBSCRIBE":
+		changes = storage.PUnsubscribe(c.sub, names...)
+	}
+
+	kind := strings.ToLower(command)
+	// Unsubscribing from everything while subscribed to nothing
+	if len(changes) == 0 {
+		c.write(w, Push{kind, nil, int64(c.subscriptions)})
+		return
+	}
+	for _, change := range changes {
+		c.subscriptions = change.Count
+		c.write(w, Push{kind, change.Name, int64(change.Count)})
+	}
+}
+
+// Writes the messages of the subscriber until it is closed, which either
+// the connection ending or the client falling behind does. The latter
+// closes the connection.
+func (c *respClient) forward(conn net.Conn, w *bufio.Writer) {
+	for m := range c.sub.Messages() {
+		reply := Push{"message", m.Channel, m.Payload}
+		if m.Pattern != "" {
+			reply = Push{"pmessage", m.Pattern, m.Channel, m.Payload}
+		}
+
+		c.wlock.Lock()
+		writeRESPReply(w, c.proto, reply)
+		var err error
+		// Messages that came in together go out together
+		if len(c.sub.Messages()) == 0 {
+			err = w.Flush()
+		}
+		c.wlock.Unlock()
+		if err != nil {
+			break
+		}
+	}
+	conn.Close()
+}
+
+func (c *respClient) hello(w *bufio.Writer, args []string) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(args[0])
+		if err != nil || (proto != RESP2 && proto != RESP3) {
+			c.writeError(w, "NOPROTO unsupported protocol version")
+			return
+		}
+		// Messages are written in the protocol of the moment
+		c.wlock.Lock()
+		c.proto = proto
+		c.wlock.Unlock()
+	}
+
+	c.write(w, Map{
+		"server", "backendInternAssignment",
+		"version", "1.0.0",
+		"proto", int64(c.proto),
+		"id", c.id,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []Reply{},
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadRESPCommand(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output []string
+	}{
+		{"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$11\r\nhello world\r\n", []string{"SET", "a", "hello world"}},
+		{"*2\r\n$3\r\nGET\r\n$0\r\n\r\n", []string{"GET", ""}},
+		{"SET a \"hello world\"\r\n", []string{"SET", "a", "hello world"}},
+		{"PING\n", []string{"PING"}},
+	}
+
+	for idx, tc := range testCases {
+		args, err := readRESPCommand(bufio.NewReader(strings.NewReader(tc.input)))
+		if err != nil {
+			t.Errorf("%d: %q %+v", idx, tc.input, err)
+			continue
+		}
+
+		if strings.Join(args, "|") != strings.Join(tc.output, "|") {
+			t.Errorf("%d: Expected %q, got %q", idx, tc.output, args)
+		}
+	}
+}
+
+func TestReadRESPTruncatedBulk(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	input := "*1\r\n$" + strconv.Itoa(maxBulkLength) + "\r\nshort"
+	_, err := readRESPCommand(bufio.NewReader(strings.NewReader(input)))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected unexpected EOF, got %+v", err)
+	}
+
+	// Only what was sent is buffered, not the declared length
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Fatalf("Expected a small allocation, got %d bytes", allocated)
+	}
+}
+
+func TestRESPConnection(t *testing.T) {
+	storage = NewStorage()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go handleRESPConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Everything is sent at once to exercise pipelining
+	go io.WriteString(client, ""+
+		"*3\r\n$3\r\nSET\r\n$5\r\nhello\r\n$5\r\nworld\r\n"+
+		"*2\r\n$3\r\nGET\r\n$5\r\nhello\r\n"+
+		"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n"+
+		"QPUSH list_a a\r\n"+
+		"*2\r\n$4\r\nQPOP\r\n$6\r\nlist_a\r\n"+
+		"XGROUP CREATE events workers $\r\n"+
+		"ZADD board NX INCR 1 ann\r\n"+
+		"ZADD board NX INCR 1 ann\r\n"+
+		"*1\r\n$3\r\nFOO\r\n"+
+		"*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n")
+
+	expected := "" +
+		"+OK\r\n" +
+		"$5\r\nworld\r\n" +
+		"$-1\r\n" +
+		"+OK\r\n" +
+		"$1\r\na\r\n" +
+		"-ERR key not found\r\n" +
+		"$1\r\n1\r\n" +
+		"$-1\r\n" +
+		"-ERR invalid command\r\n"
+
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf)
+	}
+
+	r := bufio.NewReader(client)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "%7\r\n" {
+		t.Fatalf("Expected RESP3 map, got %q", line)
+	}
+}
+
+func TestRESPSubscribe(t *testing.T) {
+	storage = NewStorage()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go handleRESPConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(client)
+
+	expect := func(expected string) {
+		t.Helper()
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != expected {
+			t.Fatalf("Expected %q, got %q", expected, buf)
+		}
+	}
+
+	io.WriteString(client, "SUBSCRIBE news sport\r\n")
+	expect("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n" +
+		"*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n")
+
+	// RESP2 clients can only manage their subscriptions
+	io.WriteString(client, "GET hello\r\n")
+	expect("-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n")
+	io.WriteString(client, "PING\r\n")
+	expect("*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+
+	go storage.Publish("news", "hello")
+	expect("*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+
+	io.WriteString(client, "UNSUBSCRIBE\r\n")
+	expect("*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n" +
+		"*3\r\n$11\r\nunsubscribe\r\n$5\r\nsport\r\n:0\r\n")
+
+	// RESP3 messages are push frames, and any command is allowed
+	io.WriteString(client, "HELLO 3\r\n")
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7*2; i++ {
+		readRESPValue(t, r)
+	}
+	io.WriteString(client, "PSUBSCRIBE n*\r\nGET missing\r\n")
+	expect(">3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:1\r\n_\r\n")
+
+	go storage.Publish("news", "again")
+	expect(">4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nagain\r\n")
+}
+
+// Skips one value of the HELLO reply
+func readRESPValue(t *testing.T, r *bufio.Reader) {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		io.ReadFull(r, make([]byte, n+2))
+	case '*':
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		for i := 0; i < n; i++ {
+			readRESPValue(t, r)
+		}
+	}
+}
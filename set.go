@@ -0,0 +1,296 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// How SCombine combines sets
+type SetOp int
+
+const (
+	// Members of every set
+	SetInter SetOp = iota
+	// Members of any set
+	SetUnion
+	// Members of the first set and of none of the others
+	SetDiff
+)
+
+// Returns the set at key, nil if there is none. Must be called with kvLock
+// held.
+func (s *Storage) setLocked(key string) (map[string]struct{}, error) {
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		return nil, nil
+	}
+	if v.set == nil {
+		return nil, ErrorWrongType
+	}
+	return v.set, nil
+}
+
+// SAdd adds the members to the set at key, creating it if needed. Returns how
+// many were new.
+func (s *Storage) SAdd(key string, members ...string) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	set, err := s.setLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	if set == nil {
+		set = make(map[string]struct{})
+		s.replaceLocked(key, Value{set: set})
+	}
+
+	entry := []string{"SADD", key}
+	for _, m := range members {
+		if _, found := set[m]; !found {
+			set[m] = struct{}{}
+			entry = append(entry, m)
+		}
+	}
+	if len(entry) == 2 {
+		return 0, nil
+	}
+	s.log(entry...)
+	return len(entry) - 2, nil
+}
+
+// SRem removes the members and returns how many of them were there. The key
+// is removed with its last member.
+func (s *Storage) SRem(key string, members ...string) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	set, err := s.setLocked(key)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := s.removeMembersLocked(key, set, members)
+	return len(removed), nil
+}
+
+// Returns the members that were there. Must be called with kvLock held.
+func (s *Storage) removeMembersLocked(key string, set map[string]struct{}, members []string) []string {
+	entry := []string{"SREM", key}
+	for _, m := range members {
+		if _, found := set[m]; found {
+			delete(set, m)
+			entry = append(entry, m)
+		}
+	}
+	if len(entry) == 2 {
+		return nil
+	}
+
+	if len(set) == 0 {
+		delete(s.KV, key)
+	}
+	s.log(entry...)
+	return entry[2:]
+}
+
+func (s *Storage) SIsMember(key, member string) (bool, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	set, err := s.setLocked(key)
+	if err != nil {
+		return false, err
+	}
+	_, found := set[member]
+	return found, nil
+}
+
+// SMembers returns the members in order
+func (s *Storage) SMembers(key string) ([]string, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	set, err := s.setLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	return sortedMembers(set), nil
+}
+
+func (s *Storage) SCard(key string) (int, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	set, err := s.setLocked(key)
+	return len(set), err
+}
+
+// SPop removes and returns up to count random members
+func (s *Storage) SPop(key string, count int) ([]string, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	set, err := s.setLocked(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logged as the members removed, so replaying doesn't pick others
+	popped := s.removeMembersLocked(key, set, randomMembers(set, count))
+	if popped == nil {
+		popped = []string{}
+	}
+	return popped, nil
+}
+
+// Most members SRANDMEMBER returns with repeats, the reply is built in memory
+const maxRandomMembers = 1 << 20
+
+// SRandMember returns up to count distinct random members. A negative count
+// returns exactly -count members, which may repeat, at most maxRandomMembers.
+func (s *Storage) SRandMember(key string, count int) ([]string, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	set, err := s.setLocked(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if count >= 0 || len(set) == 0 {
+		return randomMembers(set, count), nil
+	}
+	members := sortedMembers(set)
+	picked := make([]string, -count)
+	for i := range picked {
+		picked[i] = members[rand.Intn(len(members))]
+	}
+	return picked, nil
+}
+
+// Up to count distinct members picked at random
+func randomMembers(set map[string]struct{}, count int) []string {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	if count > len(members) {
+		count = len(members)
+	}
+
+	// The first count steps of a Fisher-Yates shuffle
+	for i := 0; i < count; i++ {
+		j := i + rand.Intn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	return members[:count]
+}
+
+func sortedMembers(set map[string]struct{}) []string {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// SCombine returns the members of the sets at keys combined by op, in order.
+// Missing keys are empty sets.
+func (s *Storage) SCombine(op SetOp, keys ...string) ([]string, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	result, err := s.combineLocked(op, keys)
+	if err != nil {
+		return nil, err
+	}
+	return sortedMembers(result), nil
+}
+
+// SCombineStore replaces the value at destination with the sets at keys
+// combined by op, removing it if the result is empty. Returns the number of
+// members stored.
+func (s *Storage) SCombineStore(op SetOp, destination string, keys ...string) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	result, err := s.combineLocked(op, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(result) == 0 {
+		if _, found := s.KV[destination]; found {
+			s.dropLocked(destination)
+			s.log("DEL", destination)
+		}
+		return 0, nil
+	}
+
+	s.replaceLocked(destination, Value{set: result})
+	// The result rather than the command, the sources could have expired by
+	// the time the log is replayed
+	s.log(append([]string{"SSTORE", destination}, sortedMembers(result)...)...)
+	return len(result), nil
+}
+
+// Returns a new set. Must be called with kvLock held.
+func (s *Storage) combineLocked(op SetOp, keys []string) (map[string]struct{}, error) {
+	sets := make([]map[string]struct{}, len(keys))
+	for i, key := range keys {
+		set, err := s.setLocked(key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	result := make(map[string]struct{})
+	switch op {
+	case SetInter:
+		// Only members of the smallest set can be in all of them
+		smallest := sets[0]
+		for _, set := range sets[1:] {
+			if len(set) < len(smallest) {
+				smallest = set
+			}
+		}
+	members:
+		for m := range smallest {
+			for _, set := range sets {
+				if _, found := set[m]; !found {
+					continue members
+				}
+			}
+			result[m] = struct{}{}
+		}
+
+	case SetUnion:
+		for _, set := range sets {
+			for m := range set {
+				result[m] = struct{}{}
+			}
+		}
+
+	case SetDiff:
+		for m := range sets[0] {
+			result[m] = struct{}{}
+		}
+		for _, set := range sets[1:] {
+			for m := range set {
+				delete(result, m)
+			}
+		}
+	}
+	return result, nil
+}
+
+func newSet(members []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(members))
+	for _, m := range members {
+		set[m] = struct{}{}
+	}
+	return set
+}
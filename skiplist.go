@@ -0,0 +1,237 @@
+package main
+
+import (
+	"math/rand"
+)
+
+const (
+	skiplistMaxLevel = 32
+	// Chance of a node being on the next level up
+	skiplistP = 0.25
+)
+
+// Members of a sorted set ordered by score, then by member among equal
+// scores. Every forward pointer knows how many nodes it skips, which makes
+// finding a rank or the node at a rank O(log n).
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	// Nodes between this one and forward, counting forward
+	span int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// Whether the node sorts before score and member
+func (n *skiplistNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// Inserts a member that isn't in the list yet
+func (zsl *skiplist) insert(score float64, member string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		// update[i] is at rank[i], x ends up at rank[0]+1
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// Levels above the new node now skip one more
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+}
+
+// Returns false if the member with that score isn't in the list
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+	return true
+}
+
+// 1 based rank of the member with that score, 0 if it isn't in the list
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !(score < x.level[i].forward.score ||
+			(score == x.level[i].forward.score && member < x.level[i].forward.member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// Node at the 1 based rank, nil if out of range
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank && x != zsl.header {
+			return x
+		}
+	}
+	return nil
+}
+
+// First node not below the range, which may be above it too. The nodes below
+// must all come first.
+func (zsl *skiplist) firstFrom(r zrange) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.below(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	return x.level[0].forward
+}
+
+// Last node not above the range, nil if there is none
+func (zsl *skiplist) lastUpTo(r zrange) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.above(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header {
+		return nil
+	}
+	return x
+}
+
+// A range of nodes, by score or by member
+type zrange interface {
+	below(n *skiplistNode) bool
+	above(n *skiplistNode) bool
+}
+
+// Scores from Min to Max, each excluded if its flag is set
+type ScoreRange struct {
+	Min, Max                   float64
+	MinExclusive, MaxExclusive bool
+}
+
+func (r ScoreRange) below(n *skiplistNode) bool {
+	return n.score < r.Min || (r.MinExclusive && n.score == r.Min)
+}
+
+func (r ScoreRange) above(n *skiplistNode) bool {
+	return n.score > r.Max || (r.MaxExclusive && n.score == r.Max)
+}
+
+// Members from Min to Max, for sets where every score is the same. Unbounded
+// ends include every member on that side.
+type LexRange struct {
+	Min, Max                   string
+	MinExclusive, MaxExclusive bool
+	MinUnbounded, MaxUnbounded bool
+}
+
+func (r LexRange) below(n *skiplistNode) bool {
+	return !r.MinUnbounded && (n.member < r.Min || (r.MinExclusive && n.member == r.Min))
+}
+
+func (r LexRange) above(n *skiplistNode) bool {
+	return !r.MaxUnbounded && (n.member > r.Max || (r.MaxExclusive && n.member == r.Max))
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot layout, integers are little endian and strings are a uvarint
+// length followed by the bytes:
+//
+//	magic "BIASNAP" | version uint16 | records... | recordEOF | crc32 of everything before it
+//
+// recordString:     key, value, expiry as unix milliseconds varint (0 for none)
+// recordHash:       key, expiry as for recordString, uvarint count, fields and values
+// recordSet:        key, expiry as for recordString, uvarint count, members
+// recordZSet:       key, expiry as for recordString, uvarint count, members and scores in score order
+// recordQueue:      key, uvarint count, values in the order they are popped
+// recordLease:      key, receipt, value, deadline as unix milliseconds varint, uvarint deliveries, varint priority
+// recordDeliveries: key, uvarint count, deliveries of the queue values in order
+// recordPriorities: key, uvarint count, varint priorities of the queue values in order
+// recordDeadLetter: key, dead letter key, uvarint max deliveries
+// recordDelayed:    key, due time as unix milliseconds varint, uvarint count, values, varint priority
+// recordCapacity:   key, uvarint capacity, uvarint overflow policy
+// recordStream:     key, last ID, uvarint count, entries as ID, uvarint field count, fields and values
+// recordGroup:      key, group, last delivered ID, uvarint count, pending entries as ID, consumer, delivery time as unix milliseconds varint, uvarint deliveries
+// recordExpiry:     key of a queue or stream, expiry as unix milliseconds varint
+//
+// IDs are two uvarints, scores the bits of a float64 as a little endian
+// uint64.
+const (
+	snapshotMagic   = "BIASNAP"
+	snapshotVersion = 1
+
+	recordEOF        byte = 0xFF
+	recordString     byte = 1
+	recordQueue      byte = 2
+	recordLease      byte = 3
+	recordDeliveries byte = 4
+	recordDeadLetter byte = 5
+	recordDelayed    byte = 6
+	recordPriorities byte = 7
+	recordCapacity   byte = 8
+	recordStream     byte = 9
+	recordGroup      byte = 10
+	recordHash       byte = 11
+	recordSet        byte = 12
+	recordZSet       byte = 13
+	recordExpiry     byte = 14
+)
+
+var (
+	ErrorSnapshotDisabled    = errors.New("snapshots are disabled")
+	ErrorSaveInProgress      = errors.New("background save already in progress")
+	ErrorSnapshotCorrupt     = errors.New("snapshot is corrupt")
+	ErrorSnapshotVersion     = errors.New("unsupported snapshot version")
+	ErrorSnapshotBadChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// EnableSnapshots sets where SAVE and BGSAVE write to
+func (s *Storage) EnableSnapshots(path string) {
+	s.lockAll()
+	defer s.unlockAll()
+	s.snapshotPath = path
+}
+
+// Save writes a snapshot of the current state. Like RewriteAOF the locks are
+// only held while copying the state, not while writing it.
+func (s *Storage) Save() error {
+	path, state, err := s.startSave()
+	if err != nil {
+		return err
+	}
+	defer s.saving.Store(false)
+
+	return writeSnapshot(path, state)
+}
+
+// BackgroundSave is Save without waiting for the writing
+func (s *Storage) BackgroundSave() error {
+	path, state, err := s.startSave()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer s.saving.Store(false)
+		if err := writeSnapshot(path, state); err != nil {
+			log.Print(err.Error())
+		}
+	}()
+	return nil
+}
+
+func (s *Storage) startSave() (string, storageState, error) {
+	s.lockAll()
+	defer s.unlockAll()
+
+	if s.snapshotPath == "" {
+		return "", storageState{}, ErrorSnapshotDisabled
+	}
+	if !s.saving.CompareAndSwap(false, true) {
+		return "", storageState{}, ErrorSaveInProgress
+	}
+
+	return s.snapshotPath, s.copyStateLocked(), nil
+}
+
+// The snapshot replaces the one at path only once it is fully on disk
+func writeSnapshot(path string, state storageState) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	if err := encodeSnapshot(w, state); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+type snapshotWriter struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(p)
+	}
+}
+
+func (sw *snapshotWriter) byte(b byte) {
+	sw.write([]byte{b})
+}
+
+func (sw *snapshotWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(sw.buf[:], v)
+	sw.write(sw.buf[:n])
+}
+
+func (sw *snapshotWriter) varint(v int64) {
+	n := binary.PutVarint(sw.buf[:], v)
+	sw.write(sw.buf[:n])
+}
+
+func (sw *snapshotWriter) string(v string) {
+	sw.uvarint(uint64(len(v)))
+	sw.write([]byte(v))
+}
+
+// Zero for none
+func (sw *snapshotWriter) expiry(t *time.Time) {
+	if t == nil {
+		sw.varint(0)
+	} else {
+		sw.varint(t.UnixMilli())
+	}
+}
+
+func (sw *snapshotWriter) score(v float64) {
+	sw.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func (sw *snapshotWriter) streamID(id StreamID) {
+	sw.uvarint(id.ms)
+	sw.uvarint(id.seq)
+}
+
+func encodeSnapshot(w io.Writer, state storageState) error {
+	checksum := crc32.NewIEEE()
+	sw := &snapshotWriter{w: io.MultiWriter(w, checksum)}
+
+	sw.write([]byte(snapshotMagic))
+	sw.write(binary.LittleEndian.AppendUint16(nil, snapshotVersion))
+
+	for k, v := range state.KV {
+		switch {
+		case v.hash != nil:
+			sw.byte(recordHash)
+			sw.string(k)
+			sw.expiry(v.expiry)
+			sw.uvarint(uint64(len(v.hash)))
+			for _, field := range sortedFields(v.hash) {
+				sw.string(field)
+				sw.string(v.hash[field])
+			}
+
+		case v.set != nil:
+			sw.byte(recordSet)
+			sw.string(k)
+			sw.expiry(v.expiry)
+			sw.uvarint(uint64(len(v.set)))
+			for _, m := range sortedMembers(v.set) {
+				sw.string(m)
+			}
+
+		case v.zset != nil:
+			sw.byte(recordZSet)
+			sw.string(k)
+			sw.expiry(v.expiry)
+			sw.uvarint(uint64(v.zset.len()))
+			for _, m := range v.zset.members() {
+				sw.string(m.Member)
+				sw.score(m.Score)
+			}
+
+		default:
+			sw.byte(recordString)
+			sw.string(k)
+			sw.string(v.value)
+			sw.expiry(v.expiry)
+		}
+	}
+
+	for k, values := range state.Queue {
+		sw.byte(recordQueue)
+		sw.string(k)
+		sw.uvarint(uint64(len(values)))
+		for _, v := range values {
+			sw.string(v)
+		}
+	}
+
+	for _, l := range state.Leases {
+		sw.byte(recordLease)
+		sw.string(l.key)
+		sw.string(l.receipt)
+		sw.string(l.node.value)
+		sw.varint(l.deadline.UnixMilli())
+		sw.uvarint(uint64(l.node.deliveries))
+		sw.varint(int64(l.node.priority))
+	}
+
+	for k, priorities := range state.Priorities {
+		sw.byte(recordPriorities)
+		sw.string(k)
+		sw.uvarint(uint64(len(priorities)))
+		for _, n := range priorities {
+			sw.varint(int64(n))
+		}
+	}
+
+	for k, deliveries := range state.Deliveries {
+		sw.byte(recordDeliveries)
+		sw.string(k)
+		sw.uvarint(uint64(len(deliveries)))
+		for _, n := range deliveries {
+			sw.uvarint(uint64(n))
+		}
+	}
+
+	for k, c := range state.DeadLetters {
+		sw.byte(recordDeadLetter)
+		sw.string(k)
+		sw.string(c.key)
+		sw.uvarint(uint64(c.maxDeliveries))
+	}
+
+	for k, l := range state.Limits {
+		sw.byte(recordCapacity)
+		sw.string(k)
+		sw.uvarint(uint64(l.Capacity))
+		sw.uvarint(uint64(l.Policy))
+	}
+
+	for k, st := range state.Streams {
+		sw.byte(recordStream)
+		sw.string(k)
+		sw.streamID(st.lastID)
+		sw.uvarint(uint64(len(st.entries)))
+		for _, e := range st.entries {
+			sw.streamID(e.ID)
+			sw.uvarint(uint64(len(e.Fields)))
+			for _, f := range e.Fields {
+				sw.string(f)
+			}
+		}
+
+		for name, g := range st.groups {
+			sw.byte(recordGroup)
+			sw.string(k)
+			sw.string(name)
+			sw.streamID(g.lastDelivered)
+			sw.uvarint(uint64(len(g.pending)))
+			for _, id := range g.pendingIDs("") {
+				p := g.pending[id]
+				sw.streamID(id)
+				sw.string(p.consumer)
+				sw.varint(p.delivered.UnixMilli())
+				sw.uvarint(uint64(p.deliveries))
+			}
+		}
+	}
+
+	for k, at := range state.Expiries {
+		sw.byte(recordExpiry)
+		sw.string(k)
+		sw.varint(at.UnixMilli())
+	}
+
+	for _, d := range state.Delayed {
+		sw.byte(recordDelayed)
+		sw.string(d.key)
+		sw.varint(d.at.UnixMilli())
+		sw.uvarint(uint64(len(d.values)))
+		for _, v := range d.values {
+			sw.string(v)
+		}
+		sw.varint(int64(d.priority))
+	}
+
+	sw.byte(recordEOF)
+	if sw.err != nil {
+		return sw.err
+	}
+
+	_, err := w.Write(binary.LittleEndian.AppendUint32(nil, checksum.Sum32()))
+	return err
+}
+
+// LoadSnapshot applies the snapshot at path, dropping keys that expired since
+// it was written. Nothing is applied unless the whole snapshot is valid.
+func (s *Storage) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	state, err := decodeSnapshot(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for k, v := range state.KV {
+		switch {
+		case v.Expired():
+		case v.isString():
+			s.Set(k, v.value, v.expiry)
+		default:
+			s.restoreValue(k, v)
+		}
+	}
+	for k, values := range state.Queue {
+		priorityRuns(values, state.Priorities[k], func(values []string, priority int) {
+			s.restorePush(k, values, priority, false)
+		})
+	}
+	// Checked against the queues by decodeSnapshot
+	for k, deliveries := range state.Deliveries {
+		s.setDeliveries(k, deliveries)
+	}
+	for k, c := range state.DeadLetters {
+		s.restoreDeadLetter(k, c.key, c.maxDeliveries)
+	}
+	for k, l := range state.Limits {
+		s.QSetCapacity(k, l.Capacity, l.Policy)
+	}
+	for k, st := range state.Streams {
+		s.restoreStream(k, st)
+	}
+	for k, at := range state.Expiries {
+		s.Expire(k, at)
+	}
+	// Delayed pushes and leases that are due are handled by the queue timers
+	for _, d := range state.Delayed {
+		s.restoreDelayed(d.key, d.values, d.priority, d.at)
+	}
+	for _, l := range state.Leases {
+		s.restoreLease(l.key, l.node.value, l.node.priority, l.node.deliveries, l.receipt, l.deadline)
+	}
+	return nil
+}
+
+func decodeSnapshot(data []byte) (storageState, error) {
+	state := storageState{
+		KV:          make(map[string]Value),
+		Queue:       make(map[string][]string),
+		Priorities:  make(map[string][]int),
+		Deliveries:  make(map[string][]int),
+		DeadLetters: make(map[string]deadLetterConfig),
+		Limits:      make(map[string]queueLimit),
+		Streams:     make(map[string]streamState),
+		Expiries:    make(map[string]time.Time),
+	}
+
+	header := len(snapshotMagic) + 2
+	if len(data) < header+1+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return state, ErrorSnapshotCorrupt
+	}
+	if binary.LittleEndian.Uint16(data[len(snapshotMagic):]) != snapshotVersion {
+		return state, ErrorSnapshotVersion
+	}
+
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return state, ErrorSnapshotBadChecksum
+	}
+
+	r := &snapshotReader{r: bytes.NewReader(body[header:])}
+	for {
+		switch r.byte() {
+		case recordEOF:
+			if r.err != nil || r.r.Len() != 0 || !state.consistent() {
+				return state, ErrorSnapshotCorrupt
+			}
+			return state, nil
+
+		case recordString:
+			key := r.string()
+			v := Value{value: r.string()}
+			if ms := r.varint(); ms != 0 {
+				v.expiry = new(time.Time)
+				*v.expiry = time.UnixMilli(ms)
+			}
+			state.KV[key] = v
+
+		case recordHash:
+			key := r.string()
+			var v Value
+			if ms := r.varint(); ms != 0 {
+				v.expiry = new(time.Time)
+				*v.expiry = time.UnixMilli(ms)
+			}
+			count := r.uvarint()
+			if count == 0 || count > uint64(r.r.Len()) {
+				return state, ErrorSnapshotCorrupt
+			}
+			v.hash = make(map[string]string, count)
+			for i := uint64(0); i < count; i++ {
+				field := r.string()
+				v.hash[field] = r.string()
+			}
+			state.KV[key] = v
+
+		case recordSet:
+			key := r.string()
+			var v Value
+			if ms := r.varint(); ms != 0 {
+				v.expiry = new(time.Time)
+				*v.expiry = time.UnixMilli(ms)
+			}
+			count := r.uvarint()
+			if count == 0 || count > uint64(r.r.Len()) {
+				return state, ErrorSnapshotCorrupt
+			}
+			v.set = make(map[string]struct{}, count)
+			for i := uint64(0); i < count; i++ {
+				v.set[r.string()] = struct{}{}
+			}
+			state.KV[key] = v
+
+		case recordZSet:
+			key := r.string()
+			var v Value
+			if ms := r.varint(); ms != 0 {
+				v.expiry = new(time.Time)
+				*v.expiry = time.UnixMilli(ms)
+			}
+			count := r.uvarint()
+			if count == 0 || count > uint64(r.r.Len()) {
+				return state, ErrorSnapshotCorrupt
+			}
+			v.zset = newSortedSet()
+			for i := uint64(0); i < count; i++ {
+				member := r.string()
+				score := r.score()
+				if math.IsNaN(score) {
+					return state, ErrorSnapshotCorrupt
+				}
+				v.zset.set(member, score)
+			}
+			state.KV[key] = v
+
+		case recordQueue:
+			key := r.string()
+			count := r.uvarint()
+			if count > uint64(r.r.Len()) {
+				return state, ErrorSnapshotCorrupt
+			}
+			values := make([]string, 0, count)
+			for i := uint64(0); i < count; i++ {
+				values = append(values, r.string())
+			}
+			state.Queue[key] = values
+
+		case recordLease:
+			l := queueLease{key: r.string(), receipt: r.string()}
+			l.node = &QueueNode{value: r.string()}
+			l.deadline = time.UnixMilli(r.varint())
+			l.node.deliveries = int(r.uvarint())
+			l.node.priority = int(r.varint())
+			state.Leases = append(state.Leases, l)
+
+		case recordDeliveries:
+			key := r.string()
+			count := r.uvarint()
+			if count > uint64(r.r.Len()) {
+				return state, ErrorSnapshotCorrupt
+			}
+			deliveries := make([]int, 0, count)
+			for i := uint64(0); i < count; i++ {
+				deliveries = append(deliveries, int(r.uvarint()))
+			}
+			state.Deliveries[key] = deliveries
+
+		case recordDeadLetter:
+			key := r.string()
+			c := deadLetterConfig{key: r.string(), maxDeliveries: int(r.uvarint())}
+			state.DeadLetters[key] = c
+
+		case recordDelayed:
+			d := delayedPush{key: r.string(), at: time.UnixMilli(r.varint())}
+			count := r.uvarint()
+			if count == 0 || count > uint64(r.r.Len()) {
+				return state, ErrorSnapshotCorrupt
+			}
+			for i := uint64(0); i < count; i++ {
+				d.values = append(d.values, r.string())
+			}
+			d.priority = int(r.varint())
+			state.Delayed = append(state.Delayed, d)
+
+		case recordPriorities:
+			key := r.string()
+			count := r.uvarint()
+			if count > uint64(r.r.Len()) {
+				return state, ErrorSnapshotCorrupt
+			}
+			priorities := make([]int, 0, count)
+			for i := uint64(0); i < count; i++ {
+				priorities = append(priorities, int(r.varint()))
+			}
+			state.Priorities[key] = priorities
+
+		case recordCapacity:
+			key := r.string()
+			l := queueLimit{Capacity: int(r.uvarint())}
+			l.Policy = OverflowPolicy(r.uvarint())
+			if l.Capacity == 0 || !l.Policy.Valid() {
+				return state, ErrorSnapshotCorrupt
+			}
+			state.Limits[key] = l
+
+		case recordStream:
+			key := r.string()
+			st := streamState{lastID: r.streamID(), groups: make(map[string]consumerGroup)}
+			count := r.uvarint()
+			if count > uint64(r.r.Len()) {
+				return state, ErrorSnapshotCorrupt
+			}
+			for i := uint64(0); i < count; i++ {
+				e := StreamEntry{ID: r.streamID()}
+				fields := r.uvarint()
+				if fields > uint64(r.r.Len()) {
+					return state, ErrorSnapshotCorrupt
+				}
+				for j := uint64(0); j < fields; j++ {
+					e.Fields = append(e.Fields, r.string())
+				}
+				// Entries are in ID order, up to the last ID
+				if (i > 0 && !st.entries[i-1].ID.Less(e.ID)) || st.lastID.Less(e.ID) {
+					return state, ErrorSnapshotCorrupt
+				}
+				st.entries = append(st.entries, e)
+			}
+			state.Streams[key] = st
+
+		case recordGroup:
+			key := r.string()
+			st, found := state.Streams[key]
+			if !found {
+				return state, ErrorSnapshotCorrupt
+			}
+			name := r.string()
+			g := consumerGroup{lastDelivered: r.streamID(), pending: make(map[StreamID]*pendingEntry)}
+			count := r.uvarint()
+			if count > uint64(r.r.Len()) {
+				return state, ErrorSnapshotCorrupt
+			}
+			for i := uint64(0); i < count; i++ {
+				id := r.streamID()
+				p := &pendingEntry{consumer: r.string()}
+				p.delivered = time.UnixMilli(r.varint())
+				p.deliveries = int(r.uvarint())
+				g.pending[id] = p
+			}
+			st.groups[name] = g
+
+		case recordExpiry:
+			key := r.string()
+			state.Expiries[key] = time.UnixMilli(r.varint())
+
+		default:
+			return state, ErrorSnapshotCorrupt
+		}
+
+		if r.err != nil {
+			return state, ErrorSnapshotCorrupt
+		}
+	}
+}
+
+// Whether the records agree with each other, so that LoadSnapshot can apply
+// them without failing halfway. Every key has one type, expiry records are
+// for queues and streams, and priorities and deliveries have one entry per
+// value of their queue.
+func (state *storageState) consistent() bool {
+	for k := range state.KV {
+		if _, found := state.Queue[k]; found {
+			return false
+		}
+		if _, found := state.Streams[k]; found {
+			return false
+		}
+	}
+	for k := range state.Streams {
+		if _, found := state.Queue[k]; found {
+			return false
+		}
+	}
+	// Strings and the other types carry their own expiry
+	for k := range state.Expiries {
+		_, queue := state.Queue[k]
+		_, stream := state.Streams[k]
+		if !queue && !stream {
+			return false
+		}
+	}
+
+	for k, priorities := range state.Priorities {
+		if values, found := state.Queue[k]; !found || len(values) != len(priorities) {
+			return false
+		}
+	}
+	// Only queues with values are restored
+	for k, deliveries := range state.Deliveries {
+		if values := state.Queue[k]; len(values) == 0 || len(values) != len(deliveries) {
+			return false
+		}
+	}
+	return true
+}
+
+type snapshotReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (sr *snapshotReader) byte() byte {
+	if sr.err != nil {
+		return 0
+	}
+	var b byte
+	b, sr.err = sr.r.ReadByte()
+	return b
+}
+
+func (sr *snapshotReader) uvarint() uint64 {
+	if sr.err != nil {
+		return 0
+	}
+	var v uint64
+	v, sr.err = binary.ReadUvarint(sr.r)
+	return v
+}
+
+func (sr *snapshotReader) varint() int64 {
+	if sr.err != nil {
+		return 0
+	}
+	var v int64
+	v, sr.err = binary.ReadVarint(sr.r)
+	return v
+}
+
+func (sr *snapshotReader) string() string {
+	n := sr.uvarint()
+	if sr.err != nil {
+		return ""
+	}
+	if n > uint64(sr.r.Len()) {
+		sr.err = ErrorSnapshotCorrupt
+		return ""
+	}
+
+	buf := make([]byte, n)
+	_, sr.err = io.ReadFull(sr.r, buf)
+	return string(buf)
+}
+
+func (sr *snapshotReader) score() float64 {
+	if sr.err != nil {
+		return 0
+	}
+	var buf [8]byte
+	if _, sr.err = io.ReadFull(sr.r, buf[:]); sr.err != nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf[:]))
+}
+
+func (sr *snapshotReader) streamID() StreamID {
+	return StreamID{ms: sr.uvarint(), seq: sr.uvarint()}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.bia")
+
+	s := NewStorage()
+	if err := s.Save(); err != ErrorSnapshotDisabled {
+		t.Fatalf("Expected snapshots to be disabled, got %+v", err)
+	}
+	s.EnableSnapshots(path)
+
+	expiry := new(time.Time)
+	*expiry = time.Now().Add(time.Hour)
+	soon := new(time.Time)
+	*soon = time.Now().Add(50 * time.Millisecond)
+
+	s.Set("a", "1", nil)
+	s.Set("b", "2", expiry)
+	s.Set("c", "3", soon)
+	s.QPush("q", []string{"x", "y", "z"})
+	s.QSetCapacity("q", 2, OverflowReject)
+	s.QSetDeadLetter("jobs", "jobs:dead", 2)
+	s.QPush("jobs", []string{"j", "k"})
+	leased, _ := s.QPopAny([]string{"jobs"}, nil, time.Hour)
+	nacked, _ := s.QPopAny([]string{"jobs"}, nil, time.Hour)
+	s.QNack("jobs", nacked.Receipt)
+	s.QPushAt("delayed", []string{"d"}, 0, time.Now().Add(time.Hour))
+	s.QPushPriority("prio", []string{"p0"}, 0)
+	s.QPushPriority("prio", []string{"p1"}, 1)
+	s.Expire("prio", *expiry)
+	fillStreams(s)
+	s.Expire("empty", *expiry)
+	s.HSet("user", []string{"name", "ann", "age", "31"})
+	s.Expire("user", *expiry)
+	s.SAdd("tags", "a", "b", "c")
+	s.SAdd("common", "b", "c")
+	fillSortedSets(s)
+
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	loaded := NewStorage()
+	if err := loaded.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := loaded.Get("a"); err != nil || v != "1" {
+		t.Fatalf("Expected 1, got %s %+v", v, err)
+	}
+	if got := loaded.KV["b"].expiry; got == nil || got.UnixMilli() != expiry.UnixMilli() {
+		t.Fatalf("Expected expiry %v, got %v", expiry, got)
+	}
+	if _, found := loaded.KV["c"]; found {
+		t.Fatal("Expected the expired key to be dropped")
+	}
+
+	// Values over the capacity are kept, but nothing more goes in
+	if err := loaded.QPush("q", []string{"w"}); err != ErrorQueueFull {
+		t.Fatalf("Expected full queue, got %+v", err)
+	}
+	for _, expected := range []string{"x", "y", "z"} {
+		v, err := loaded.QPop("q")
+		if err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+	}
+
+	if !loaded.QNack("jobs", leased.Receipt) {
+		t.Fatal("Expected the lease to be restored")
+	}
+	if v, err := loaded.QPop("jobs"); err != nil || v != "j" {
+		t.Fatalf("Expected j, got %s %+v", v, err)
+	}
+
+	// The delivery count and the dead letter queue survive
+	popped, _ := loaded.QPopAny([]string{"jobs"}, nil, time.Hour)
+	loaded.QNack("jobs", popped.Receipt)
+	if values, err := loaded.QDeadLetters("jobs", 10); err != nil || len(values) != 1 || values[0] != "k" {
+		t.Fatalf("Expected [k], got %+v %+v", values, err)
+	}
+
+	checkExpiriesReplayed(t, loaded, expiry, "prio", "empty")
+	for _, expected := range []string{"p1", "p0"} {
+		if v, err := loaded.QPop("prio"); err != nil || v != expected {
+			t.Fatalf("Expected %s, got %s %+v", expected, v, err)
+		}
+	}
+
+	if len(loaded.delayed) != 1 || loaded.delayed[0].values[0] != "d" {
+		t.Fatalf("Expected d to still be delayed, got %+v", loaded.delayed)
+	}
+	checkStreamsReplayed(t, loaded)
+	checkHashReplayed(t, loaded, expiry)
+	checkSetsReplayed(t, loaded)
+	checkSortedSetsReplayed(t, loaded)
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.bia")
+
+	s := NewStorage()
+	s.EnableSnapshots(path)
+	s.Set("a", "1", nil)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(snapshotMagic)+4] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewStorage()
+	if err := loaded.LoadSnapshot(path); !errors.Is(err, ErrorSnapshotBadChecksum) {
+		t.Fatalf("Expected checksum error, got %+v", err)
+	}
+	if len(loaded.KV) != 0 {
+		t.Fatalf("Expected nothing to be loaded, got %+v", loaded.KV)
+	}
+}
+
+func TestSnapshotInconsistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.bia")
+
+	// Records that are fine on their own, but disagree with each other
+	state := storageState{
+		KV:         map[string]Value{"a": {value: "1"}},
+		Queue:      map[string][]string{"jobs": {"x", "y"}},
+		Deliveries: map[string][]int{"jobs": {1}},
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeSnapshot(f, state); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	loaded := NewStorage()
+	if err := loaded.LoadSnapshot(path); !errors.Is(err, ErrorSnapshotCorrupt) {
+		t.Fatalf("Expected corrupt error, got %+v", err)
+	}
+	if len(loaded.KV) != 0 {
+		t.Fatalf("Expected nothing to be loaded, got %+v", loaded.KV)
+	}
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.bia")
+
+	s := NewStorage()
+	s.EnableSnapshots(path)
+	s.Set("a", "1", nil)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(snapshotMagic)] = snapshotVersion + 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewStorage().LoadSnapshot(path); !errors.Is(err, ErrorSnapshotVersion) {
+		t.Fatalf("Expected version error, got %+v", err)
+	}
+}
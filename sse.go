@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// HandleSubscribe streams the messages published to the channel and pattern
+// query parameters as Server-Sent Events, until the client goes away or
+// falls too far behind. Every subscription is confirmed by a subscribe or
+// psubscribe event before any message event.
+func HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	channels, patterns := query["channel"], query["pattern"]
+	if len(channels)+len(patterns) == 0 {
+		http.Error(w, "At least one channel or pattern is required", http.StatusBadRequest)
+		return
+	}
+
+	// The server write timeout would cut the stream short. Not every writer
+	// supports deadlines, those have no timeout to lift.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	sub := NewSubscriber(subscriberBuffer)
+	defer storage.CloseSubscriber(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, c := range storage.Subscribe(sub, channels...) {
+		writeEvent(w, "subscribe", map[string]any{"channel": c.Name, "count": c.Count})
+	}
+	for _, c := range storage.PSubscribe(sub, patterns...) {
+		writeEvent(w, "psubscribe", map[string]any{"pattern": c.Name, "count": c.Count})
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case m, ok := <-sub.Messages():
+			if !ok {
+				return
+			}
+			writeEvent(w, "message", m)
+			// Messages that came in together go out together
+			if len(sub.Messages()) == 0 {
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// JSON has no newlines, so the data fits on one line
+func writeEvent(w io.Writer, event string, data any) {
+	encoded, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded)
+}
@@ -2,49 +2,116 @@ package main
 
 import (
 	"errors"
+	"log"
+	"math"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type WaitingStatus int
-
-const (
-	NoWaiting WaitingStatus = iota
-	CurrentlyWaiting
-)
-
-// Nodes are implemented in a linked list fashion
+// Nodes are implemented in a doubly linked list fashion
 type QueueNode struct {
 	value string
+	prev  *QueueNode
 	next  *QueueNode
+
+	priority   int // See QPushPriority
+	deliveries int // Times the value was leased, see QSetDeadLetter
 }
 
+// Values are popped from head. The list is ordered by priority, highest
+// first, and by push order among values of the same priority. A queue is in
+// the keyspace only while it has values.
 type Queue struct {
+	head   *QueueNode
 	tail   *QueueNode
-	status WaitingStatus
-	cond   *sync.Cond
+	length int
+
+	// Blocked producers of a full queue, longest waiting first
+	producers []*queueProducer
 }
 
+// A consumer blocked on one or more queues. A push hands it a value directly,
+// under kvLock, so a value is never given to two consumers or lost when the
+// consumer gives up at the same time.
+type queueWaiter struct {
+	keys   []string      // Every queue the waiter is registered on
+	lease  time.Duration // Lease the value for this long, see QPopAny
+	moveTo string        // Push the value there instead, see QMove
+
+	popped Popped
+	err    error // Set instead of popped when the move can't happen
+	served bool
+	ready  chan struct{} // closed once served
+}
+
+// A key of any type. The type is the one of the field that is set, a value
+// with none of them set is a string.
 type Value struct {
 	value  string
+	hash   map[string]string
+	set    map[string]struct{}
+	zset   *sortedSet
+	queue  *Queue
+	stream *Stream
 	expiry *time.Time
 }
 
 type Storage struct {
+	// Every key whatever its type, see Value
 	KV     map[string]Value
 	kvLock sync.RWMutex
 
-	Queue     map[string]*Queue
-	queueLock sync.Mutex
+	// Clients blocked in BZPop and QPopAny, by key. A key can be waited on
+	// before it exists, or while it holds another type. Guarded by kvLock.
+	zsetWaiters  map[string][]*zsetWaiter
+	queueWaiters map[string][]*queueWaiter
+
+	// Values handed out by reliable pops, by receipt. Guarded by kvLock.
+	leases    map[string]*queueLease
+	leaseHeap leaseHeap
+
+	// Where values leased too many times go, by source queue. Guarded by kvLock.
+	deadLetters map[string]deadLetterConfig
+
+	// Capacities set with QSetCapacity, by queue. Guarded by kvLock.
+	limits map[string]queueLimit
+
+	// Pushes waiting for their time, see QPushAt. Guarded by kvLock.
+	delayed    delayedHeap
+	delayedSeq uint64
+
+	// Subscribers by channel and by pattern, never persisted
+	channels   map[string]map[*Subscriber]struct{}
+	patterns   map[string]map[*Subscriber]struct{}
+	pubsubLock sync.Mutex
+
+	// Optional, mutations are appended while holding the lock they happen under
+	aof *AOF
+
+	snapshotPath string
+	saving       atomic.Bool
+
+	// Set while replaying the log, which has every timed event in it
+	loading atomic.Bool
 }
 
 func NewStorage() *Storage {
 	s := &Storage{
-		KV:    make(map[string]Value),
-		Queue: make(map[string]*Queue),
+		KV:           make(map[string]Value),
+		zsetWaiters:  make(map[string][]*zsetWaiter),
+		queueWaiters: make(map[string][]*queueWaiter),
+		leases:       make(map[string]*queueLease),
+		deadLetters:  make(map[string]deadLetterConfig),
+		limits:       make(map[string]queueLimit),
+		channels:     make(map[string]map[*Subscriber]struct{}),
+		patterns:     make(map[string]map[*Subscriber]struct{}),
 	}
 
 	go s.runStorageGC()
+	go s.runQueueTimers()
 	return s
 }
 
@@ -56,11 +123,39 @@ func (v *Value) Expired() bool {
 	return time.Now().After(*v.expiry)
 }
 
+// Type names the type of the value, as TYPE reports it
+func (v *Value) Type() string {
+	switch {
+	case v.hash != nil:
+		return "hash"
+	case v.set != nil:
+		return "set"
+	case v.zset != nil:
+		return "zset"
+	case v.queue != nil:
+		return "queue"
+	case v.stream != nil:
+		return "stream"
+	}
+	return "string"
+}
+
+// String commands fail with ErrorWrongType on other values
+func (v *Value) isString() bool {
+	return v.Type() == "string"
+}
+
 var (
-	ErrorKeyNotFound       = errors.New("key not found")
-	ErrorKeyExists         = errors.New("key already exists")
-	ErrorEmptyQueue        = errors.New("queue is empty")
-	ErrorManyWaiterOnQueue = errors.New("many waiter on queue")
+	ErrorKeyNotFound   = errors.New("key not found")
+	ErrorKeyExists     = errors.New("key already exists")
+	ErrorEmptyQueue    = errors.New("queue is empty")
+	ErrorQueueFull     = errors.New("queue is full")
+	ErrorWrongType     = errors.New("operation against a key holding the wrong kind of value")
+	ErrorNotInteger    = errors.New("value is not an integer or out of range")
+	ErrorNotFloat      = errors.New("value is not a valid float")
+	ErrorOverflow      = errors.New("increment or decrement would overflow")
+	ErrorNaNOrInfinity = errors.New("increment would produce NaN or Infinity")
+	ErrorScoreNaN      = errors.New("resulting score is not a number")
 )
 
 func (s *Storage) runStorageGC() {
@@ -71,41 +166,302 @@ func (s *Storage) runStorageGC() {
 		s.kvLock.Lock()
 		for k, v := range s.KV {
 			if v.Expired() {
-				delete(s.KV, k)
+				s.dropLocked(k)
 			}
 		}
 		s.kvLock.Unlock()
+
+		if s.aof != nil && s.aof.NeedsRewrite() {
+			if err := s.BackgroundRewriteAOF(); err != nil && err != ErrorRewriteInProgress {
+				log.Print(err.Error())
+			}
+		}
 	}
 }
 
-func (s *Storage) SetIfExists(key, value string, expiry *time.Time) error {
+// Must be called with the lock covering the mutation held
+func (s *Storage) log(args ...string) {
+	if s.aof != nil {
+		s.aof.Append(args...)
+	}
+}
+
+func (s *Storage) logSet(key string, v Value) {
+	s.log(setLogEntry(key, v)...)
+}
+
+// Expiry is logged as an absolute time, so replaying doesn't extend it
+func setLogEntry(key string, v Value) []string {
+	if v.expiry == nil {
+		return []string{"SET", key, v.value}
+	}
+	return []string{"SET", key, v.value, "PXAT", strconv.FormatInt(v.expiry.UnixMilli(), 10)}
+}
+
+// storageState is a point in time copy of the storage contents
+type storageState struct {
+	KV map[string]Value
+	// Values in the order they are popped
+	Queue map[string][]string
+	// In the same order as the values, only for queues with values of a
+	// priority other than zero or that were leased
+	Priorities  map[string][]int
+	Deliveries  map[string][]int
+	Leases      []queueLease
+	DeadLetters map[string]deadLetterConfig
+	Limits      map[string]queueLimit
+	// In the order they are due
+	Delayed []delayedPush
+	Streams map[string]streamState
+	// Of queues and streams, the other values carry their own
+	Expiries map[string]time.Time
+}
+
+// A copy of a stream, entries are never changed once added so they are shared
+type streamState struct {
+	entries []StreamEntry
+	lastID  StreamID
+	groups  map[string]consumerGroup
+}
+
+// Calls fn with each run of values of the same priority, in order. Nil
+// priorities are all zero.
+func priorityRuns(values []string, priorities []int, fn func(values []string, priority int)) {
+	if priorities == nil {
+		fn(values, 0)
+		return
+	}
+
+	start := 0
+	for i := 1; i <= len(values); i++ {
+		if i == len(values) || priorities[i] != priorities[start] {
+			fn(values[start:i], priorities[start])
+			start = i
+		}
+	}
+}
+
+// Blocks every mutation until unlockAll
+func (s *Storage) lockAll() {
 	s.kvLock.Lock()
-	defer s.kvLock.Unlock()
+}
 
-	if vOld, ok := s.KV[key]; ok && !vOld.Expired() {
-		s.KV[key] = Value{value, expiry}
-		return nil
+func (s *Storage) unlockAll() {
+	s.kvLock.Unlock()
+}
+
+// Must be called between lockAll and unlockAll. Expired keys are skipped.
+func (s *Storage) copyStateLocked() storageState {
+	state := storageState{
+		KV:          make(map[string]Value, len(s.KV)),
+		Queue:       make(map[string][]string),
+		Priorities:  make(map[string][]int),
+		Deliveries:  make(map[string][]int),
+		DeadLetters: make(map[string]deadLetterConfig, len(s.deadLetters)),
+		Limits:      make(map[string]queueLimit, len(s.limits)),
+		Streams:     make(map[string]streamState),
+		Expiries:    make(map[string]time.Time),
 	}
 
-	return ErrorKeyNotFound
+	for k, v := range s.KV {
+		if v.Expired() {
+			continue
+		}
+		if v.queue != nil || v.stream != nil {
+			if v.expiry != nil {
+				state.Expiries[k] = *v.expiry
+			}
+			if v.queue != nil {
+				state.copyQueue(k, v.queue)
+			} else {
+				state.Streams[k] = v.stream.copy()
+			}
+			continue
+		}
+
+		// Hashes, sets and sorted sets change in place
+		if v.hash != nil {
+			hash := make(map[string]string, len(v.hash))
+			for field, value := range v.hash {
+				hash[field] = value
+			}
+			v.hash = hash
+		}
+		if v.set != nil {
+			set := make(map[string]struct{}, len(v.set))
+			for m := range v.set {
+				set[m] = struct{}{}
+			}
+			v.set = set
+		}
+		if v.zset != nil {
+			v.zset = v.zset.clone()
+		}
+		state.KV[k] = v
+	}
+
+	for k, c := range s.deadLetters {
+		state.DeadLetters[k] = c
+	}
+	for k, l := range s.limits {
+		state.Limits[k] = l
+	}
+
+	delayed := append(delayedHeap(nil), s.delayed...)
+	sort.Sort(delayed)
+	for _, d := range delayed {
+		state.Delayed = append(state.Delayed, *d)
+	}
+
+	for _, l := range s.leaseHeap {
+		// The node changes once it is back in the queue
+		c, node := *l, *l.node
+		c.node = &node
+		state.Leases = append(state.Leases, c)
+	}
+
+	return state
 }
 
-func (s *Storage) SetIfDoesntExists(key, value string, expiry *time.Time) error {
+func (state *storageState) copyQueue(k string, q *Queue) {
+	var values []string
+	var priorities, deliveries []int
+	prioritized, delivered := false, false
+	for node := q.head; node != nil; node = node.next {
+		values = append(values, node.value)
+		priorities = append(priorities, node.priority)
+		deliveries = append(deliveries, node.deliveries)
+		prioritized = prioritized || node.priority != 0
+		delivered = delivered || node.deliveries != 0
+	}
+	if len(values) == 0 {
+		return
+	}
+
+	state.Queue[k] = values
+	if prioritized {
+		state.Priorities[k] = priorities
+	}
+	if delivered {
+		state.Deliveries[k] = deliveries
+	}
+}
+
+func (st *Stream) copy() streamState {
+	c := streamState{
+		entries: st.entries[:len(st.entries):len(st.entries)],
+		lastID:  st.lastID,
+		groups:  make(map[string]consumerGroup, len(st.groups)),
+	}
+	for name, g := range st.groups {
+		pending := make(map[StreamID]*pendingEntry, len(g.pending))
+		for id, p := range g.pending {
+			p := *p
+			pending[id] = &p
+		}
+		c.groups[name] = consumerGroup{lastDelivered: g.lastDelivered, pending: pending}
+	}
+	return c
+}
+
+type SetOptions struct {
+	XX      bool // Set if key exists
+	NX      bool // Set if key doesn't exists
+	KeepTTL bool // Keep the expiry of the previous value
+	Get     bool // The previous value must be a string
+}
+
+// SetWithOptions stores the value and returns the previous one, if any.
+// Nothing is stored when the NX or XX condition isn't met, or when the
+// previous value isn't a string and Get is set.
+func (s *Storage) SetWithOptions(key, value string, expiry *time.Time, opts SetOptions) (old string, found bool, err error) {
 	s.kvLock.Lock()
 	defer s.kvLock.Unlock()
 
-	if vOld, ok := s.KV[key]; !ok || !vOld.Expired() {
-		return ErrorKeyExists
+	vOld, ok := s.KV[key]
+	if ok && !vOld.Expired() {
+		if opts.Get && !vOld.isString() {
+			return "", false, ErrorWrongType
+		}
+		old, found = vOld.value, true
 	}
 
-	s.KV[key] = Value{value, expiry}
-	return nil
+	if opts.XX && !found {
+		return old, found, ErrorKeyNotFound
+	}
+	if opts.NX && found {
+		return old, found, ErrorKeyExists
+	}
+
+	if opts.KeepTTL && found {
+		expiry = vOld.expiry
+	}
+
+	s.replaceLocked(key, Value{value: value, expiry: expiry})
+	s.logSet(key, s.KV[key])
+	return old, found, nil
+}
+
+func (s *Storage) SetIfExists(key, value string, expiry *time.Time) error {
+	_, _, err := s.SetWithOptions(key, value, expiry, SetOptions{XX: true})
+	return err
+}
+
+func (s *Storage) SetIfDoesntExists(key, value string, expiry *time.Time) error {
+	_, _, err := s.SetWithOptions(key, value, expiry, SetOptions{NX: true})
+	return err
 }
 
 func (s *Storage) Set(key, value string, expiry *time.Time) {
+	s.SetWithOptions(key, value, expiry, SetOptions{})
+}
+
+// Replaces the value at key with a value of any type, for snapshots and log
+// entries of values that aren't strings
+func (s *Storage) restoreValue(key string, v Value) {
 	s.kvLock.Lock()
 	defer s.kvLock.Unlock()
-	s.KV[key] = Value{value, expiry}
+	s.replaceLocked(key, v)
+}
+
+// Stores v at key, replacing whatever is there. Must be called with kvLock
+// held.
+func (s *Storage) replaceLocked(key string, v Value) {
+	if old := s.KV[key]; old.queue != v.queue {
+		s.dropLocked(key)
+	}
+	s.KV[key] = v
+}
+
+// Removes the key. Pushes blocked on a queue that goes away fail with
+// ErrorKeyNotFound. Must be called with kvLock held.
+func (s *Storage) dropLocked(key string) {
+	v, found := s.KV[key]
+	if !found {
+		return
+	}
+
+	delete(s.KV, key)
+	if v.queue != nil {
+		for _, p := range v.queue.producers {
+			p.err = ErrorKeyNotFound
+			p.served = true
+			close(p.ready)
+		}
+		v.queue.producers = nil
+	}
+}
+
+// Type returns the type of the value at key, see Value.Type, or none
+func (s *Storage) Type(key string) string {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		return "none"
+	}
+	return v.Type()
 }
 
 func (s *Storage) Get(key string) (string, error) {
@@ -116,94 +472,522 @@ func (s *Storage) Get(key string) (string, error) {
 	if !ok || v.Expired() {
 		return "", ErrorKeyNotFound
 	}
+	if !v.isString() {
+		return "", ErrorWrongType
+	}
 
 	return v.value, nil
 }
 
-func (s *Storage) QPush(key string, value []string) {
-	if len(value) <= 0 {
-		return
+// MGet returns the value of every key, found is false for missing keys and
+// keys that aren't strings
+func (s *Storage) MGet(keys ...string) (values []string, found []bool) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	values = make([]string, len(keys))
+	found = make([]bool, len(keys))
+	for i, key := range keys {
+		if v, ok := s.KV[key]; ok && !v.Expired() && v.isString() {
+			values[i], found[i] = v.value, true
+		}
 	}
+	return
+}
 
-	head := &QueueNode{value[0], nil}
-	tail := head
+// MSet stores every key at once, without expiry. With nx nothing is stored
+// if any of the keys exists, and false is returned.
+func (s *Storage) MSet(keys, values []string, nx bool) bool {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
 
-	for _, v := range value[1:] {
-		tail = &QueueNode{v, tail}
+	if nx {
+		for _, key := range keys {
+			if v, ok := s.KV[key]; ok && !v.Expired() {
+				return false
+			}
+		}
 	}
 
-	s.queueLock.Lock()
-	defer s.queueLock.Unlock()
+	entry := []string{"MSET"}
+	for i, key := range keys {
+		s.replaceLocked(key, Value{value: values[i]})
+		entry = append(entry, key, values[i])
+	}
 
-	queue, found := s.Queue[key]
-	if !found {
-		queue = new(Queue)
+	// A single entry, so replaying never applies half of it
+	s.log(entry...)
+	return true
+}
+
+// IncrBy adds delta to the integer stored at key, a missing key counts as 0.
+// The expiry of the key is kept.
+func (s *Storage) IncrBy(key string, delta int64) (int64, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		v = Value{value: "0"}
+	}
+	if !v.isString() {
+		return 0, ErrorWrongType
 	}
-	head.next = queue.tail
-	queue.tail = tail
-	s.Queue[key] = queue
 
-	if queue.status == CurrentlyWaiting {
-		queue.cond.Signal()
+	n, err := strconv.ParseInt(v.value, 10, 64)
+	if err != nil {
+		return 0, ErrorNotInteger
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrorOverflow
 	}
+
+	n += delta
+	v.value = strconv.FormatInt(n, 10)
+	s.replaceLocked(key, v)
+	s.logSet(key, v)
+	return n, nil
 }
 
-func (s *Storage) QPop(key string) (string, error) {
-	return s.QPopTimeout(key, nil)
+// IncrByFloat is IncrBy for floating point values
+func (s *Storage) IncrByFloat(key string, delta float64) (string, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		v = Value{value: "0"}
+	}
+	if !v.isString() {
+		return "", ErrorWrongType
+	}
+
+	n, err := strconv.ParseFloat(v.value, 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return "", ErrorNotFloat
+	}
+
+	n += delta
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return "", ErrorNaNOrInfinity
+	}
+
+	v.value = strconv.FormatFloat(n, 'f', -1, 64)
+	s.replaceLocked(key, v)
+	s.logSet(key, v)
+	return v.value, nil
 }
 
-func (s *Storage) QPopTimeout(key string, time *time.Time) (string, error) {
-	s.queueLock.Lock()
-	defer s.queueLock.Unlock()
+// Del removes the keys and returns how many of them existed
+func (s *Storage) Del(keys ...string) int64 {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
 
-	queue, found := s.Queue[key]
-	if !found {
-		if time == nil {
-			return "", ErrorEmptyQueue
+	var count int64
+	for _, key := range keys {
+		v, ok := s.KV[key]
+		if !ok {
+			continue
+		}
+
+		s.dropLocked(key)
+		if !v.Expired() {
+			count++
 		}
-		queue = new(Queue)
-		s.Queue[key] = queue
 	}
 
-	for queue.tail == nil {
-		if time == nil {
-			return "", ErrorEmptyQueue
+	if count > 0 {
+		s.log(append([]string{"DEL"}, keys...)...)
+	}
+	return count
+}
+
+// Exists returns how many of the keys exist, a key given twice counts twice
+func (s *Storage) Exists(keys ...string) int64 {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	var count int64
+	for _, key := range keys {
+		if v, ok := s.KV[key]; ok && !v.Expired() {
+			count++
 		}
+	}
+	return count
+}
 
-		err := s.waitForValue(queue, *time)
-		if err != nil {
-			return "", err
+// Expiry returns when the key expires, nil if it never does
+func (s *Storage) Expiry(key string) (*time.Time, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		return nil, ErrorKeyNotFound
+	}
+
+	return v.expiry, nil
+}
+
+// Expire sets when the key expires, a time in the past deletes it right away.
+// Returns false if the key doesn't exist.
+func (s *Storage) Expire(key string, at time.Time) bool {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		return false
+	}
+
+	if !at.After(time.Now()) {
+		s.dropLocked(key)
+		s.log("DEL", key)
+		return true
+	}
+
+	v.expiry = &at
+	s.KV[key] = v
+	s.log("PEXPIREAT", key, strconv.FormatInt(at.UnixMilli(), 10))
+	return true
+}
+
+// Persist removes the expiry of the key.
+// Returns false if the key doesn't exist or has no expiry.
+func (s *Storage) Persist(key string) bool {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	v, ok := s.KV[key]
+	if !ok || v.Expired() || v.expiry == nil {
+		return false
+	}
+
+	v.expiry = nil
+	s.KV[key] = v
+	s.log("PERSIST", key)
+	return true
+}
+
+func (s *Storage) QPush(key string, value []string) error {
+	return s.QPushPriority(key, value, 0)
+}
+
+// QPushPriority pushes values popped before every value of a lower priority,
+// and after the values of the same priority already there. Fails with
+// ErrorQueueFull if they don't fit, see QSetCapacity.
+func (s *Storage) QPushPriority(key string, value []string, priority int) error {
+	return s.QPushTimeout(key, value, priority, nil)
+}
+
+func pushLogEntry(key string, values []string, priority int) []string {
+	if priority == 0 {
+		return append([]string{"QPUSH", key}, values...)
+	}
+	return append([]string{"QPUSHPRIORITY", key, strconv.Itoa(priority)}, values...)
+}
+
+// Links non empty values from first to last
+func newQueueNodes(values []string, priority int) (first, last *QueueNode) {
+	first = &QueueNode{value: values[0], priority: priority}
+	last = first
+
+	for _, v := range values[1:] {
+		last.next = &QueueNode{value: v, prev: last, priority: priority}
+		last = last.next
+	}
+	return first, last
+}
+
+// Returns the queue at key, nil if there is none. Must be called with kvLock
+// held.
+func (s *Storage) queueLocked(key string) (*Queue, error) {
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		return nil, nil
+	}
+	if v.queue == nil {
+		return nil, ErrorWrongType
+	}
+	return v.queue, nil
+}
+
+// Returns the queue at key, creating it if needed. Must be called with kvLock
+// held.
+func (s *Storage) queueForPushLocked(key string) (*Queue, error) {
+	queue, err := s.queueLocked(key)
+	if err != nil || queue != nil {
+		return queue, err
+	}
+	queue = new(Queue)
+	s.replaceLocked(key, Value{queue: queue})
+	return queue, nil
+}
+
+// Removes the queue from the keyspace once it has no values left and no
+// pushes waiting for room. Must be called with kvLock held.
+func (s *Storage) removeIfEmptyLocked(key string, queue *Queue) {
+	if queue.head == nil && len(queue.producers) == 0 {
+		if v := s.KV[key]; v.queue == queue {
+			delete(s.KV, key)
 		}
+	}
+}
 
-		time = nil
+// Pushes the linked nodes from first to last, which have the same priority,
+// and wakes waiters. Fails with ErrorWrongType if the key holds another type.
+// Client pushes check the type of the key first, values due from a delayed
+// push are dropped if the key holds another type by then. Must be called with
+// kvLock held.
+func (s *Storage) pushLocked(key string, first, last *QueueNode) error {
+	queue, err := s.queueForPushLocked(key)
+	if err != nil {
+		return err
 	}
+	queue.insert(first, last)
 
-	node := queue.tail
-	queue.tail = queue.tail.next
-	if queue.tail == nil {
-		delete(s.Queue, key)
+	s.serveWaitersLocked(key, queue)
+	return nil
+}
+
+// Inserts the linked nodes from first to last, which have the same priority,
+// after every value of the same or a higher priority
+func (q *Queue) insert(first, last *QueueNode) {
+	// Values of a lower priority are at the end, so the walk is short
+	prev := q.tail
+	for prev != nil && prev.priority < first.priority {
+		prev = prev.prev
+	}
+	q.link(prev, first, last)
+}
+
+// Inserts the node before every value of the same or a lower priority
+func (q *Queue) insertFront(n *QueueNode) {
+	var prev *QueueNode
+	for node := q.head; node != nil && node.priority > n.priority; node = node.next {
+		prev = node
+	}
+	q.link(prev, n, n)
+}
+
+// Links the nodes from first to last after prev, or at the head if prev is nil
+func (q *Queue) link(prev, first, last *QueueNode) {
+	next := q.head
+	if prev != nil {
+		next = prev.next
+	}
+
+	first.prev, last.next = prev, next
+	if prev == nil {
+		q.head = first
 	} else {
-		s.Queue[key] = queue
+		prev.next = first
+	}
+	if next == nil {
+		q.tail = last
+	} else {
+		next.prev = last
 	}
 
-	return node.value, nil
+	for node := first; node != last; node = node.next {
+		q.length++
+	}
+	q.length++
 }
 
-// Errors if queue is already begin waited on
-func (s *Storage) waitForValue(q *Queue, timeout time.Time) error {
-	if q.status == CurrentlyWaiting {
-		return ErrorManyWaiterOnQueue
+// Unlinks a node of the queue
+func (q *Queue) unlink(node *QueueNode) {
+	if node.prev == nil {
+		q.head = node.next
+	} else {
+		node.prev.next = node.next
+	}
+	if node.next == nil {
+		q.tail = node.prev
+	} else {
+		node.next.prev = node.prev
 	}
 
-	q.status = CurrentlyWaiting
-	q.cond = sync.NewCond(&s.queueLock)
+	node.prev, node.next = nil, nil
+	q.length--
+}
 
-	go func() {
-		<-time.After(time.Until(timeout))
-		q.cond.Signal()
-	}()
+// Must be called on a non empty queue
+func (q *Queue) pop() *QueueNode {
+	node := q.head
+	q.unlink(node)
+	return node
+}
 
-	q.cond.Wait()
-	q.status = NoWaiting
-	return nil
+// Pops the value popped last. Must be called on a non empty queue.
+func (q *Queue) popBack() *QueueNode {
+	node := q.tail
+	q.unlink(node)
+	return node
+}
+
+// Hands values to blocked consumers, longest waiting first. A consumer
+// moving values to a key that holds another type by now fails with
+// ErrorWrongType instead. Must be called with kvLock held.
+func (s *Storage) serveWaitersLocked(key string, queue *Queue) {
+	for len(s.queueWaiters[key]) > 0 && queue.head != nil {
+		w := s.queueWaiters[key][0]
+		s.unregisterLocked(w)
+
+		if _, err := s.queueLocked(w.moveTo); w.moveTo != "" && err != nil {
+			w.err = err
+		} else {
+			w.popped = s.deliverLocked(key, queue, w)
+		}
+		w.served = true
+		close(w.ready)
+	}
+}
+
+func (s *Storage) QPop(key string) (string, error) {
+	return s.QPopTimeout(key, nil)
+}
+
+// QPopTimeout waits until timeout for a value if the queue is empty, a nil
+// timeout doesn't wait. Consumers waiting on the same queue are served in
+// the order they started waiting.
+func (s *Storage) QPopTimeout(key string, timeout *time.Time) (string, error) {
+	popped, err := s.QPopAny([]string{key}, timeout, 0)
+	return popped.Value, err
+}
+
+type Popped struct {
+	Key   string
+	Value string
+
+	// Only set for leased values, needed to acknowledge them
+	Receipt string
+}
+
+// QPopAny pops from the first of the keys with a value, in argument order.
+// If they are all empty it waits until timeout for a value on any of them.
+// With a lease the value is only handed out until it is acknowledged or the
+// lease runs out, see QAck.
+func (s *Storage) QPopAny(keys []string, timeout *time.Time, lease time.Duration) (Popped, error) {
+	return s.popAny(keys, timeout, &queueWaiter{lease: lease})
+}
+
+// Pops like QPopAny, the value is handed out the way w says. w only waits
+// if the queues are all empty.
+func (s *Storage) popAny(keys []string, timeout *time.Time, w *queueWaiter) (Popped, error) {
+	s.kvLock.Lock()
+	s.promoteLocked(time.Now())
+
+	if w.moveTo != "" {
+		if _, err := s.queueLocked(w.moveTo); err != nil {
+			s.kvLock.Unlock()
+			return Popped{}, err
+		}
+	}
+	for _, key := range keys {
+		queue, err := s.queueLocked(key)
+		if err != nil {
+			s.kvLock.Unlock()
+			return Popped{}, err
+		}
+		if queue != nil && queue.head != nil {
+			defer s.kvLock.Unlock()
+			return s.deliverLocked(key, queue, w), nil
+		}
+	}
+	if timeout == nil {
+		s.kvLock.Unlock()
+		return Popped{}, ErrorEmptyQueue
+	}
+
+	w.ready = make(chan struct{})
+	for _, key := range keys {
+		// The same key given twice waits once
+		if n := len(s.queueWaiters[key]); n > 0 && s.queueWaiters[key][n-1] == w {
+			continue
+		}
+		s.queueWaiters[key] = append(s.queueWaiters[key], w)
+		w.keys = append(w.keys, key)
+	}
+	s.kvLock.Unlock()
+
+	timer := time.NewTimer(time.Until(*timeout))
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return w.popped, w.err
+	case <-timer.C:
+	}
+
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	// Served between the timer firing and taking the lock
+	if w.served {
+		return w.popped, w.err
+	}
+
+	s.unregisterLocked(w)
+	return Popped{}, ErrorEmptyQueue
+}
+
+// Removes the waiter from every queue it waits on. Must be called with
+// kvLock held.
+func (s *Storage) unregisterLocked(w *queueWaiter) {
+	for _, key := range w.keys {
+		waiters := s.queueWaiters[key]
+		for i, other := range waiters {
+			if other == w {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(s.queueWaiters, key)
+		} else {
+			s.queueWaiters[key] = waiters
+		}
+	}
+}
+
+// Pops the next value, leasing or moving it if w says so, and lets blocked
+// producers in. Must be called with kvLock held on a non empty queue.
+func (s *Storage) deliverLocked(key string, queue *Queue, w *queueWaiter) Popped {
+	node := queue.pop()
+
+	popped := Popped{Key: key, Value: node.value}
+	switch {
+	case w.moveTo != "":
+		// Logged before the push, which may hand the value on to a waiter
+		s.log("QMOVE", key, w.moveTo)
+		s.pushLocked(w.moveTo, node, node)
+
+	case w.lease != 0:
+		node.deliveries++
+		l := s.leaseLocked(key, node, newReceipt(), time.Now().Add(w.lease))
+		s.log("QLEASE", key, l.receipt, strconv.FormatInt(l.deadline.UnixMilli(), 10))
+		popped.Receipt = l.receipt
+
+	default:
+		s.log("QPOP", key)
+	}
+
+	// Pushes are logged after the pop that made room for them
+	s.admitLocked(key, queue)
+	s.removeIfEmptyLocked(key, queue)
+	return popped
+}
+
+// Puts the node back where the next pop of its priority takes it from, and
+// wakes a waiter. Dropped like in pushLocked if the key holds another type.
+// Must be called with kvLock held.
+func (s *Storage) pushFrontLocked(key string, node *QueueNode) {
+	queue, err := s.queueForPushLocked(key)
+	if err != nil {
+		return
+	}
+
+	queue.insertFront(node)
+	s.serveWaitersLocked(key, queue)
 }
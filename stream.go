@@ -0,0 +1,613 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrorStreamIDTooOld = errors.New("stream ID must be greater than the last one of the stream")
+	ErrorStreamFull     = errors.New("stream has exhausted the last possible ID")
+	ErrorNoGroup        = errors.New("no such consumer group")
+	ErrorGroupExists    = errors.New("consumer group already exists")
+)
+
+// Entries of a stream are ordered by ID, milliseconds then a sequence number
+// among entries of the same millisecond
+type StreamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var maxStreamID = StreamID{math.MaxUint64, math.MaxUint64}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+// Smallest ID greater than id, false if id is the largest one
+func (id StreamID) next() (StreamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return StreamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return StreamID{id.ms + 1, 0}, true
+	}
+	return StreamID{}, false
+}
+
+func (id StreamID) Less(other StreamID) bool {
+	if id.ms != other.ms {
+		return id.ms < other.ms
+	}
+	return id.seq < other.seq
+}
+
+// Parses ms-seq, or ms alone with defaultSeq
+func parseStreamID(s string, defaultSeq uint64) (StreamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, false
+	}
+	if !hasSeq {
+		return StreamID{ms, defaultSeq}, true
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, false
+	}
+	return StreamID{ms, seq}, true
+}
+
+func parseStreamIDs(args []string) ([]StreamID, bool) {
+	ids := make([]StreamID, 0, len(args))
+	for _, arg := range args {
+		id, ok := parseStreamID(arg, 0)
+		if !ok {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string // Alternating fields and values
+}
+
+// An append only log of entries. Reading doesn't remove anything, consumer
+// groups keep their own position instead.
+type Stream struct {
+	entries []StreamEntry
+	lastID  StreamID
+	groups  map[string]*consumerGroup
+
+	// Consumers blocked reading new entries, longest waiting first
+	waiters []*streamWaiter
+}
+
+// Every entry is delivered to one consumer of the group. It stays pending
+// until the consumer acknowledges it, see XAck and XClaim.
+type consumerGroup struct {
+	lastDelivered StreamID
+	pending       map[StreamID]*pendingEntry
+}
+
+type pendingEntry struct {
+	consumer   string
+	delivered  time.Time
+	deliveries int
+}
+
+// A consumer blocked in XReadGroup, served under the stream lock by XAdd
+type streamWaiter struct {
+	group    string
+	consumer string
+	count    int
+	keys     []string
+
+	read   []StreamRead
+	served bool
+	ready  chan struct{} // closed once served
+}
+
+// Entries read from the stream at Key
+type StreamRead struct {
+	Key     string
+	Entries []StreamEntry
+}
+
+func newStream() *Stream {
+	return &Stream{groups: make(map[string]*consumerGroup)}
+}
+
+// Index of the first entry with an ID not less than id
+func (st *Stream) search(id StreamID) int {
+	return sort.Search(len(st.entries), func(i int) bool {
+		return !st.entries[i].ID.Less(id)
+	})
+}
+
+func (st *Stream) entry(id StreamID) (StreamEntry, bool) {
+	i := st.search(id)
+	if i == len(st.entries) || st.entries[i].ID != id {
+		return StreamEntry{}, false
+	}
+	return st.entries[i], true
+}
+
+// Returns the stream at key, nil if there is none. Must be called with kvLock
+// held.
+func (s *Storage) streamLocked(key string) (*Stream, error) {
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		return nil, nil
+	}
+	if v.stream == nil {
+		return nil, ErrorWrongType
+	}
+	return v.stream, nil
+}
+
+// XAdd appends an entry with the given fields, a nil id picks one greater
+// than every other. Returns the ID of the entry.
+func (s *Storage) XAdd(key string, id *StreamID, fields []string) (StreamID, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	st, err := s.streamLocked(key)
+	if err != nil {
+		return StreamID{}, err
+	}
+	created := st == nil
+	if created {
+		st = newStream()
+	}
+
+	var entryID StreamID
+	if id == nil {
+		entryID = StreamID{ms: uint64(time.Now().UnixMilli())}
+		if !st.lastID.Less(entryID) {
+			next, ok := st.lastID.next()
+			if !ok {
+				return StreamID{}, ErrorStreamFull
+			}
+			entryID = next
+		}
+	} else {
+		entryID = *id
+		if !st.lastID.Less(entryID) {
+			return StreamID{}, ErrorStreamIDTooOld
+		}
+	}
+
+	if created {
+		s.replaceLocked(key, Value{stream: st})
+	}
+	st.entries = append(st.entries, StreamEntry{ID: entryID, Fields: fields})
+	st.lastID = entryID
+	s.log(append([]string{"XADD", key, entryID.String()}, fields...)...)
+
+	s.serveStreamWaitersLocked(key, st)
+	return entryID, nil
+}
+
+// XRange returns up to count entries with IDs from start to end, both
+// included
+func (s *Storage) XRange(key string, start, end StreamID, count int) ([]StreamEntry, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	entries := []StreamEntry{}
+	st, err := s.streamLocked(key)
+	if st == nil {
+		return entries, err
+	}
+
+	for i := st.search(start); i < len(st.entries) && len(entries) < count; i++ {
+		if end.Less(st.entries[i].ID) {
+			break
+		}
+		entries = append(entries, st.entries[i])
+	}
+	return entries, nil
+}
+
+func (s *Storage) XLen(key string) (int, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	st, err := s.streamLocked(key)
+	if st == nil {
+		return 0, err
+	}
+	return len(st.entries), nil
+}
+
+// XGroupCreate creates a group reading the entries after id, a nil id reads
+// only the entries added from now on. Without mkstream the stream must exist.
+func (s *Storage) XGroupCreate(key, group string, id *StreamID, mkstream bool) error {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	st, err := s.streamLocked(key)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		if !mkstream {
+			return ErrorKeyNotFound
+		}
+		st = newStream()
+		s.replaceLocked(key, Value{stream: st})
+	}
+	if _, found := st.groups[group]; found {
+		return ErrorGroupExists
+	}
+
+	g := &consumerGroup{lastDelivered: st.lastID, pending: make(map[StreamID]*pendingEntry)}
+	if id != nil {
+		g.lastDelivered = *id
+	}
+	st.groups[group] = g
+	s.log("XGROUP", "CREATE", key, group, g.lastDelivered.String(), "MKSTREAM")
+	return nil
+}
+
+// XGroupDestroy removes the group and its pending entries
+func (s *Storage) XGroupDestroy(key, group string) (bool, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	st, err := s.streamLocked(key)
+	if st == nil {
+		return false, err
+	}
+	if _, found := st.groups[group]; !found {
+		return false, nil
+	}
+
+	delete(st.groups, group)
+	s.log("XGROUP", "DESTROY", key, group)
+	return true, nil
+}
+
+// XReadGroup reads for consumer of group from each of the keys. A nil id
+// reads up to count entries never delivered to the group, which become
+// pending for the consumer. Any other id reads the consumer's pending
+// entries after it, without delivering them again.
+//
+// If every id is nil and there is nothing new, it waits until timeout for
+// an entry on any of the keys. A nil timeout doesn't wait.
+func (s *Storage) XReadGroup(group, consumer string, keys []string, ids []*StreamID, count int, timeout *time.Time) ([]StreamRead, error) {
+	s.kvLock.Lock()
+
+	streams := make([]*Stream, len(keys))
+	for i, key := range keys {
+		st, err := s.streamLocked(key)
+		if err == nil && st == nil {
+			err = ErrorKeyNotFound
+		}
+		if err != nil {
+			s.kvLock.Unlock()
+			return nil, err
+		}
+		if _, found := st.groups[group]; !found {
+			s.kvLock.Unlock()
+			return nil, ErrorNoGroup
+		}
+		streams[i] = st
+	}
+
+	var read []StreamRead
+	history := false
+	for i, key := range keys {
+		st := streams[i]
+		g := st.groups[group]
+
+		var entries []StreamEntry
+		if ids[i] == nil {
+			entries = s.deliverNewLocked(key, st, g, group, consumer, count)
+		} else {
+			history = true
+			entries = g.history(st, consumer, *ids[i], count)
+		}
+		if len(entries) > 0 || ids[i] != nil {
+			read = append(read, StreamRead{Key: key, Entries: entries})
+		}
+	}
+	if len(read) > 0 || history || timeout == nil {
+		s.kvLock.Unlock()
+		return read, nil
+	}
+
+	w := &streamWaiter{group: group, consumer: consumer, count: count, ready: make(chan struct{})}
+	for i, key := range keys {
+		st := streams[i]
+		// The same key given twice waits once
+		if n := len(st.waiters); n > 0 && st.waiters[n-1] == w {
+			continue
+		}
+		st.waiters = append(st.waiters, w)
+		w.keys = append(w.keys, key)
+	}
+	s.kvLock.Unlock()
+
+	timer := time.NewTimer(time.Until(*timeout))
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return w.read, nil
+	case <-timer.C:
+	}
+
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	// Served between the timer firing and taking the lock
+	if w.served {
+		return w.read, nil
+	}
+	s.unregisterStreamWaiterLocked(w)
+	return nil, nil
+}
+
+// Delivers up to count entries after the group's last delivered one to
+// consumer. Must be called with kvLock held.
+func (s *Storage) deliverNewLocked(key string, st *Stream, g *consumerGroup, group, consumer string, count int) []StreamEntry {
+	var entries []StreamEntry
+	for i := st.search(g.lastDelivered); i < len(st.entries) && len(entries) < count; i++ {
+		if st.entries[i].ID == g.lastDelivered {
+			continue
+		}
+		entries = append(entries, st.entries[i])
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	entry := []string{"XDELIVER", key, group, consumer, strconv.FormatInt(now.UnixMilli(), 10)}
+	for _, e := range entries {
+		g.deliver(e.ID, consumer, now)
+		entry = append(entry, e.ID.String())
+	}
+	s.log(entry...)
+	return entries
+}
+
+// Marks the entry pending for consumer
+func (g *consumerGroup) deliver(id StreamID, consumer string, at time.Time) {
+	if g.lastDelivered.Less(id) {
+		g.lastDelivered = id
+	}
+	p, found := g.pending[id]
+	if !found {
+		p = new(pendingEntry)
+		g.pending[id] = p
+	}
+	p.consumer = consumer
+	p.delivered = at
+	p.deliveries++
+}
+
+// Pending IDs of the group in order, or only those of consumer if not empty
+func (g *consumerGroup) pendingIDs(consumer string) []StreamID {
+	ids := make([]StreamID, 0, len(g.pending))
+	for id, p := range g.pending {
+		if consumer == "" || p.consumer == consumer {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Less(ids[j]) })
+	return ids
+}
+
+// Up to count entries pending for consumer with an ID greater than after
+func (g *consumerGroup) history(st *Stream, consumer string, after StreamID, count int) []StreamEntry {
+	entries := []StreamEntry{}
+	for _, id := range g.pendingIDs(consumer) {
+		if len(entries) == count {
+			break
+		}
+		if !after.Less(id) {
+			continue
+		}
+		if e, found := st.entry(id); found {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Hands new entries to blocked consumers, longest waiting first. Consumers
+// of a group the entries were already delivered to keep waiting.
+// Must be called with kvLock held.
+func (s *Storage) serveStreamWaitersLocked(key string, st *Stream) {
+	waiters := append([]*streamWaiter(nil), st.waiters...)
+	for _, w := range waiters {
+		g, found := st.groups[w.group]
+		if !found {
+			continue
+		}
+		entries := s.deliverNewLocked(key, st, g, w.group, w.consumer, w.count)
+		if len(entries) == 0 {
+			continue
+		}
+
+		w.read = []StreamRead{{Key: key, Entries: entries}}
+		w.served = true
+		s.unregisterStreamWaiterLocked(w)
+		close(w.ready)
+	}
+}
+
+// Must be called with kvLock held
+func (s *Storage) unregisterStreamWaiterLocked(w *streamWaiter) {
+	for _, key := range w.keys {
+		st := s.KV[key].stream
+		if st == nil {
+			continue
+		}
+		for i, other := range st.waiters {
+			if other == w {
+				st.waiters = append(st.waiters[:i], st.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// XAck removes the ids from the pending entries of the group. Returns how
+// many were pending.
+func (s *Storage) XAck(key, group string, ids []StreamID) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	st, err := s.streamLocked(key)
+	if st == nil {
+		return 0, err
+	}
+	g, found := st.groups[group]
+	if !found {
+		return 0, nil
+	}
+
+	entry := []string{"XACK", key, group}
+	for _, id := range ids {
+		if _, found := g.pending[id]; found {
+			delete(g.pending, id)
+			entry = append(entry, id.String())
+		}
+	}
+	if len(entry) == 3 {
+		return 0, nil
+	}
+	s.log(entry...)
+	return len(entry) - 3, nil
+}
+
+// XClaim gives the pending entries among ids that weren't delivered for at
+// least minIdle to consumer, for entries stuck with a consumer that died.
+// Returns the claimed entries, which count as delivered again.
+func (s *Storage) XClaim(key, group, consumer string, minIdle time.Duration, ids []StreamID) ([]StreamEntry, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	st, err := s.streamLocked(key)
+	if err == nil && st == nil {
+		err = ErrorKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	g, found := st.groups[group]
+	if !found {
+		return nil, ErrorNoGroup
+	}
+
+	now := time.Now()
+	entries := []StreamEntry{}
+	entry := []string{"XCLAIM", key, group, consumer, strconv.FormatInt(now.UnixMilli(), 10)}
+	for _, id := range ids {
+		p, found := g.pending[id]
+		if !found || now.Sub(p.delivered) < minIdle {
+			continue
+		}
+		e, found := st.entry(id)
+		if !found {
+			continue
+		}
+
+		g.deliver(id, consumer, now)
+		entries = append(entries, e)
+		entry = append(entry, id.String())
+	}
+	if len(entries) > 0 {
+		s.log(entry...)
+	}
+	return entries, nil
+}
+
+// A pending entry as reported by XPending
+type PendingInfo struct {
+	ID         StreamID
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int
+}
+
+// XPending lists the pending entries of the group in ID order
+func (s *Storage) XPending(key, group string) ([]PendingInfo, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	st, err := s.streamLocked(key)
+	if err == nil && st == nil {
+		err = ErrorKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	g, found := st.groups[group]
+	if !found {
+		return nil, ErrorNoGroup
+	}
+
+	now := time.Now()
+	pending := []PendingInfo{}
+	for _, id := range g.pendingIDs("") {
+		p := g.pending[id]
+		pending = append(pending, PendingInfo{ID: id, Consumer: p.consumer, Idle: now.Sub(p.delivered), Deliveries: p.deliveries})
+	}
+	return pending, nil
+}
+
+// Replays an XDELIVER or XCLAIM log entry, at is when it happened. With
+// deliveries the pending entries are restored with that count instead,
+// for XPEL entries written by rewrites.
+func (s *Storage) restoreDelivery(key, group, consumer string, at time.Time, ids []StreamID, deliveries int) error {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	st, _ := s.streamLocked(key)
+	if st == nil {
+		return ErrorInvalidLogEntry
+	}
+	g, found := st.groups[group]
+	if !found {
+		return ErrorInvalidLogEntry
+	}
+
+	for _, id := range ids {
+		g.deliver(id, consumer, at)
+		if deliveries > 0 {
+			g.pending[id].deliveries = deliveries
+		}
+	}
+	return nil
+}
+
+// Restores a stream from a snapshot, replacing the one at key
+func (s *Storage) restoreStream(key string, state streamState) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	st := newStream()
+	st.entries = append(st.entries, state.entries...)
+	st.lastID = state.lastID
+	for name, g := range state.groups {
+		g := g
+		st.groups[name] = &g
+	}
+	s.replaceLocked(key, Value{stream: st})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrorUnterminatedQuote = errors.New("unterminated quote")
+	ErrorInvalidEscape     = errors.New("invalid escape sequence")
+	ErrorQuoteNotClosed    = errors.New("closing quote must be followed by a space")
+)
+
+// Tokenize splits a command line into its arguments.
+//
+// Arguments are separated by runs of whitespace. An argument starting with a
+// double quote may contain whitespace and the escapes \n \r \t \b \a \\ \"
+// and \xHH. An argument starting with a single quote is taken literally
+// except for \' and \\. Errors carry the byte offset where parsing failed.
+func Tokenize(line string) ([]string, error) {
+	var args []string
+	pos := 0
+
+	for {
+		for pos < len(line) && isSpace(line[pos]) {
+			pos++
+		}
+		if pos >= len(line) {
+			return args, nil
+		}
+
+		var arg string
+		var err error
+		switch line[pos] {
+		case '"':
+			arg, pos, err = tokenizeDoubleQuoted(line, pos)
+		case '\'':
+			arg, pos, err = tokenizeSingleQuoted(line, pos)
+		default:
+			start := pos
+			for pos < len(line) && !isSpace(line[pos]) {
+				pos++
+			}
+			arg = line[start:pos]
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func positionError(err error, pos int) error {
+	return fmt.Errorf("%w at position %d", err, pos)
+}
+
+// Returns the unquoted argument and the position just after the closing quote
+func tokenizeDoubleQuoted(line string, start int) (string, int, error) {
+	var sb strings.Builder
+	pos := start + 1
+
+	for pos < len(line) {
+		c := line[pos]
+		switch c {
+		case '"':
+			pos++
+			if pos < len(line) && !isSpace(line[pos]) {
+				return "", pos, positionError(ErrorQuoteNotClosed, pos)
+			}
+			return sb.String(), pos, nil
+
+		case '\\':
+			if pos+1 >= len(line) {
+				return "", pos, positionError(ErrorUnterminatedQuote, start)
+			}
+
+			switch e := line[pos+1]; e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'a':
+				sb.WriteByte('\a')
+			case '\\', '"', '\'':
+				sb.WriteByte(e)
+			case 'x':
+				if pos+3 >= len(line) {
+					return "", pos, positionError(ErrorInvalidEscape, pos)
+				}
+				hi, okHi := unhex(line[pos+2])
+				lo, okLo := unhex(line[pos+3])
+				if !okHi || !okLo {
+					return "", pos, positionError(ErrorInvalidEscape, pos)
+				}
+				sb.WriteByte(hi<<4 | lo)
+				pos += 2
+			default:
+				return "", pos, positionError(ErrorInvalidEscape, pos)
+			}
+			pos += 2
+
+		default:
+			sb.WriteByte(c)
+			pos++
+		}
+	}
+
+	return "", pos, positionError(ErrorUnterminatedQuote, start)
+}
+
+// Returns the unquoted argument and the position just after the closing quote
+func tokenizeSingleQuoted(line string, start int) (string, int, error) {
+	var sb strings.Builder
+	pos := start + 1
+
+	for pos < len(line) {
+		c := line[pos]
+		switch {
+		case c == '\\' && pos+1 < len(line) && (line[pos+1] == '\'' || line[pos+1] == '\\'):
+			sb.WriteByte(line[pos+1])
+			pos += 2
+
+		case c == '\'':
+			pos++
+			if pos < len(line) && !isSpace(line[pos]) {
+				return "", pos, positionError(ErrorQuoteNotClosed, pos)
+			}
+			return sb.String(), pos, nil
+
+		default:
+			sb.WriteByte(c)
+			pos++
+		}
+	}
+
+	return "", pos, positionError(ErrorUnterminatedQuote, start)
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
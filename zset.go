@@ -0,0 +1,537 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// A sorted set: scores by member, and the members ordered by score in a
+// skiplist for ranks and ranges
+type sortedSet struct {
+	scores map[string]float64
+	zsl    *skiplist
+}
+
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{scores: make(map[string]float64), zsl: newSkiplist()}
+}
+
+// Adds the member or moves it to its new score
+func (zs *sortedSet) set(member string, score float64) {
+	if old, found := zs.scores[member]; found {
+		if old == score {
+			return
+		}
+		zs.zsl.delete(old, member)
+	}
+	zs.scores[member] = score
+	zs.zsl.insert(score, member)
+}
+
+func (zs *sortedSet) remove(member string) bool {
+	score, found := zs.scores[member]
+	if !found {
+		return false
+	}
+	delete(zs.scores, member)
+	zs.zsl.delete(score, member)
+	return true
+}
+
+func (zs *sortedSet) len() int {
+	return len(zs.scores)
+}
+
+func (zs *sortedSet) clone() *sortedSet {
+	c := newSortedSet()
+	for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		c.set(x.member, x.score)
+	}
+	return c
+}
+
+// Every member in order
+func (zs *sortedSet) members() []ZMember {
+	members := make([]ZMember, 0, zs.len())
+	for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		members = append(members, ZMember{Member: x.member, Score: x.score})
+	}
+	return members
+}
+
+// Scores are written the shortest way that parses back to the same float
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// Like strconv.ParseFloat, which takes inf and -inf too, but not NaN
+func parseScore(s string) (float64, bool) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+	return score, true
+}
+
+// Returns the sorted set at key, nil if there is none. Must be called with
+// kvLock held.
+func (s *Storage) zsetLocked(key string) (*sortedSet, error) {
+	v, ok := s.KV[key]
+	if !ok || v.Expired() {
+		return nil, nil
+	}
+	if v.zset == nil {
+		return nil, ErrorWrongType
+	}
+	return v.zset, nil
+}
+
+// Which members ZAdd touches
+type ZAddOptions struct {
+	// Only add new members, or only update existing ones
+	NX, XX bool
+	// Only update when the new score is greater, or less. New members are
+	// added either way.
+	GT, LT bool
+	// Count updated members as well as new ones
+	CH bool
+}
+
+// Whether a member with the score old, if found, may get the score new
+func (o ZAddOptions) allows(old float64, found bool, new float64) bool {
+	if !found {
+		return !o.XX
+	}
+	return !o.NX && !(o.GT && new <= old) && !(o.LT && new >= old)
+}
+
+// ZAdd sets the scores of the members, creating the set if needed. Returns
+// how many members were added, or changed too with CH.
+func (s *Storage) ZAdd(key string, members []ZMember, opts ZAddOptions) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	zs, err := s.zsetLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	if zs == nil {
+		zs = newSortedSet()
+	}
+
+	entry := []string{"ZADD", key}
+	counted := 0
+	for _, m := range members {
+		old, found := zs.scores[m.Member]
+		if !opts.allows(old, found, m.Score) || (found && old == m.Score) {
+			continue
+		}
+		if !found || opts.CH {
+			counted++
+		}
+		zs.set(m.Member, m.Score)
+		entry = append(entry, formatScore(m.Score), m.Member)
+	}
+	if len(entry) == 2 {
+		return 0, nil
+	}
+
+	s.storeZSetLocked(key, zs)
+	s.log(entry...)
+	s.serveZSetWaitersLocked(key, zs)
+	return counted, nil
+}
+
+// ZIncrBy adds delta to the score of the member, a missing member counts as
+// 0. Reports the change as not applied if opts rule it out.
+func (s *Storage) ZIncrBy(key, member string, delta float64, opts ZAddOptions) (score float64, applied bool, err error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	zs, err := s.zsetLocked(key)
+	if err != nil {
+		return 0, false, err
+	}
+	if zs == nil {
+		zs = newSortedSet()
+	}
+
+	old, found := zs.scores[member]
+	score = old + delta
+	if math.IsNaN(score) {
+		return 0, false, ErrorScoreNaN
+	}
+	if !opts.allows(old, found, score) {
+		return 0, false, nil
+	}
+	if found && old == score {
+		return score, true, nil
+	}
+
+	zs.set(member, score)
+	s.storeZSetLocked(key, zs)
+	// Logged as the result, like HIncrBy
+	s.log("ZADD", key, formatScore(score), member)
+	s.serveZSetWaitersLocked(key, zs)
+	return score, true, nil
+}
+
+// Stores a new set, keeping the expiry of one already there. Must be called
+// with kvLock held.
+func (s *Storage) storeZSetLocked(key string, zs *sortedSet) {
+	if v, found := s.KV[key]; !found || v.zset != zs {
+		s.replaceLocked(key, Value{zset: zs})
+	}
+}
+
+// ZRem removes the members and returns how many of them were there. The key
+// is removed with its last member.
+func (s *Storage) ZRem(key string, members ...string) (int, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	zs, err := s.zsetLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	if zs == nil {
+		return 0, nil
+	}
+
+	entry := []string{"ZREM", key}
+	for _, m := range members {
+		if zs.remove(m) {
+			entry = append(entry, m)
+		}
+	}
+	if len(entry) == 2 {
+		return 0, nil
+	}
+
+	if zs.len() == 0 {
+		delete(s.KV, key)
+	}
+	s.log(entry...)
+	return len(entry) - 2, nil
+}
+
+// ZScore fails with ErrorKeyNotFound if either the key or the member is
+// missing
+func (s *Storage) ZScore(key, member string) (float64, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	zs, err := s.zsetLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	if zs == nil {
+		return 0, ErrorKeyNotFound
+	}
+	score, found := zs.scores[member]
+	if !found {
+		return 0, ErrorKeyNotFound
+	}
+	return score, nil
+}
+
+// ZRank returns the 0 based rank of the member, from the highest score with
+// rev. Fails with ErrorKeyNotFound if either the key or the member is missing.
+func (s *Storage) ZRank(key, member string, rev bool) (int, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	zs, err := s.zsetLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	if zs == nil {
+		return 0, ErrorKeyNotFound
+	}
+	score, found := zs.scores[member]
+	if !found {
+		return 0, ErrorKeyNotFound
+	}
+
+	rank := zs.zsl.rank(score, member) - 1
+	if rev {
+		rank = zs.len() - 1 - rank
+	}
+	return rank, nil
+}
+
+func (s *Storage) ZCard(key string) (int, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	zs, err := s.zsetLocked(key)
+	if err != nil || zs == nil {
+		return 0, err
+	}
+	return zs.len(), nil
+}
+
+// What ZRange selects
+type ZRangeBy int
+
+const (
+	// By 0 based rank, negative ranks count from the end
+	ZRangeByIndex ZRangeBy = iota
+	ZRangeByScore
+	// By member, for sets where every score is the same
+	ZRangeByLex
+)
+
+type ZRangeQuery struct {
+	By ZRangeBy
+	// Ranks for ZRangeByIndex, both included
+	Start, Stop int
+	Score       ScoreRange
+	Lex         LexRange
+	// From the highest score down. Ranks count from the end too.
+	Rev bool
+	// Skip Offset members of a score or lex range, then return up to Count,
+	// a negative Count returns the rest
+	Offset, Count int
+}
+
+// ZRange returns the members the query selects, in order
+func (s *Storage) ZRange(key string, q ZRangeQuery) ([]ZMember, error) {
+	s.kvLock.RLock()
+	defer s.kvLock.RUnlock()
+
+	zs, err := s.zsetLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	members := []ZMember{}
+	if zs == nil {
+		return members, nil
+	}
+
+	if q.By == ZRangeByIndex {
+		start, stop, n := q.Start, q.Stop, zs.len()
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= n {
+			stop = n - 1
+		}
+		if start > stop {
+			return members, nil
+		}
+
+		if !q.Rev {
+			for x := zs.zsl.byRank(start + 1); x != nil && len(members) <= stop-start; x = x.level[0].forward {
+				members = append(members, ZMember{Member: x.member, Score: x.score})
+			}
+		} else {
+			for x := zs.zsl.byRank(n - start); x != nil && len(members) <= stop-start; x = x.backward {
+				members = append(members, ZMember{Member: x.member, Score: x.score})
+			}
+		}
+		return members, nil
+	}
+
+	var r zrange = q.Score
+	if q.By == ZRangeByLex {
+		r = q.Lex
+	}
+
+	var x *skiplistNode
+	if !q.Rev {
+		x = zs.zsl.firstFrom(r)
+	} else {
+		x = zs.zsl.lastUpTo(r)
+	}
+	for skipped := 0; x != nil && q.Count != 0; {
+		if (!q.Rev && r.above(x)) || (q.Rev && r.below(x)) {
+			break
+		}
+		if skipped < q.Offset {
+			skipped++
+		} else {
+			members = append(members, ZMember{Member: x.member, Score: x.score})
+			if len(members) == q.Count {
+				break
+			}
+		}
+
+		if !q.Rev {
+			x = x.level[0].forward
+		} else {
+			x = x.backward
+		}
+	}
+	return members, nil
+}
+
+// ZPop removes and returns up to count members with the lowest scores, or the
+// highest with max
+func (s *Storage) ZPop(key string, count int, max bool) ([]ZMember, error) {
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	zs, err := s.zsetLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	if zs == nil {
+		return []ZMember{}, nil
+	}
+	return s.popLocked(key, zs, count, max), nil
+}
+
+// Must be called with kvLock held
+func (s *Storage) popLocked(key string, zs *sortedSet, count int, max bool) []ZMember {
+	popped := []ZMember{}
+	entry := []string{"ZREM", key}
+	for len(popped) < count && zs.len() > 0 {
+		x := zs.zsl.header.level[0].forward
+		if max {
+			x = zs.zsl.tail
+		}
+		popped = append(popped, ZMember{Member: x.member, Score: x.score})
+		entry = append(entry, x.member)
+		zs.remove(x.member)
+	}
+	if len(popped) == 0 {
+		return popped
+	}
+
+	if zs.len() == 0 {
+		delete(s.KV, key)
+	}
+	s.log(entry...)
+	return popped
+}
+
+type ZPopped struct {
+	Key string
+	ZMember
+}
+
+// A client blocked in BZPop, served by the add that gives one of its keys a
+// member, under kvLock
+type zsetWaiter struct {
+	keys []string
+	max  bool
+
+	popped ZPopped
+	served bool
+	ready  chan struct{} // closed once served
+}
+
+// BZPop pops like ZPop from the first of the keys with members, in argument
+// order. If they are all empty it waits until timeout for a member on any of
+// them, and fails with ErrorKeyNotFound if none comes. Clients waiting on the
+// same key are served in the order they started waiting.
+func (s *Storage) BZPop(keys []string, max bool, timeout *time.Time) (ZPopped, error) {
+	s.kvLock.Lock()
+
+	for _, key := range keys {
+		zs, err := s.zsetLocked(key)
+		if err != nil {
+			s.kvLock.Unlock()
+			return ZPopped{}, err
+		}
+		if zs != nil {
+			popped := s.popLocked(key, zs, 1, max)
+			s.kvLock.Unlock()
+			return ZPopped{Key: key, ZMember: popped[0]}, nil
+		}
+	}
+	if timeout == nil {
+		s.kvLock.Unlock()
+		return ZPopped{}, ErrorKeyNotFound
+	}
+
+	w := &zsetWaiter{max: max, ready: make(chan struct{})}
+	for _, key := range keys {
+		// The same key given twice waits once
+		if n := len(s.zsetWaiters[key]); n > 0 && s.zsetWaiters[key][n-1] == w {
+			continue
+		}
+		s.zsetWaiters[key] = append(s.zsetWaiters[key], w)
+		w.keys = append(w.keys, key)
+	}
+	s.kvLock.Unlock()
+
+	timer := time.NewTimer(time.Until(*timeout))
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return w.popped, nil
+	case <-timer.C:
+	}
+
+	s.kvLock.Lock()
+	defer s.kvLock.Unlock()
+
+	// Served between the timer firing and taking the lock
+	if w.served {
+		return w.popped, nil
+	}
+
+	s.unregisterZSetLocked(w)
+	return ZPopped{}, ErrorKeyNotFound
+}
+
+// Hands members to blocked clients, longest waiting first. Must be called
+// with kvLock held.
+func (s *Storage) serveZSetWaitersLocked(key string, zs *sortedSet) {
+	for len(s.zsetWaiters[key]) > 0 && zs.len() > 0 {
+		w := s.zsetWaiters[key][0]
+		popped := s.popLocked(key, zs, 1, w.max)
+		w.popped = ZPopped{Key: key, ZMember: popped[0]}
+		w.served = true
+		s.unregisterZSetLocked(w)
+		close(w.ready)
+	}
+}
+
+// Must be called with kvLock held
+func (s *Storage) unregisterZSetLocked(w *zsetWaiter) {
+	for _, key := range w.keys {
+		waiters := s.zsetWaiters[key]
+		for i, other := range waiters {
+			if other == w {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(s.zsetWaiters, key)
+		} else {
+			s.zsetWaiters[key] = waiters
+		}
+	}
+}
+
+// Every member as one ZADD, expiry is logged on its own
+func zsetLogEntry(key string, zs *sortedSet) []string {
+	entry := []string{"ZADD", key}
+	for _, m := range zs.members() {
+		entry = append(entry, formatScore(m.Score), m.Member)
+	}
+	return entry
+}